@@ -8,12 +8,31 @@ type Config struct {
 	Port          string `mapstructure:"port"`
 	SessionSecret string `mapstructure:"session_secret"`
 	SiteName      string `mapstructure:"site_name"`
+	// BaseURL is the public URL of the portal, used for links in emails.
+	BaseURL       string `mapstructure:"base_url"`
+	// TrustedProxies are the addresses or CIDRs allowed to set
+	// X-Forwarded-For; client IPs from anyone else are taken as-is.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	// MonitoringAddr is an internal listen address, such as
+	// "127.0.0.1:9090", serving detailed health. Empty disables it.
+	MonitoringAddr string `mapstructure:"monitoring_addr"`
 	
 	LDAP           LDAPConfig           `mapstructure:"ldap"`
 	Email          EmailConfig          `mapstructure:"email"`
 	SMS            SMSConfig            `mapstructure:"sms"`
 	JWT            JWTConfig            `mapstructure:"jwt"`
 	PasswordPolicy PasswordPolicyConfig `mapstructure:"password_policy"`
+	ExpiryReminders ExpiryReminderConfig `mapstructure:"expiry_reminders"`
+	VerificationStore VerificationStoreConfig `mapstructure:"verification_store"`
+	Verification      VerificationConfig      `mapstructure:"verification"`
+	RateLimit         RateLimitConfig         `mapstructure:"rate_limit"`
+	Reset             ResetConfig             `mapstructure:"reset"`
+	SecurityQuestions SecurityQuestionConfig  `mapstructure:"security_questions"`
+	TOTP              TOTPConfig              `mapstructure:"totp"`
+	OTP               OTPConfig               `mapstructure:"otp"`
+	WebAuthn          WebAuthnConfig          `mapstructure:"webauthn"`
+	Session           SessionConfig           `mapstructure:"session"`
+	SessionStore      SessionStoreConfig      `mapstructure:"session_store"`
 }
 
 type LDAPConfig struct {
@@ -29,6 +48,27 @@ type LDAPConfig struct {
 	SSHKeyAttr       string `mapstructure:"ssh_key_attr"`
 	EmailAttr        string `mapstructure:"email_attr"`
 	PhoneAttr        string `mapstructure:"phone_attr"`
+	UsernameAttr     string `mapstructure:"username_attr"`
+	// DirectoryType selects how passwords are written: "" for the RFC 3062
+	// Password Modify operation, "ad" for Active Directory's unicodePwd.
+	DirectoryType    string `mapstructure:"directory_type"`
+	Pool             LDAPPoolConfig `mapstructure:"pool"`
+	// URLs is an ordered list of ldap:// or ldaps:// servers used for reads,
+	// MasterURL the server that receives writes. When both are empty the
+	// Host/Port settings above are used.
+	URLs                []string `mapstructure:"urls"`
+	MasterURL           string   `mapstructure:"master_url"`
+	HealthCheckInterval int      `mapstructure:"health_check_interval"`
+}
+
+// LDAPPoolConfig bounds the pool of service-bound connections. Durations
+// are in seconds.
+type LDAPPoolConfig struct {
+	MaxOpen       int `mapstructure:"max_open"`
+	MaxIdle       int `mapstructure:"max_idle"`
+	IdleTimeout   int `mapstructure:"idle_timeout"`
+	ProbeInterval int `mapstructure:"probe_interval"`
+	WaitTimeout   int `mapstructure:"wait_timeout"`
 }
 
 type EmailConfig struct {
@@ -50,6 +90,26 @@ type SMSConfig struct {
 type JWTConfig struct {
 	Secret     string `mapstructure:"secret"`
 	Expiration int    `mapstructure:"expiration"`
+	// RefreshExpiration is how long, in seconds, a refresh token stays
+	// valid. Each refresh issues a new one.
+	RefreshExpiration int `mapstructure:"refresh_expiration"`
+	// Issuer and Audience are set in every session token and required
+	// when validating, unless empty. Restricted tokens get Audience with
+	// a "#restricted" suffix instead.
+	Issuer   string `mapstructure:"issuer"`
+	Audience string `mapstructure:"audience"`
+	// Keys replace Secret with asymmetric keys. Tokens are signed with
+	// SigningKey, by default the first key, and verified with any of them.
+	Keys       []JWTKeyConfig `mapstructure:"keys"`
+	SigningKey string         `mapstructure:"signing_key"`
+}
+
+// JWTKeyConfig is a PEM key file: an RSA (RS256), P-256 (ES256) or Ed25519
+// (EdDSA) private key, or only the public key for a retired key that still
+// verifies older tokens. ID is the kid, by default the RFC 7638 thumbprint.
+type JWTKeyConfig struct {
+	ID   string `mapstructure:"id"`
+	File string `mapstructure:"file"`
 }
 
 type PasswordPolicyConfig struct {
@@ -61,9 +121,159 @@ type PasswordPolicyConfig struct {
 	MinSpecial         int    `mapstructure:"min_special"`
 	SpecialChars       string `mapstructure:"special_chars"`
 	NoReuse            bool   `mapstructure:"no_reuse"`
+	HistoryCount       int    `mapstructure:"history_count"`
+	HistoryFile        string `mapstructure:"history_file"`
+	MaxAge             int    `mapstructure:"max_age"`
 	DiffLogin          bool   `mapstructure:"diff_login"`
 	Complexity         int    `mapstructure:"complexity"`
 	UsePwnedPasswords  bool   `mapstructure:"use_pwned_passwords"`
+	// Offline Have I Been Pwned corpus: a sorted HASH:COUNT file or a
+	// directory of per-prefix range files.
+	PwnedPasswordsPath     string `mapstructure:"pwned_passwords_path"`
+	PwnedPasswordsMmap     bool   `mapstructure:"pwned_passwords_mmap"`
+	PwnedPasswordsMinCount int    `mapstructure:"pwned_passwords_min_count"`
+}
+
+// ExpiryReminderConfig controls the background job that emails users whose
+// password is about to expire. Windows are in days before expiry; Interval
+// is in seconds. Sent reminders are recorded in the verification store.
+type ExpiryReminderConfig struct {
+	Enabled  bool  `mapstructure:"enabled"`
+	Interval int   `mapstructure:"interval"`
+	Windows  []int `mapstructure:"windows"`
+}
+
+// VerificationStoreConfig selects where pending email and SMS codes are
+// kept: "memory", "bolt" (an embedded database at Path) or "redis".
+type VerificationStoreConfig struct {
+	Type      string `mapstructure:"type"`
+	Path      string `mapstructure:"path"`
+	RedisURL  string `mapstructure:"redis_url"`
+	KeyPrefix string `mapstructure:"key_prefix"`
+}
+
+// SessionStoreConfig selects where active sessions are tracked: "memory",
+// "bolt" (an embedded database at Path) or "redis". Use a shared store when
+// running several replicas so a sign-out applies everywhere.
+type SessionStoreConfig struct {
+	Type      string `mapstructure:"type"`
+	Path      string `mapstructure:"path"`
+	RedisURL  string `mapstructure:"redis_url"`
+	KeyPrefix string `mapstructure:"key_prefix"`
+}
+
+// VerificationConfig limits guessing of verification codes. MaxAttempts
+// wrong codes invalidate a challenge; UserMaxFailures or IPMaxFailures
+// failures within FailureWindow lock the username or client address out
+// for LockoutDuration. Durations are in seconds; zero disables a limit.
+type VerificationConfig struct {
+	MaxAttempts     int `mapstructure:"max_attempts"`
+	UserMaxFailures int `mapstructure:"user_max_failures"`
+	IPMaxFailures   int `mapstructure:"ip_max_failures"`
+	FailureWindow   int `mapstructure:"failure_window"`
+	LockoutDuration int `mapstructure:"lockout_duration"`
+}
+
+// RateLimitConfig throttles the sending of reset codes. Store is "memory"
+// or "redis"; intervals are in seconds.
+type RateLimitConfig struct {
+	Enabled        bool       `mapstructure:"enabled"`
+	Store          string     `mapstructure:"store"`
+	RedisURL       string     `mapstructure:"redis_url"`
+	KeyPrefix      string     `mapstructure:"key_prefix"`
+	IP             RateBucket `mapstructure:"ip"`
+	Username       RateBucket `mapstructure:"username"`
+	Destination    RateBucket `mapstructure:"destination"`
+	ResendInterval int        `mapstructure:"resend_interval"`
+	DailyCap       int        `mapstructure:"daily_cap"`
+}
+
+// RateBucket is a token bucket holding up to Burst requests that regains
+// one every Interval seconds.
+type RateBucket struct {
+	Burst    int `mapstructure:"burst"`
+	Interval int `mapstructure:"interval"`
+}
+
+// ResetConfig tunes the password reset request endpoint. With
+// AntiEnumeration every request gets the same answer after ResponseTime
+// milliseconds, whether or not the account exists. MagicLink adds the
+// "link" method, which emails a reset link valid for LinkTTL seconds.
+type ResetConfig struct {
+	AntiEnumeration bool `mapstructure:"anti_enumeration"`
+	ResponseTime    int  `mapstructure:"response_time"`
+	MagicLink       bool `mapstructure:"magic_link"`
+	LinkTTL         int  `mapstructure:"link_ttl"`
+}
+
+// SecurityQuestionConfig enables the "questions" reset method. Users answer
+// at least MinEnrolled of Questions from the dashboard and a reset asks Ask
+// of them at random. Hashed answers are kept in Attribute on the user's
+// entry, or in StoreFile when no attribute is set.
+type SecurityQuestionConfig struct {
+	Enabled         bool     `mapstructure:"enabled"`
+	Questions       []string `mapstructure:"questions"`
+	MinEnrolled     int      `mapstructure:"min_enrolled"`
+	Ask             int      `mapstructure:"ask"`
+	MinAnswerLength int      `mapstructure:"min_answer_length"`
+	Attribute       string   `mapstructure:"attribute"`
+	StoreFile       string   `mapstructure:"store_file"`
+}
+
+// TOTPConfig enables authenticator app codes as a second login factor.
+// Enrolled users enter a code within PreAuthTTL seconds of their password;
+// with Required, users who have not enrolled can only enroll. Skew is the
+// number of 30-second steps accepted either side of the current one.
+// Secrets are kept in Attribute on the user's entry or, encrypted with
+// EncryptionKey, in StoreFile.
+type TOTPConfig struct {
+	Enabled       bool   `mapstructure:"enabled"`
+	Required      bool   `mapstructure:"required"`
+	Issuer        string `mapstructure:"issuer"`
+	Skew          int    `mapstructure:"skew"`
+	PreAuthTTL    int    `mapstructure:"pre_auth_ttl"`
+	Attribute     string `mapstructure:"attribute"`
+	StoreFile     string `mapstructure:"store_file"`
+	EncryptionKey string `mapstructure:"encryption_key"`
+}
+
+// OTPConfig enables the "otp" reset method for FreeIPA users with OTP
+// tokens. Verify is "key" to check codes against ipatokenOTPkey with the
+// service account, or "bind" to have FreeIPA check the user's current
+// password followed by the code. TokenBaseDN defaults to cn=otp under
+// base_dn. HOTPWindow is how far ahead of the stored counter a HOTP code may
+// be; TOTPSkew is how many time steps either side of now are accepted.
+type OTPConfig struct {
+	Enabled     bool   `mapstructure:"enabled"`
+	Verify      string `mapstructure:"verify"`
+	TokenBaseDN string `mapstructure:"token_base_dn"`
+	HOTPWindow  int    `mapstructure:"hotp_window"`
+	TOTPSkew    int    `mapstructure:"totp_skew"`
+}
+
+// WebAuthnConfig enables passkeys for signing in and as the "passkey" reset
+// method. RPID is the domain passkeys are bound to and RPOrigins the
+// origins allowed to use them; both are derived from base_url when unset.
+// Credentials are kept in Attribute on the user's entry or in StoreFile.
+type WebAuthnConfig struct {
+	Enabled       bool     `mapstructure:"enabled"`
+	RPID          string   `mapstructure:"rp_id"`
+	RPDisplayName string   `mapstructure:"rp_display_name"`
+	RPOrigins     []string `mapstructure:"rp_origins"`
+	Attribute     string   `mapstructure:"attribute"`
+	StoreFile     string   `mapstructure:"store_file"`
+}
+
+// SessionConfig controls browser sessions kept in an HttpOnly cookie,
+// encrypted with session_secret. With Cookies enabled, logins also set the
+// cookie and the API accepts it in place of a bearer token, with a CSRF
+// token required on requests that change anything. SameSite is "lax",
+// "strict" or "none"; MaxAge is in seconds.
+type SessionConfig struct {
+	Cookies  bool   `mapstructure:"cookies"`
+	Secure   bool   `mapstructure:"secure"`
+	SameSite string `mapstructure:"same_site"`
+	MaxAge   int    `mapstructure:"max_age"`
 }
 
 func Load() (*Config, error) {
@@ -83,11 +293,56 @@ func Load() (*Config, error) {
 	viper.SetDefault("ldap.ssh_key_attr", "sshPublicKey")
 	viper.SetDefault("ldap.email_attr", "mail")
 	viper.SetDefault("ldap.phone_attr", "mobile")
+	viper.SetDefault("ldap.username_attr", "uid")
+	viper.SetDefault("ldap.health_check_interval", 30)
+	viper.SetDefault("ldap.pool.max_open", 10)
+	viper.SetDefault("ldap.pool.max_idle", 5)
+	viper.SetDefault("ldap.pool.idle_timeout", 300)
+	viper.SetDefault("ldap.pool.probe_interval", 30)
+	viper.SetDefault("ldap.pool.wait_timeout", 10)
 	viper.SetDefault("email.smtp_port", 587)
 	viper.SetDefault("jwt.expiration", 3600)
+	viper.SetDefault("jwt.refresh_expiration", 604800)
+	viper.SetDefault("session.secure", true)
+	viper.SetDefault("session.same_site", "lax")
+	viper.SetDefault("session.max_age", 604800)
 	viper.SetDefault("password_policy.min_length", 8)
 	viper.SetDefault("password_policy.max_length", 128)
 	viper.SetDefault("password_policy.complexity", 3)
+	viper.SetDefault("password_policy.history_count", 5)
+	viper.SetDefault("password_policy.pwned_passwords_min_count", 1)
+	viper.SetDefault("expiry_reminders.interval", 3600)
+	viper.SetDefault("expiry_reminders.windows", []int{14, 7, 1})
+	viper.SetDefault("verification_store.type", "memory")
+	viper.SetDefault("verification_store.key_prefix", "ldap-self-service:")
+	viper.SetDefault("session_store.type", "memory")
+	viper.SetDefault("session_store.key_prefix", "ldap-self-service:")
+	viper.SetDefault("verification.max_attempts", 5)
+	viper.SetDefault("verification.user_max_failures", 10)
+	viper.SetDefault("verification.ip_max_failures", 20)
+	viper.SetDefault("verification.failure_window", 900)
+	viper.SetDefault("verification.lockout_duration", 900)
+	viper.SetDefault("rate_limit.enabled", true)
+	viper.SetDefault("rate_limit.store", "memory")
+	viper.SetDefault("rate_limit.key_prefix", "ldap-self-service:")
+	viper.SetDefault("rate_limit.ip.burst", 10)
+	viper.SetDefault("rate_limit.ip.interval", 60)
+	viper.SetDefault("rate_limit.username.burst", 5)
+	viper.SetDefault("rate_limit.username.interval", 300)
+	viper.SetDefault("rate_limit.destination.burst", 3)
+	viper.SetDefault("rate_limit.destination.interval", 600)
+	viper.SetDefault("rate_limit.resend_interval", 60)
+	viper.SetDefault("rate_limit.daily_cap", 10)
+	viper.SetDefault("reset.response_time", 1000)
+	viper.SetDefault("reset.link_ttl", 1800)
+	viper.SetDefault("security_questions.min_enrolled", 3)
+	viper.SetDefault("security_questions.ask", 2)
+	viper.SetDefault("security_questions.min_answer_length", 3)
+	viper.SetDefault("totp.skew", 1)
+	viper.SetDefault("totp.pre_auth_ttl", 300)
+	viper.SetDefault("otp.verify", "key")
+	viper.SetDefault("otp.hotp_window", 10)
+	viper.SetDefault("otp.totp_skew", 1)
 
 	viper.AutomaticEnv()
 
@@ -1,14 +1,26 @@
 package handlers
 
 import (
+	"errors"
+	"io"
+	"ldap-self-service/internal/middleware"
 	"ldap-self-service/internal/models"
 	"ldap-self-service/internal/services"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func Login(ldapService *services.LDAPService, authService *services.AuthService) gin.HandlerFunc {
+// restrictedTokenTTL bounds the tokens issued to users who must change an
+// expired password or set up two-factor authentication first.
+const restrictedTokenTTL = 10 * time.Minute
+
+// Login checks the password. Users with an authenticator get a pre-auth
+// token to exchange at LoginTOTP instead of a session; totpService is nil
+// when TOTP is disabled.
+func Login(ldapService *services.LDAPService, authService *services.AuthService, totpService *services.TOTPService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req models.LoginRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -16,47 +28,307 @@ func Login(ldapService *services.LDAPService, authService *services.AuthService)
 			return
 		}
 
-		user, err := ldapService.Authenticate(req.Username, req.Password)
+		user, expiry, err := ldapService.Authenticate(req.Username, req.Password)
+		if err != nil {
+			if errors.Is(err, services.ErrUserNotFound) {
+				err = services.ErrInvalidCredentials
+			}
+			respondError(c, err, "Login failed")
+			return
+		}
+
+		scope := ""
+		if expiry.Expired || expiry.MustChange {
+			// The password was accepted but has to be replaced first.
+			scope = services.ScopePasswordChange
+		}
+
+		if totpService != nil {
+			enrolled, err := totpService.Enrolled(user.DN)
+			if err != nil {
+				respondError(c, err, "Login failed")
+				return
+			}
+
+			if enrolled {
+				preAuthToken, err := authService.GeneratePreAuthToken(user.Username, user.DN, scope, totpService.PreAuthTTL())
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+					return
+				}
+
+				c.JSON(http.StatusOK, gin.H{
+					"totpRequired": true,
+					"preAuthToken": preAuthToken,
+				})
+				return
+			}
+
+			if totpService.Required() && scope == "" {
+				scope = services.ScopeTOTPEnroll
+			}
+		}
+
+		respondWithSession(c, authService, user, expiry, scope)
+	}
+}
+
+// LoginTOTP exchanges a pre-auth token from Login and an authenticator
+// code for a session.
+func LoginTOTP(ldapService *services.LDAPService, authService *services.AuthService, totpService *services.TOTPService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.TOTPLoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		claims, err := authService.ValidateToken(req.PreAuthToken)
+		if err != nil || claims.Scope != services.ScopePreAuth {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, sign in again"})
+			return
+		}
+
+		if err := totpService.Verify(claims.Username, claims.DN, req.Code); err != nil {
+			respondError(c, err, "Failed to verify code")
+			return
+		}
+		// The pre-auth token is spent.
+		if err := authService.Revoke(claims); err != nil {
+			log.Printf("Failed to revoke pre-auth token for %s: %v", claims.Username, err)
+		}
+
+		user, err := ldapService.GetUser(claims.Username)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			respondError(c, err, "Login failed")
 			return
 		}
 
-		token, err := authService.GenerateToken(user.Username, user.DN)
+		// Expiry details were reported to the first step only; all that
+		// matters now is whether the password must be changed.
+		expiry := &models.PasswordExpiry{Expired: claims.NextScope == services.ScopePasswordChange}
+		respondWithSession(c, authService, user, expiry, claims.NextScope)
+	}
+}
+
+// respondWithSession issues the login token: a full session with a refresh
+// token when scope is empty, otherwise a short-lived token restricted to
+// scope. With cookie sessions enabled the tokens are also set in the session
+// cookie and the response carries its CSRF token.
+func respondWithSession(c *gin.Context, authService *services.AuthService, user *models.User, expiry *models.PasswordExpiry, scope string) {
+	response := gin.H{
+		"user":           user,
+		"passwordExpiry": expiry,
+	}
+
+	var refreshToken string
+	if scope == "" {
+		session, err := authService.GenerateSession(user.Username, user.DN, c.Request.UserAgent(), c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+		response["token"] = session.AccessToken
+		response["refreshToken"] = session.RefreshToken
+		refreshToken = session.RefreshToken
+	} else {
+		token, err := authService.GenerateScopedToken(user.Username, user.DN, scope, restrictedTokenTTL)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 			return
 		}
+		response["token"] = token
+	}
 
-		c.JSON(http.StatusOK, gin.H{
-			"token": token,
-			"user":  user,
-		})
+	csrfToken, err := middleware.SaveSessionTokens(c, response["token"].(string), refreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+		return
+	}
+	if csrfToken != "" {
+		response["csrfToken"] = csrfToken
 	}
+
+	switch scope {
+	case services.ScopePasswordChange:
+		response["passwordExpired"] = true
+	case services.ScopeTOTPEnroll:
+		response["totpEnrollmentRequired"] = true
+	}
+	c.JSON(http.StatusOK, response)
 }
 
-func VerifyEmail(emailService *services.EmailService) gin.HandlerFunc {
+// RefreshToken exchanges a refresh token for a new access and refresh
+// token. The old refresh token stops working. Without a refreshToken in the
+// body the session cookie's is used, and the new tokens only go back into
+// the cookie.
+func RefreshToken(authService *services.AuthService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var req models.VerificationRequest
-		if err := c.ShouldBindJSON(&req); err != nil {
+		var req models.RefreshTokenRequest
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		valid, email := emailService.VerifyCode(req.Token, req.Code)
-		if !valid {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid verification code"})
+		if req.RefreshToken == "" {
+			refreshFromCookie(c, authService)
+			return
+		}
+
+		session, err := authService.Refresh(req.RefreshToken)
+		if err != nil {
+			respondError(c, err, "Failed to refresh token")
 			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
-			"verified": true,
-			"email":    email,
+			"token":        session.AccessToken,
+			"refreshToken": session.RefreshToken,
+			"expiresAt":    session.ExpiresAt,
 		})
 	}
 }
 
-func VerifySMS(smsService *services.SMSService) gin.HandlerFunc {
+func refreshFromCookie(c *gin.Context, authService *services.AuthService) {
+	refreshToken := middleware.SessionRefreshToken(c)
+	if refreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "refreshToken is required"})
+		return
+	}
+	if !middleware.ValidCSRF(c) {
+		respondError(c, services.ErrInvalidCSRFToken, "Missing or invalid CSRF token")
+		return
+	}
+
+	session, err := authService.Refresh(refreshToken)
+	if err != nil {
+		respondError(c, err, "Failed to refresh token")
+		return
+	}
+	if err := middleware.RotateSessionTokens(c, session.AccessToken, session.RefreshToken); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"expiresAt": session.ExpiresAt})
+}
+
+// Logout revokes the caller's token and, for a full session, its refresh
+// tokens, and deletes the session cookie.
+func Logout(authService *services.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("tokenClaims").(*services.Claims)
+		if err := authService.Revoke(claims); err != nil {
+			respondError(c, err, "Failed to log out")
+			return
+		}
+		if err := middleware.ClearSession(c); err != nil {
+			log.Printf("Failed to clear session cookie: %v", err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+	}
+}
+
+// ListSessions returns the caller's active sessions, flagging the one the
+// request was made with.
+func ListSessions(authService *services.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("tokenClaims").(*services.Claims)
+
+		sessions, err := authService.Sessions(claims.DN)
+		if err != nil {
+			respondError(c, err, "Failed to list sessions")
+			return
+		}
+
+		response := make([]gin.H, 0, len(sessions))
+		for _, session := range sessions {
+			response = append(response, gin.H{
+				"id":         session.ID,
+				"userAgent":  session.UserAgent,
+				"ip":         session.IP,
+				"createdAt":  session.CreatedAt,
+				"lastSeenAt": session.LastSeenAt,
+				"expiresAt":  session.ExpiresAt,
+				"current":    session.ID == claims.SessionID,
+			})
+		}
+
+		c.JSON(http.StatusOK, gin.H{"sessions": response})
+	}
+}
+
+// DeleteSession signs the caller out of one of their sessions. Ending the
+// current session also deletes the session cookie.
+func DeleteSession(authService *services.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("tokenClaims").(*services.Claims)
+		sessionID := c.Param("id")
+
+		if err := authService.RevokeSession(claims.DN, sessionID); err != nil {
+			respondError(c, err, "Failed to sign out session")
+			return
+		}
+		if sessionID == claims.SessionID {
+			if err := middleware.ClearSession(c); err != nil {
+				log.Printf("Failed to clear session cookie: %v", err)
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Session signed out"})
+	}
+}
+
+// JWKS publishes the public keys tokens are signed with so other services
+// can verify them.
+func JWKS(authService *services.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, authService.JWKS())
+	}
+}
+
+// reauthenticate checks the caller's current password before a change that
+// would let a stolen session take over the account for good, such as new
+// recovery answers or a new second factor. Restricted TOTP enrollment
+// tokens are exempt, as they are only issued right after a password login.
+// It writes the error response and returns false when the check fails.
+func reauthenticate(c *gin.Context, ldapService *services.LDAPService, password string) bool {
+	if c.GetString("tokenScope") == services.ScopeTOTPEnroll {
+		return true
+	}
+
+	err := ldapService.VerifyPassword(c.GetString("userDN"), password)
+	if errors.Is(err, services.ErrInvalidCredentials) {
+		err = services.ErrReauthRequired
+	}
+	if err != nil {
+		respondError(c, err, "Failed to verify your password")
+		return false
+	}
+	return true
+}
+
+// revokeUserTokens signs userDN out everywhere after a password change.
+// The change has already happened, so a failure is only logged.
+func revokeUserTokens(authService *services.AuthService, userDN string) {
+	if err := authService.RevokeUser(userDN); err != nil {
+		log.Printf("Failed to revoke tokens for %s: %v", userDN, err)
+	}
+}
+
+func VerifyEmail(challenges *services.ChallengeManager) gin.HandlerFunc {
+	return verifyChallenge(challenges, "email")
+}
+
+func VerifySMS(challenges *services.ChallengeManager) gin.HandlerFunc {
+	return verifyChallenge(challenges, "sms")
+}
+
+// verifyChallenge confirms a code issued through channel and reports the
+// verified destination under the channel's name.
+func verifyChallenge(challenges *services.ChallengeManager, channel string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req models.VerificationRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -64,15 +336,19 @@ func VerifySMS(smsService *services.SMSService) gin.HandlerFunc {
 			return
 		}
 
-		valid, phone := smsService.VerifyCode(req.Token, req.Code)
-		if !valid {
+		challenge, err := challenges.Verify(req.Token, services.ChallengeResponse{Code: req.Code}, channel, c.ClientIP())
+		if err != nil {
+			respondError(c, err, "Failed to verify code")
+			return
+		}
+		if challenge == nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid verification code"})
 			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
 			"verified": true,
-			"phone":    phone,
+			channel:    challenge.Destination,
 		})
 	}
-}
\ No newline at end of file
+}
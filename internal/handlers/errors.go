@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"ldap-self-service/internal/services"
+	"log"
+	"net/http"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errorStatus = map[services.ErrorKind]int{
+	services.KindInvalidRequest:       http.StatusBadRequest,
+	services.KindInvalidCredentials:   http.StatusUnauthorized,
+	services.KindUserNotFound:         http.StatusNotFound,
+	services.KindAccountLocked:        http.StatusForbidden,
+	services.KindAccountDisabled:      http.StatusForbidden,
+	services.KindPasswordExpired:      http.StatusForbidden,
+	services.KindPasswordMustChange:   http.StatusForbidden,
+	services.KindPasswordTooYoung:     http.StatusConflict,
+	services.KindPolicyViolation:      http.StatusBadRequest,
+	services.KindInsufficientAccess:   http.StatusForbidden,
+	services.KindTooManyAttempts:      http.StatusTooManyRequests,
+	services.KindInvalidCode:          http.StatusUnauthorized,
+	services.KindTOTPRequired:         http.StatusForbidden,
+	services.KindInvalidToken:         http.StatusUnauthorized,
+	services.KindInvalidCSRFToken:     http.StatusForbidden,
+	services.KindSessionNotFound:      http.StatusNotFound,
+	services.KindReauthRequired:       http.StatusForbidden,
+	services.KindDirectoryUnavailable: http.StatusServiceUnavailable,
+	services.KindDirectoryError:       http.StatusInternalServerError,
+}
+
+// respondError writes a classified error as {"error", "code"} JSON with a
+// stable code and status. Unclassified errors are logged and reported with
+// the fallback message so directory details never reach the client.
+func respondError(c *gin.Context, err error, fallback string) {
+	kind := services.ErrorKindOf(err)
+
+	var policyErr *services.PolicyError
+	if errors.As(err, &policyErr) {
+		if policyErr.Err != nil {
+			log.Printf("%s: %v", fallback, policyErr.Err)
+		}
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      policyErr.Error(),
+			"code":       kind,
+			"violations": policyErr.Violations,
+		})
+		return
+	}
+
+	var throttleErr *services.ThrottleError
+	if errors.As(err, &throttleErr) {
+		c.Header("Retry-After", strconv.Itoa(throttleErr.RetryAfterSeconds()))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":      capitalize(throttleErr.Message),
+			"code":       kind,
+			"retryAfter": throttleErr.RetryAfterSeconds(),
+		})
+		return
+	}
+
+	status := errorStatus[kind]
+	message := fallback
+
+	var serviceErr *services.ServiceError
+	if errors.As(err, &serviceErr) && kind != services.KindDirectoryError {
+		message = capitalize(serviceErr.Message)
+	}
+
+	if status >= http.StatusInternalServerError {
+		log.Printf("%s: %v", fallback, err)
+	}
+
+	c.JSON(status, gin.H{"error": message, "code": kind})
+}
+
+func capitalize(message string) string {
+	r, size := utf8.DecodeRuneInString(message)
+	return string(unicode.ToUpper(r)) + message[size:]
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"ldap-self-service/internal/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Health reports only the overall status, since it is served publicly.
+func Health(ldapService *services.LDAPService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, code := healthStatus(ldapService)
+		c.JSON(code, gin.H{"status": status})
+	}
+}
+
+// HealthDetails adds per-server LDAP health, errors and pool metrics. It is
+// only served on the internal monitoring listener, as server URLs and
+// directory errors must not be public.
+func HealthDetails(ldapService *services.LDAPService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, code := healthStatus(ldapService)
+		read, write := ldapService.Available()
+
+		c.JSON(code, gin.H{
+			"status": status,
+			"ldap": gin.H{
+				"read":    read,
+				"write":   write,
+				"servers": ldapService.ServerStatus(),
+			},
+		})
+	}
+}
+
+func healthStatus(ldapService *services.LDAPService) (string, int) {
+	read, write := ldapService.Available()
+	if !read || !write {
+		return "unavailable", http.StatusServiceUnavailable
+	}
+
+	for _, server := range ldapService.ServerStatus() {
+		if !server.Up {
+			return "degraded", http.StatusOK
+		}
+	}
+	return "ok", http.StatusOK
+}
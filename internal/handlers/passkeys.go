@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"errors"
+	"ldap-self-service/internal/models"
+	"ldap-self-service/internal/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func ListPasskeys(passkeys *services.PasskeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		list, err := passkeys.List(c.GetString("userDN"))
+		if err != nil {
+			respondError(c, err, "Failed to load passkeys")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"passkeys": list})
+	}
+}
+
+// BeginPasskeyRegistration returns the options for
+// navigator.credentials.create and a token for FinishPasskeyRegistration,
+// once the user's current password is confirmed.
+func BeginPasskeyRegistration(ldapService *services.LDAPService, passkeys *services.PasskeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.ReauthenticationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !reauthenticate(c, ldapService, req.CurrentPassword) {
+			return
+		}
+
+		user, err := ldapService.GetUser(c.GetString("username"))
+		if err != nil {
+			respondError(c, err, "Failed to register passkey")
+			return
+		}
+
+		token, options, err := passkeys.BeginRegistration(user)
+		if err != nil {
+			respondError(c, err, "Failed to register passkey")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"token": token, "options": options})
+	}
+}
+
+func FinishPasskeyRegistration(ldapService *services.LDAPService, passkeys *services.PasskeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.PasskeyFinishRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := ldapService.GetUser(c.GetString("username"))
+		if err != nil {
+			respondError(c, err, "Failed to register passkey")
+			return
+		}
+
+		passkey, err := passkeys.FinishRegistration(user, req.Token, req.Name, req.Credential)
+		if err != nil {
+			respondError(c, err, "Failed to register passkey")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Passkey registered", "passkey": passkey})
+	}
+}
+
+func DeletePasskey(passkeys *services.PasskeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := passkeys.Delete(c.GetString("userDN"), c.Param("id")); err != nil {
+			respondError(c, err, "Failed to remove passkey")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Passkey removed"})
+	}
+}
+
+// BeginPasskeyLogin returns the options for navigator.credentials.get and
+// a token for FinishPasskeyLogin. Unknown users and users without passkeys
+// get decoy options, so the answer doesn't reveal either.
+func BeginPasskeyLogin(ldapService *services.LDAPService, passkeys *services.PasskeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.PasskeyLoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := ldapService.GetUser(req.Username)
+		if errors.Is(err, services.ErrUserNotFound) {
+			user, err = nil, nil
+		}
+		if err != nil {
+			respondError(c, err, "Login failed")
+			return
+		}
+
+		token, options, err := passkeys.BeginLogin(req.Username, user)
+		if err != nil {
+			respondError(c, err, "Login failed")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"token": token, "options": options})
+	}
+}
+
+// FinishPasskeyLogin verifies the assertion and issues a session, subject to
+// the same account state as a password login: locked and disabled accounts
+// are refused, and an expired password restricts the session to changing
+// it.
+func FinishPasskeyLogin(ldapService *services.LDAPService, authService *services.AuthService, passkeys *services.PasskeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.PasskeyFinishRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		username, err := passkeys.FinishLogin(req.Token, req.Credential)
+		if err != nil {
+			respondError(c, err, "Login failed")
+			return
+		}
+
+		user, err := ldapService.GetUser(username)
+		if err != nil {
+			respondError(c, err, "Login failed")
+			return
+		}
+
+		expiry, err := ldapService.AccountStatus(user.DN)
+		if err != nil {
+			respondError(c, err, "Login failed")
+			return
+		}
+
+		scope := ""
+		if expiry.Expired || expiry.MustChange {
+			scope = services.ScopePasswordChange
+		}
+		respondWithSession(c, authService, user, expiry, scope)
+	}
+}
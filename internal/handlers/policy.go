@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"errors"
+	"ldap-self-service/internal/models"
+	"ldap-self-service/internal/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetPasswordPolicy(ldapService *services.LDAPService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"rules": ldapService.PasswordPolicy().Rules(),
+		})
+	}
+}
+
+func CheckPassword(ldapService *services.LDAPService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.PasswordCheckRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		violations := []services.PolicyViolation{}
+		if err := ldapService.CheckPassword(req.Username, req.Password); err != nil {
+			var policyErr *services.PolicyError
+			if !errors.As(err, &policyErr) {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check password"})
+				return
+			}
+			if policyErr.Err != nil {
+				log.Printf("Failed to check password: %v", policyErr.Err)
+			}
+			violations = policyErr.Violations
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"valid":      len(violations) == 0,
+			"violations": violations,
+			"strength":   ldapService.PasswordPolicy().EstimateStrength(req.Password),
+		})
+	}
+}
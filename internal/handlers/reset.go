@@ -1,63 +1,109 @@
 package handlers
 
 import (
+	"ldap-self-service/internal/config"
 	"ldap-self-service/internal/models"
 	"ldap-self-service/internal/services"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func RequestPasswordReset(ldapService *services.LDAPService, emailService *services.EmailService, smsService *services.SMSService) gin.HandlerFunc {
+// GetResetOptions lists the reset methods available to a user with masked
+// destinations. In anti-enumeration mode it lists every method without
+// destinations, whoever the user is.
+func GetResetOptions(cfg *config.Config, ldapService *services.LDAPService, challenges *services.ChallengeManager) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var req models.PasswordResetRequest
+		var req models.PasswordResetOptionsRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		// Get user from LDAP to validate username and get contact info
+		if cfg.Reset.AntiEnumeration {
+			c.JSON(http.StatusOK, gin.H{"options": challenges.Methods()})
+			return
+		}
+
 		user, err := ldapService.GetUser(req.Username)
 		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			respondError(c, err, "Failed to look up user")
 			return
 		}
 
-		var token string
-		var err2 error
+		c.JSON(http.StatusOK, gin.H{"options": challenges.Options(user)})
+	}
+}
+
+func RequestPasswordReset(cfg *config.Config, ldapService *services.LDAPService, challenges *services.ChallengeManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
 
-		switch req.Method {
-		case "email":
-			if user.Email == "" {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "No email address configured for this user"})
-				return
-			}
-			token, err2 = emailService.SendVerificationCode(user.Email, user.Username)
-		case "sms":
-			if user.Phone == "" {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "No phone number configured for this user"})
+		var req models.PasswordResetRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		channel, err := challenges.Channel(req.Method)
+		if err != nil {
+			respondError(c, err, "Invalid reset method")
+			return
+		}
+
+		if cfg.Reset.AntiEnumeration {
+			// Answer identically for every username, existing or not, and
+			// do the lookup and send after responding.
+			token, err := challenges.IssueDeferred(channel, req.Destination, func() (*models.User, error) {
+				return ldapService.GetUser(req.Username)
+			})
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification code"})
 				return
 			}
-			token, err2 = smsService.SendVerificationCode(user.Phone, user.Username)
-		default:
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reset method. Use 'email' or 'sms'"})
+
+			time.Sleep(time.Until(start.Add(time.Duration(cfg.Reset.ResponseTime) * time.Millisecond)))
+			c.JSON(http.StatusOK, gin.H{
+				"message": "If the account exists, a verification code has been sent",
+				"token":   token,
+				"method":  req.Method,
+			})
 			return
 		}
 
-		if err2 != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification code"})
+		// Get user from LDAP to validate username and get contact info
+		user, err := ldapService.GetUser(req.Username)
+		if err != nil {
+			respondError(c, err, "Failed to look up user")
+			return
+		}
+
+		challenge, err := challenges.Issue(channel, user, req.Destination)
+		if err != nil {
+			respondError(c, err, "Failed to send verification code")
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
+		response := gin.H{
 			"message": "Verification code sent",
-			"token":   token,
+			"token":   challenge.Token,
 			"method":  req.Method,
-		})
+		}
+		if len(challenge.Prompt) > 0 {
+			response["message"] = "Answer the security questions"
+			response["questions"] = challenge.Prompt
+		}
+		if len(challenge.Options) > 0 {
+			response["message"] = "Confirm with your passkey"
+			response["options"] = challenge.Options
+		}
+		c.JSON(http.StatusOK, response)
 	}
 }
 
-func ResetPassword(ldapService *services.LDAPService, emailService *services.EmailService, smsService *services.SMSService) gin.HandlerFunc {
+func ResetPassword(ldapService *services.LDAPService, authService *services.AuthService, challenges *services.ChallengeManager) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req models.PasswordResetConfirm
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -65,45 +111,60 @@ func ResetPassword(ldapService *services.LDAPService, emailService *services.Ema
 			return
 		}
 
-		// Get the username BEFORE verifying the code (since VerifyCode deletes the token)
-		var username string
-		if smsService.HasToken(req.Token) {
-			username = smsService.GetUsernameForToken(req.Token)
-		} else if emailService.HasToken(req.Token) {
-			username = emailService.GetUsernameForToken(req.Token)
-		}
-		
-		if username == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token or token expired"})
+		// Check the new password against the policy first, so a rejected
+		// one doesn't use up the code or link.
+		pending, err := challenges.Lookup(req.Token)
+		if err != nil {
+			respondError(c, err, "Failed to verify code")
 			return
 		}
-
-		// Now try to verify the code with both email and SMS services
-		valid, _ := emailService.VerifyCode(req.Token, req.Code)
-		if !valid {
-			valid, _ = smsService.VerifyCode(req.Token, req.Code)
+		if pending != nil {
+			if err := ldapService.CheckPassword(pending.Username, req.NewPassword); err != nil {
+				respondError(c, err, "Failed to check password")
+				return
+			}
 		}
 
-		if !valid {
+		response := services.ChallengeResponse{
+			Code:       req.Code,
+			Answers:    req.Answers,
+			Password:   req.CurrentPassword,
+			Credential: req.Credential,
+		}
+		challenge, err := challenges.Verify(req.Token, response, "", c.ClientIP())
+		if err != nil {
+			respondError(c, err, "Failed to verify code")
+			return
+		}
+		if challenge == nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification code"})
 			return
 		}
-		
-		// Get user by username
-		user, err := ldapService.GetUser(username)
 
+		// Get user by username
+		user, err := ldapService.GetUser(challenge.Username)
 		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			releaseChallenge(challenges, challenge)
+			respondError(c, err, "Failed to look up user")
 			return
 		}
 
-		// Reset password using admin privileges
-		if err := ldapService.ResetPassword(user.DN, req.NewPassword); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		// Reset password using admin privileges. The history check and the
+		// directory's own policy can still refuse it; give the challenge
+		// back so the user can pick another password.
+		if err := ldapService.ResetPassword(user.DN, user.Username, req.NewPassword); err != nil {
+			releaseChallenge(challenges, challenge)
+			respondError(c, err, "Failed to reset password")
 			return
 		}
+		revokeUserTokens(authService, user.DN)
 
 		c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
 	}
 }
 
+func releaseChallenge(challenges *services.ChallengeManager, challenge *services.VerificationCode) {
+	if err := challenges.Release(challenge); err != nil {
+		log.Printf("Failed to restore verification code for %s: %v", challenge.Username, err)
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"ldap-self-service/internal/models"
+	"ldap-self-service/internal/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetSecurityQuestions returns the question catalog and which questions
+// the user has already answered.
+func GetSecurityQuestions(questions *services.SecurityQuestionService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		enrolled, err := questions.Enrolled(c.GetString("userDN"))
+		if err != nil {
+			respondError(c, err, "Failed to load security questions")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"questions":   questions.Catalog(),
+			"enrolled":    enrolled,
+			"minEnrolled": questions.MinEnrolled(),
+		})
+	}
+}
+
+// SetSecurityQuestions replaces the user's security answers once their
+// current password is confirmed.
+func SetSecurityQuestions(ldapService *services.LDAPService, questions *services.SecurityQuestionService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.SecurityQuestionsRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !reauthenticate(c, ldapService, req.CurrentPassword) {
+			return
+		}
+
+		if err := questions.Enroll(c.GetString("userDN"), req.Answers); err != nil {
+			respondError(c, err, "Failed to save security questions")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Security questions saved"})
+	}
+}
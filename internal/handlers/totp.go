@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"ldap-self-service/internal/models"
+	"ldap-self-service/internal/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetTOTPStatus reports whether the user has an authenticator set up.
+func GetTOTPStatus(totpService *services.TOTPService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		enrolled, err := totpService.Enrolled(c.GetString("userDN"))
+		if err != nil {
+			respondError(c, err, "Failed to load two-factor settings")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"enrolled": enrolled,
+			"required": totpService.Required(),
+		})
+	}
+}
+
+// BeginTOTPEnrollment returns a new secret and its provisioning URI and QR
+// code once the user's current password is confirmed. The secret takes
+// effect once ConfirmTOTPEnrollment succeeds.
+func BeginTOTPEnrollment(ldapService *services.LDAPService, totpService *services.TOTPService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.ReauthenticationRequest
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !reauthenticate(c, ldapService, req.CurrentPassword) {
+			return
+		}
+
+		enrollment, err := totpService.BeginEnrollment(c.GetString("username"), c.GetString("userDN"))
+		if err != nil {
+			respondError(c, err, "Failed to set up two-factor authentication")
+			return
+		}
+
+		c.JSON(http.StatusOK, enrollment)
+	}
+}
+
+func ConfirmTOTPEnrollment(totpService *services.TOTPService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.TOTPCodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := totpService.ConfirmEnrollment(c.GetString("username"), c.GetString("userDN"), req.Code); err != nil {
+			respondError(c, err, "Failed to set up two-factor authentication")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled"})
+	}
+}
+
+func DisableTOTP(totpService *services.TOTPService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.TOTPCodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := totpService.Disable(c.GetString("username"), c.GetString("userDN"), req.Code); err != nil {
+			respondError(c, err, "Failed to turn off two-factor authentication")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication turned off"})
+	}
+}
@@ -1,15 +1,17 @@
 package handlers
 
 import (
+	"ldap-self-service/internal/middleware"
 	"ldap-self-service/internal/models"
 	"ldap-self-service/internal/services"
+	"log"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
-func UpdatePassword(ldapService *services.LDAPService) gin.HandlerFunc {
+func UpdatePassword(ldapService *services.LDAPService, authService *services.AuthService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req models.PasswordChangeRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -23,10 +25,15 @@ func UpdatePassword(ldapService *services.LDAPService) gin.HandlerFunc {
 		}
 
 		userDN := c.GetString("userDN")
-		if err := ldapService.UpdatePassword(userDN, req.CurrentPassword, req.NewPassword); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if err := ldapService.UpdatePassword(userDN, c.GetString("username"), req.CurrentPassword, req.NewPassword); err != nil {
+			respondError(c, err, "Failed to update password")
 			return
 		}
+		// This signs out the caller too.
+		revokeUserTokens(authService, userDN)
+		if err := middleware.ClearSession(c); err != nil {
+			log.Printf("Failed to clear session cookie: %v", err)
+		}
 
 		c.JSON(http.StatusOK, gin.H{"message": "Password updated successfully"})
 	}
@@ -37,7 +44,7 @@ func GetProfile(ldapService *services.LDAPService) gin.HandlerFunc {
 		username := c.GetString("username")
 		user, err := ldapService.GetUser(username)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user profile"})
+			respondError(c, err, "Failed to get user profile")
 			return
 		}
 
@@ -50,7 +57,7 @@ func GetSSHKeys(ldapService *services.LDAPService) gin.HandlerFunc {
 		username := c.GetString("username")
 		user, err := ldapService.GetUser(username)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SSH keys"})
+			respondError(c, err, "Failed to get SSH keys")
 			return
 		}
 
@@ -68,7 +75,7 @@ func AddSSHKey(ldapService *services.LDAPService) gin.HandlerFunc {
 
 		userDN := c.GetString("userDN")
 		if err := ldapService.AddSSHKey(userDN, req.PublicKey); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, err, "Failed to add SSH key")
 			return
 		}
 
@@ -90,7 +97,7 @@ func DeleteSSHKey(ldapService *services.LDAPService) gin.HandlerFunc {
 		
 		user, err := ldapService.GetUser(username)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+			respondError(c, err, "Failed to get user")
 			return
 		}
 
@@ -101,7 +108,7 @@ func DeleteSSHKey(ldapService *services.LDAPService) gin.HandlerFunc {
 
 		sshKey := user.SSHKeys[keyID].PublicKey
 		if err := ldapService.RemoveSSHKey(userDN, sshKey); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, err, "Failed to remove SSH key")
 			return
 		}
 
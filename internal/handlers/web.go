@@ -21,6 +21,7 @@ func LoginPage(cfg *config.Config) gin.HandlerFunc {
 		c.HTML(http.StatusOK, "login.html", gin.H{
 			"title":     "Login - " + cfg.SiteName,
 			"site_name": cfg.SiteName,
+			"passkeys":  cfg.WebAuthn.Enabled,
 		})
 	}
 }
@@ -39,6 +40,8 @@ func ResetPasswordPage(cfg *config.Config) gin.HandlerFunc {
 		c.HTML(http.StatusOK, "reset.html", gin.H{
 			"title":     "Reset Password - " + cfg.SiteName,
 			"site_name": cfg.SiteName,
+			// OTP codes checked by binding need the current password too.
+			"otp_needs_password": cfg.OTP.Verify == "bind",
 		})
 	}
 }
\ No newline at end of file
@@ -2,38 +2,97 @@ package middleware
 
 import (
 	"ldap-self-service/internal/services"
+	"log"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
+// scopedRoutes lists the routes a restricted token may call, by scope.
+var scopedRoutes = map[string][]string{
+	services.ScopePasswordChange: {"PUT /api/v1/password", "POST /api/v1/logout"},
+	services.ScopeTOTPEnroll:     {"GET /api/v1/totp", "POST /api/v1/totp/enroll", "POST /api/v1/totp/confirm", "POST /api/v1/logout"},
+}
+
+// scopeErrors is the response to a restricted token used on any other
+// route. Scopes without an entry, such as pre-auth tokens, are invalid.
+var scopeErrors = map[string]gin.H{
+	services.ScopePasswordChange: {"error": "Token is restricted to a password change", "code": services.KindPasswordExpired},
+	services.ScopeTOTPEnroll:     {"error": "Two-factor authentication must be set up first", "code": services.KindTOTPRequired},
+}
+
+// AuthRequired accepts a bearer token or, with cookie sessions enabled, the
+// session cookie, and rejects tokens whose session has been signed out.
+// Cookie-authenticated requests other than GET and HEAD
+// must carry the session's CSRF token, since browsers send cookies along
+// with cross-site requests.
 func AuthRequired() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
+		var tokenString string
 		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
-			return
+			tokenString = sessionValue(c, sessionTokenKey)
+			if tokenString == "" {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+				c.Abort()
+				return
+			}
+			if !safeMethod(c.Request.Method) && !ValidCSRF(c) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token", "code": services.KindInvalidCSRFToken})
+				c.Abort()
+				return
+			}
+		} else {
+			tokenString = strings.TrimPrefix(authHeader, "Bearer ")
+			if tokenString == authHeader {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Bearer token required"})
+				c.Abort()
+				return
+			}
 		}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		if tokenString == authHeader {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Bearer token required"})
+		authService := c.MustGet("authService").(*services.AuthService)
+		claims, err := authService.ValidateToken(tokenString)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token", "code": services.KindInvalidToken})
 			c.Abort()
 			return
 		}
 
-		authService := c.MustGet("authService").(*services.AuthService)
-		claims, err := authService.ValidateToken(tokenString)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		if claims.Scope != "" && !scopeAllows(claims.Scope, c.Request.Method+" "+c.FullPath()) {
+			if body, ok := scopeErrors[claims.Scope]; ok {
+				c.JSON(http.StatusForbidden, body)
+			} else {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token", "code": services.KindInvalidToken})
+			}
 			c.Abort()
 			return
 		}
 
+		if claims.SessionID != "" {
+			if err := authService.TouchSession(claims.SessionID, c.ClientIP()); err != nil {
+				log.Printf("Failed to update session %s: %v", claims.SessionID, err)
+			}
+		}
+
 		c.Set("username", claims.Username)
 		c.Set("userDN", claims.DN)
+		c.Set("tokenScope", claims.Scope)
+		c.Set("tokenClaims", claims)
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+func scopeAllows(scope, route string) bool {
+	for _, allowed := range scopedRoutes[scope] {
+		if allowed == route {
+			return true
+		}
+	}
+	return false
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
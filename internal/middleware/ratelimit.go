@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"errors"
+	"ldap-self-service/internal/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit throttles requests per client IP. Limits that depend on the
+// request body, such as per-username ones, are applied by the services.
+func RateLimit(limiter *services.RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var throttleErr *services.ThrottleError
+		if err := limiter.AllowIP(c.ClientIP()); errors.As(err, &throttleErr) {
+			c.Header("Retry-After", strconv.Itoa(throttleErr.RetryAfterSeconds()))
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error":      "Too many requests, try again later",
+				"code":       services.KindTooManyAttempts,
+				"retryAfter": throttleErr.RetryAfterSeconds(),
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
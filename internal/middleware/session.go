@@ -1,26 +1,168 @@
 package middleware
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"ldap-self-service/internal/config"
+	"net/http"
+	"strings"
+
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/sessions"
 )
 
-func SessionMiddleware(secret string) gin.HandlerFunc {
-	store := sessions.NewCookieStore([]byte(secret))
+const (
+	sessionCookieName = "ldap-session"
+	// csrfCookieName holds a copy of the CSRF token that scripts can read
+	// and send back in csrfHeaderName.
+	csrfCookieName = "ldap-csrf"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// Values kept in the session cookie.
+const (
+	sessionTokenKey   = "token"
+	sessionRefreshKey = "refreshToken"
+	sessionCSRFKey    = "csrf"
+)
+
+// SessionMiddleware loads the encrypted session cookie into the context as
+// "session". It only carries tokens when session.cookies is enabled.
+func SessionMiddleware(secret string, cfg config.SessionConfig) (gin.HandlerFunc, error) {
+	sameSite, err := parseSameSite(cfg.SameSite)
+	if err != nil {
+		return nil, err
+	}
+
+	hashKey := sha256.Sum256([]byte("ldap-session-auth:" + secret))
+	blockKey := sha256.Sum256([]byte("ldap-session-encryption:" + secret))
+	store := sessions.NewCookieStore(hashKey[:], blockKey[:])
 	store.Options = &sessions.Options{
 		Path:     "/",
-		MaxAge:   86400 * 7,
+		MaxAge:   cfg.MaxAge,
 		HttpOnly: true,
-		Secure:   false,
-		SameSite: 1,
+		Secure:   cfg.Secure,
+		SameSite: sameSite,
 	}
+	store.MaxAge(cfg.MaxAge)
 
 	return func(c *gin.Context) {
-		session, err := store.Get(c.Request, "ldap-session")
+		session, err := store.Get(c.Request, sessionCookieName)
 		if err != nil {
-			session, _ = store.New(c.Request, "ldap-session")
+			session, _ = store.New(c.Request, sessionCookieName)
 		}
 		c.Set("session", session)
+		c.Set("sessionConfig", cfg)
 		c.Next()
+	}, nil
+}
+
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("invalid session.same_site %q, use lax, strict or none", value)
+	}
+}
+
+// SaveSessionTokens keeps a login's tokens in the session cookie with a new
+// CSRF token, which it returns. It does nothing and returns "" when cookie
+// sessions are disabled. Call it before writing the response body.
+func SaveSessionTokens(c *gin.Context, accessToken, refreshToken string) (string, error) {
+	session, cfg := currentSession(c)
+	if session == nil || !cfg.Cookies {
+		return "", nil
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	csrfToken := base64.RawURLEncoding.EncodeToString(raw)
+
+	session.Values[sessionTokenKey] = accessToken
+	session.Values[sessionRefreshKey] = refreshToken
+	session.Values[sessionCSRFKey] = csrfToken
+	session.Options.MaxAge = cfg.MaxAge
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		return "", err
 	}
-}
\ No newline at end of file
+	setCSRFCookie(c, session, csrfToken, cfg.MaxAge)
+	return csrfToken, nil
+}
+
+// RotateSessionTokens replaces the tokens in the session cookie after a
+// refresh, keeping the CSRF token.
+func RotateSessionTokens(c *gin.Context, accessToken, refreshToken string) error {
+	session, _ := currentSession(c)
+	if session == nil {
+		return nil
+	}
+
+	session.Values[sessionTokenKey] = accessToken
+	session.Values[sessionRefreshKey] = refreshToken
+	return session.Save(c.Request, c.Writer)
+}
+
+// ClearSession deletes the session and CSRF cookies.
+func ClearSession(c *gin.Context) error {
+	session, _ := currentSession(c)
+	if session == nil || session.IsNew {
+		return nil
+	}
+
+	session.Values = map[interface{}]interface{}{}
+	session.Options.MaxAge = -1
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		return err
+	}
+	setCSRFCookie(c, session, "", -1)
+	return nil
+}
+
+// SessionRefreshToken returns the refresh token in the session cookie, or "".
+func SessionRefreshToken(c *gin.Context) string {
+	return sessionValue(c, sessionRefreshKey)
+}
+
+// ValidCSRF reports whether the request carries the session's CSRF token
+// in the X-CSRF-Token header.
+func ValidCSRF(c *gin.Context) bool {
+	expected := sessionValue(c, sessionCSRFKey)
+	actual := c.GetHeader(csrfHeaderName)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
+
+func sessionValue(c *gin.Context, key string) string {
+	session, cfg := currentSession(c)
+	if session == nil || !cfg.Cookies {
+		return ""
+	}
+	value, _ := session.Values[key].(string)
+	return value
+}
+
+func currentSession(c *gin.Context) (*sessions.Session, config.SessionConfig) {
+	session, _ := c.MustGet("session").(*sessions.Session)
+	cfg, _ := c.MustGet("sessionConfig").(config.SessionConfig)
+	return session, cfg
+}
+
+func setCSRFCookie(c *gin.Context, session *sessions.Session, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    value,
+		Path:     session.Options.Path,
+		MaxAge:   maxAge,
+		Secure:   session.Options.Secure,
+		SameSite: session.Options.SameSite,
+	})
+}
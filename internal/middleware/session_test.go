@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"ldap-self-service/internal/config"
+	"ldap-self-service/internal/services"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newSessionRouter serves /login, which stores a session in the cookie and
+// returns its CSRF token, and GET and POST /api/v1/me behind AuthRequired.
+func newSessionRouter(t *testing.T, cfg config.SessionConfig) (*gin.Engine, *services.TokenPair) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	authService, err := services.NewAuthService(&config.Config{JWT: config.JWTConfig{Secret: "test-secret", Expiration: 300, RefreshExpiration: 3600}},
+		services.NewMemoryVerificationStore(), services.NewMemorySessionStore())
+	if err != nil {
+		t.Fatalf("NewAuthService: %v", err)
+	}
+	pair, err := authService.GenerateSession("alice", "uid=alice,dc=example,dc=com", "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("GenerateSession: %v", err)
+	}
+
+	session, err := SessionMiddleware("session-secret", cfg)
+	if err != nil {
+		t.Fatalf("SessionMiddleware: %v", err)
+	}
+
+	router := gin.New()
+	router.Use(session, func(c *gin.Context) {
+		c.Set("authService", authService)
+		c.Next()
+	})
+	router.POST("/login", func(c *gin.Context) {
+		csrfToken, err := SaveSessionTokens(c, pair.AccessToken, pair.RefreshToken)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"csrfToken": csrfToken})
+	})
+	me := func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"username": c.GetString("username")})
+	}
+	router.GET("/api/v1/me", AuthRequired(), me)
+	router.POST("/api/v1/me", AuthRequired(), me)
+	return router, pair
+}
+
+// login returns the cookies set by /login.
+func login(t *testing.T, router *gin.Engine) []*http.Cookie {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/login", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("login = %d %s", recorder.Code, recorder.Body)
+	}
+	return recorder.Result().Cookies()
+}
+
+func findCookie(cookies []*http.Cookie, name string) *http.Cookie {
+	for _, cookie := range cookies {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestAuthRequiredCSRF(t *testing.T) {
+	router, pair := newSessionRouter(t, config.SessionConfig{Cookies: true, MaxAge: 3600})
+	cookies := login(t, router)
+	csrfCookie := findCookie(cookies, csrfCookieName)
+	if csrfCookie == nil || csrfCookie.Value == "" {
+		t.Fatal("login did not set the CSRF cookie")
+	}
+	if csrfCookie.HttpOnly {
+		t.Fatal("the CSRF cookie is HttpOnly, so scripts can't read it")
+	}
+	sessionCookie := findCookie(cookies, sessionCookieName)
+	if sessionCookie == nil || !sessionCookie.HttpOnly {
+		t.Fatal("login did not set an HttpOnly session cookie")
+	}
+
+	// Another login has a CSRF token of its own.
+	otherCSRF := findCookie(login(t, router), csrfCookieName).Value
+
+	tests := []struct {
+		name    string
+		method  string
+		session bool
+		csrf    string
+		bearer  string
+		want    int
+	}{
+		{name: "GET without a token", method: http.MethodGet, session: true, want: http.StatusOK},
+		{name: "POST with the token", method: http.MethodPost, session: true, csrf: csrfCookie.Value, want: http.StatusOK},
+		{name: "POST without a token", method: http.MethodPost, session: true, want: http.StatusForbidden},
+		{name: "POST with a wrong token", method: http.MethodPost, session: true, csrf: "forged", want: http.StatusForbidden},
+		{name: "POST with another session's token", method: http.MethodPost, session: true, csrf: otherCSRF, want: http.StatusForbidden},
+		{name: "POST with a token but no session", method: http.MethodPost, csrf: csrfCookie.Value, want: http.StatusUnauthorized},
+		{name: "bearer POST needs no token", method: http.MethodPost, bearer: pair.AccessToken, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, "/api/v1/me", nil)
+			if tt.session {
+				request.AddCookie(sessionCookie)
+				request.AddCookie(csrfCookie)
+			}
+			if tt.csrf != "" {
+				request.Header.Set(csrfHeaderName, tt.csrf)
+			}
+			if tt.bearer != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != tt.want {
+				t.Fatalf("%s = %d %s, want %d", tt.method, recorder.Code, recorder.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthRequiredCookiesDisabled(t *testing.T) {
+	router, _ := newSessionRouter(t, config.SessionConfig{MaxAge: 3600})
+
+	cookies := login(t, router)
+	if len(cookies) != 0 {
+		t.Fatalf("login set cookies %v with cookie sessions disabled", cookies)
+	}
+
+	// A session cookie minted while cookies were enabled is ignored.
+	enabled, _ := newSessionRouter(t, config.SessionConfig{Cookies: true, MaxAge: 3600})
+	cookies = login(t, enabled)
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/me", nil)
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	request.Header.Set(csrfHeaderName, findCookie(cookies, csrfCookieName).Value)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("POST = %d %s, want %d", recorder.Code, recorder.Body, http.StatusUnauthorized)
+	}
+}
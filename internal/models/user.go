@@ -1,12 +1,19 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type User struct {
 	DN          string    `json:"dn"`
 	Username    string    `json:"username"`
 	Email       string    `json:"email"`
 	Phone       string    `json:"phone"`
+	// Emails and Phones hold every value of the mail and phone attributes;
+	// Email and Phone are the first of each.
+	Emails      []string  `json:"emails,omitempty"`
+	Phones      []string  `json:"phones,omitempty"`
 	FirstName   string    `json:"firstName"`
 	LastName    string    `json:"lastName"`
 	SSHKeys     []SSHKey  `json:"sshKeys"`
@@ -14,6 +21,17 @@ type User struct {
 	UpdatedAt   time.Time `json:"updatedAt"`
 }
 
+// PasswordExpiry describes when a user's password expires. Expired or
+// MustChange mean the password was accepted but has to be changed before
+// the account can be used normally.
+type PasswordExpiry struct {
+	ExpiresAt            *time.Time `json:"expiresAt,omitempty"`
+	DaysUntilExpiry      *int       `json:"daysUntilExpiry,omitempty"`
+	GraceLoginsRemaining *int       `json:"graceLoginsRemaining,omitempty"`
+	Expired              bool       `json:"expired"`
+	MustChange           bool       `json:"mustChange"`
+}
+
 type SSHKey struct {
 	ID          string    `json:"id"`
 	Name        string    `json:"name"`
@@ -38,18 +56,76 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+type TOTPLoginRequest struct {
+	PreAuthToken string `json:"preAuthToken" binding:"required"`
+	Code         string `json:"code" binding:"required"`
+}
+
+// RefreshTokenRequest may leave RefreshToken empty to use the one in the
+// session cookie.
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type PasskeyLoginRequest struct {
+	Username string `json:"username" binding:"required"`
+}
+
+// PasskeyFinishRequest completes a WebAuthn ceremony started with Token.
+// Credential is the PublicKeyCredential returned by the browser, as JSON.
+type PasskeyFinishRequest struct {
+	Token      string          `json:"token" binding:"required"`
+	Name       string          `json:"name"` // for registrations
+	Credential json.RawMessage `json:"credential" binding:"required"`
+}
+
 type SSHKeyRequest struct {
 	Name      string `json:"name" binding:"required"`
 	PublicKey string `json:"publicKey" binding:"required"`
 }
 
+type PasswordCheckRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password" binding:"required"`
+}
+
 type PasswordResetRequest struct {
+	Username    string `json:"username" binding:"required"`
+	Method      string `json:"method" binding:"required"` // a registered channel, e.g. "email" or "sms"
+	Destination int    `json:"destination"`                // index into the method's destinations from /reset-password/options
+}
+
+type PasswordResetOptionsRequest struct {
 	Username string `json:"username" binding:"required"`
-	Method   string `json:"method" binding:"required"` // "email" or "sms"
 }
 
+// PasswordResetConfirm answers the challenge issued by /reset-password with
+// whichever of Code, Answers or Credential its method asks for.
 type PasswordResetConfirm struct {
-	Token       string `json:"token" binding:"required"`
-	Code        string `json:"code" binding:"required"`
-	NewPassword string `json:"newPassword" binding:"required,min=3"`
+	Token           string          `json:"token" binding:"required"`
+	Code            string          `json:"code"`
+	Answers         []string        `json:"answers"`         // answers to the questions returned by /reset-password, in order
+	CurrentPassword string          `json:"currentPassword"` // for the "otp" method when codes are checked by binding
+	Credential      json.RawMessage `json:"credential"`      // WebAuthn assertion for the "passkey" method
+	NewPassword     string          `json:"newPassword" binding:"required,min=3"`
+}
+
+type SecurityAnswer struct {
+	Question string `json:"question" binding:"required"`
+	Answer   string `json:"answer" binding:"required"`
+}
+
+type SecurityQuestionsRequest struct {
+	Answers         []SecurityAnswer `json:"answers" binding:"required,dive"`
+	CurrentPassword string           `json:"currentPassword"`
+}
+
+// ReauthenticationRequest confirms the user's current password before a
+// change to how they sign in or recover their account.
+type ReauthenticationRequest struct {
+	CurrentPassword string `json:"currentPassword"`
 }
\ No newline at end of file
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"fmt"
+	"ldap-self-service/internal/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// accountStatusAttributes record whether the directory would refuse a bind
+// whatever the password: nsAccountLock (FreeIPA, 389 DS), ppolicy lockout
+// and reset, Active Directory account control, and shadow and Kerberos
+// account expiry.
+var accountStatusAttributes = []string{
+	"nsAccountLock",
+	"pwdAccountLockedTime",
+	"pwdPolicySubentry",
+	"pwdReset",
+	"userAccountControl",
+	"msDS-User-Account-Control-Computed",
+	"pwdLastSet",
+	"shadowExpire",
+	"krbPrincipalExpiration",
+}
+
+// Active Directory userAccountControl and
+// msDS-User-Account-Control-Computed flags.
+const (
+	adAccountDisable  = 0x2
+	adLockout         = 0x10
+	adPasswordExpired = 0x800000
+)
+
+// permanentLockTime is the pwdAccountLockedTime ppolicy records when an
+// administrator locks the account; it never times out.
+const permanentLockTime = "000001010000Z"
+
+// AccountStatus reports what a bind as the user at userDN would, without
+// the password: ErrAccountLocked or ErrAccountDisabled when the directory
+// would refuse it, otherwise the state of the password's expiry. Logins
+// that don't present the password, such as passkeys, use it to apply the
+// same restrictions as Authenticate.
+func (s *LDAPService) AccountStatus(userDN string) (*models.PasswordExpiry, error) {
+	conn, err := s.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	searchRequest := ldap.NewSearchRequest(
+		userDN,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		1,
+		0,
+		false,
+		"(objectClass=*)",
+		append(append([]string{}, accountStatusAttributes...), expiryAttributes...),
+		nil,
+	)
+
+	sr, err := conn.Search(searchRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account status: %w", s.translateError(err, nil))
+	}
+	if len(sr.Entries) == 0 {
+		return nil, ErrUserNotFound
+	}
+	entry := sr.Entries[0]
+
+	now := time.Now()
+	lockoutDuration := func() (time.Duration, bool) {
+		return s.lockoutDuration(conn, entry.GetAttributeValue("pwdPolicySubentry"))
+	}
+	if err := accountRefusal(entry, now, lockoutDuration); err != nil {
+		return nil, err
+	}
+
+	expiry := s.buildPasswordExpiry(entry, nil, now)
+	if strings.EqualFold(entry.GetAttributeValue("pwdReset"), "TRUE") || entry.GetAttributeValue("pwdLastSet") == "0" {
+		expiry.MustChange = true
+	}
+	if adFlags(entry, "msDS-User-Account-Control-Computed")&adPasswordExpired != 0 {
+		expiry.Expired = true
+	}
+	return expiry, nil
+}
+
+// accountRefusal returns the error a bind would fail with for the account
+// in entry. lockoutDuration gives the ppolicy pwdLockoutDuration, and is
+// only consulted for accounts with a pwdAccountLockedTime; an unknown
+// duration counts the lock as still in force.
+func accountRefusal(entry *ldap.Entry, now time.Time, lockoutDuration func() (time.Duration, bool)) error {
+	if strings.EqualFold(entry.GetAttributeValue("nsAccountLock"), "TRUE") {
+		return ErrAccountDisabled
+	}
+	if adFlags(entry, "userAccountControl")&adAccountDisable != 0 {
+		return ErrAccountDisabled
+	}
+	if adFlags(entry, "msDS-User-Account-Control-Computed")&adLockout != 0 {
+		return ErrAccountLocked
+	}
+
+	if lockedAt := entry.GetAttributeValue("pwdAccountLockedTime"); lockedAt != "" {
+		if lockedAt == permanentLockTime {
+			return ErrAccountLocked
+		}
+		locked, err := time.Parse(generalizedTime, lockedAt)
+		duration, known := lockoutDuration()
+		if err != nil || !known || duration == 0 || now.Before(locked.Add(duration)) {
+			return ErrAccountLocked
+		}
+	}
+
+	// shadowExpire counts days since 1970-01-01; -1 means never.
+	if days, err := strconv.Atoi(entry.GetAttributeValue("shadowExpire")); err == nil && days >= 0 {
+		if !now.Before(time.Unix(0, 0).UTC().AddDate(0, 0, days)) {
+			return ErrAccountDisabled
+		}
+	}
+	if value := entry.GetAttributeValue("krbPrincipalExpiration"); value != "" {
+		if expires, err := time.Parse(generalizedTime, value); err == nil && !now.Before(expires) {
+			return ErrAccountDisabled
+		}
+	}
+
+	return nil
+}
+
+// lockoutDuration reads pwdLockoutDuration from the ppolicy entry at
+// policyDN. known is false when there is no policy entry or it can't be
+// read.
+func (s *LDAPService) lockoutDuration(conn *PooledConn, policyDN string) (duration time.Duration, known bool) {
+	if policyDN == "" {
+		return 0, false
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		policyDN,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		1,
+		0,
+		false,
+		"(objectClass=*)",
+		[]string{"pwdLockoutDuration"},
+		nil,
+	)
+
+	sr, err := conn.Search(searchRequest)
+	if err != nil || len(sr.Entries) == 0 {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(sr.Entries[0].GetAttributeValue("pwdLockoutDuration"))
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func adFlags(entry *ldap.Entry, attribute string) int64 {
+	flags, _ := strconv.ParseInt(entry.GetAttributeValue(attribute), 10, 64)
+	return flags
+}
@@ -0,0 +1,50 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestAccountRefusal(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	hourAgo := now.Add(-time.Hour).Format(generalizedTime)
+
+	tests := []struct {
+		name       string
+		attributes map[string][]string
+		lockout    time.Duration
+		known      bool
+		want       error
+	}{
+		{name: "active", want: nil},
+		{name: "FreeIPA disabled", attributes: map[string][]string{"nsAccountLock": {"TRUE"}}, want: ErrAccountDisabled},
+		{name: "FreeIPA enabled", attributes: map[string][]string{"nsAccountLock": {"FALSE"}}, want: nil},
+		{name: "AD disabled", attributes: map[string][]string{"userAccountControl": {"514"}}, want: ErrAccountDisabled},
+		{name: "AD normal account", attributes: map[string][]string{"userAccountControl": {"512"}}, want: nil},
+		{name: "AD locked out", attributes: map[string][]string{"msDS-User-Account-Control-Computed": {"16"}}, want: ErrAccountLocked},
+		{name: "ppolicy locked by administrator", attributes: map[string][]string{"pwdAccountLockedTime": {permanentLockTime}}, known: true, lockout: time.Minute, want: ErrAccountLocked},
+		{name: "ppolicy lockout in force", attributes: map[string][]string{"pwdAccountLockedTime": {hourAgo}}, known: true, lockout: 2 * time.Hour, want: ErrAccountLocked},
+		{name: "ppolicy lockout elapsed", attributes: map[string][]string{"pwdAccountLockedTime": {hourAgo}}, known: true, lockout: 30 * time.Minute, want: nil},
+		{name: "ppolicy lockout without duration", attributes: map[string][]string{"pwdAccountLockedTime": {hourAgo}}, known: true, want: ErrAccountLocked},
+		{name: "ppolicy lockout with unknown policy", attributes: map[string][]string{"pwdAccountLockedTime": {hourAgo}}, want: ErrAccountLocked},
+		{name: "shadow account expired", attributes: map[string][]string{"shadowExpire": {"19000"}}, want: ErrAccountDisabled},
+		{name: "shadow account never expires", attributes: map[string][]string{"shadowExpire": {"-1"}}, want: nil},
+		{name: "shadow account expires later", attributes: map[string][]string{"shadowExpire": {"20000"}}, want: nil},
+		{name: "Kerberos principal expired", attributes: map[string][]string{"krbPrincipalExpiration": {hourAgo}}, want: ErrAccountDisabled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := ldap.NewEntry("uid=alice,dc=example,dc=com", tt.attributes)
+			lockoutDuration := func() (time.Duration, bool) { return tt.lockout, tt.known }
+
+			err := accountRefusal(entry, now, lockoutDuration)
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("accountRefusal = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
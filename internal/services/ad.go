@@ -0,0 +1,153 @@
+package services
+
+import (
+	"encoding/binary"
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	DirectoryTypeActiveDirectory = "ad"
+
+	RuleDirectoryPolicy = "directory_policy"
+)
+
+// Extended error codes reported at the start of AD diagnostic messages,
+// e.g. "0000052D: SvcErr: DSID-031A12D2, problem 5003 (WILL_NOT_PERFORM), data 0".
+var adExtendedErrors = map[string]*ServiceError{
+	"00000005": ErrInsufficientAccess,
+	"00000056": ErrInvalidCredentials,
+	"0000001F": {Kind: KindDirectoryError, Message: "password changes require an LDAPS connection to Active Directory"},
+	"00002077": {Kind: KindDirectoryError, Message: "password changes require an LDAPS connection to Active Directory"},
+}
+
+// Bind failure subcodes reported as "data NNN" in AcceptSecurityContext errors.
+var adBindErrors = map[string]*ServiceError{
+	"525": ErrInvalidCredentials,
+	"52e": ErrInvalidCredentials,
+	"530": {Kind: KindAccountDisabled, Message: "logon is not permitted at this time"},
+	"531": {Kind: KindAccountDisabled, Message: "logon is not permitted from this workstation"},
+	"532": ErrPasswordExpired,
+	"533": ErrAccountDisabled,
+	"701": {Kind: KindAccountDisabled, Message: "the account has expired"},
+	"773": ErrPasswordMustChange,
+	"775": ErrAccountLocked,
+}
+
+const adPolicyCode = "0000052D"
+
+var (
+	adExtendedPattern = regexp.MustCompile(`\b([0-9A-Fa-f]{8}):`)
+	adDataPattern     = regexp.MustCompile(`data ([0-9A-Fa-f]+)`)
+)
+
+func (s *LDAPService) isActiveDirectory() bool {
+	return strings.EqualFold(s.config.LDAP.DirectoryType, DirectoryTypeActiveDirectory)
+}
+
+// encodeADPassword produces the unicodePwd value: the password enclosed in
+// double quotes and encoded as UTF-16LE.
+func encodeADPassword(password string) string {
+	encoded := utf16.Encode([]rune(`"` + password + `"`))
+	buf := make([]byte, len(encoded)*2)
+	for i, r := range encoded {
+		binary.LittleEndian.PutUint16(buf[i*2:], r)
+	}
+	return string(buf)
+}
+
+func requireTLS(conn *PooledConn) error {
+	if _, ok := conn.TLSConnectionState(); !ok {
+		return &ServiceError{Kind: KindDirectoryError, Message: "Active Directory password changes require LDAPS or StartTLS"}
+	}
+	return nil
+}
+
+// changeADPassword performs a user password change: bound as the user, the
+// old value is deleted and the new one added in a single modify, which makes
+// AD enforce history and minimum age as it would for an interactive change.
+func (s *LDAPService) changeADPassword(conn *PooledConn, userDN, oldPassword, newPassword string) error {
+	if err := requireTLS(conn); err != nil {
+		return err
+	}
+
+	if _, err := s.bindUser(conn, userDN, oldPassword); err != nil {
+		if credentialsVerifiedButExpired(err) {
+			// An expired password cannot bind, so AD cannot run the
+			// change as the user. The old password has been proven, so
+			// fall back to an administrative replace.
+			if err := conn.Bind(s.config.LDAP.BindDN, s.config.LDAP.BindPassword); err != nil {
+				return translateADError(err)
+			}
+			return s.resetADPassword(conn, userDN, newPassword)
+		}
+		return err
+	}
+
+	modifyRequest := ldap.NewModifyRequest(userDN, nil)
+	modifyRequest.Delete("unicodePwd", []string{encodeADPassword(oldPassword)})
+	modifyRequest.Add("unicodePwd", []string{encodeADPassword(newPassword)})
+
+	if err := conn.Modify(modifyRequest); err != nil {
+		return translateADError(err)
+	}
+
+	return nil
+}
+
+// resetADPassword performs an administrative reset with a replace, which
+// requires the service account to hold the Reset Password right.
+func (s *LDAPService) resetADPassword(conn *PooledConn, userDN, newPassword string) error {
+	if err := requireTLS(conn); err != nil {
+		return err
+	}
+
+	modifyRequest := ldap.NewModifyRequest(userDN, nil)
+	modifyRequest.Replace("unicodePwd", []string{encodeADPassword(newPassword)})
+
+	if err := conn.Modify(modifyRequest); err != nil {
+		return translateADError(err)
+	}
+
+	return nil
+}
+
+// translateADError maps AD extended error codes and bind subcodes to
+// classified errors. Policy rejections become a *PolicyError so callers can
+// treat them like portal-side policy failures.
+func translateADError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) || ldapErr.Err == nil {
+		return translateLDAPError(err, nil)
+	}
+	diagnostic := ldapErr.Err.Error()
+
+	if match := adExtendedPattern.FindStringSubmatch(diagnostic); match != nil {
+		code := strings.ToUpper(match[1])
+		if code == adPolicyCode {
+			return directoryPolicyError(RuleDirectoryPolicy, "password does not meet the domain's length, complexity, history or minimum age requirements")
+		}
+
+		if ldapErr.ResultCode == ldap.LDAPResultInvalidCredentials {
+			if data := adDataPattern.FindStringSubmatch(diagnostic); data != nil {
+				if kind, ok := adBindErrors[strings.ToLower(data[1])]; ok {
+					return newServiceError(kind, err)
+				}
+			}
+		}
+
+		if kind, ok := adExtendedErrors[code]; ok {
+			return newServiceError(kind, err)
+		}
+	}
+
+	return translateLDAPError(err, nil)
+}
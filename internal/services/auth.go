@@ -1,54 +1,301 @@
 package services
 
 import (
+	"errors"
+	"fmt"
 	"ldap-self-service/internal/config"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// AuthService issues and validates the portal's tokens. Full sessions get a
+// short-lived access token and a refresh token, and are tracked in the
+// session store; refresh tokens and token revocations are kept in the
+// verification store so every replica honours them.
+//
+// Tokens are signed with HS256 and jwt.secret unless jwt.keys lists PEM
+// keys, in which case they are signed with jwt.signing_key and verified
+// with whichever listed key their kid names, so other services can check
+// them against the JWKS.
 type AuthService struct {
-	config *config.Config
+	config   *config.Config
+	store    VerificationStore
+	sessions SessionStore
+
+	// keys are the jwt.keys by id, ordered as configured.
+	keys    map[string]*signingKey
+	ordered []*signingKey
+	signer  *signingKey
+	// methods are the algorithms accepted when validating.
+	methods []string
+
+	// mutex serializes refresh token rotation and session updates.
+	mutex sync.Mutex
+
+	// touched is when this replica last recorded activity per session.
+	touched    map[string]time.Time
+	touchMutex sync.Mutex
 }
 
+// Token scopes. A token without a scope is a full session.
+const (
+	// ScopePasswordChange restricts a token to changing the user's own
+	// password. It is issued when a login succeeds with an expired password.
+	ScopePasswordChange = "password_change"
+	// ScopeTOTPEnroll restricts a token to setting up an authenticator,
+	// for users who must enroll before using the portal.
+	ScopeTOTPEnroll = "totp_enroll"
+	// ScopePreAuth marks a token that only proves the password was right.
+	// It is accepted by nothing but the second login step.
+	ScopePreAuth = "pre_auth"
+)
+
+// tokenTimePrecision is the precision of token times, and of the cutoff
+// RevokeUser records, so a token issued just after a revocation is told
+// apart from one issued just before it in the same second. RFC 7519
+// allows fractional NumericDates.
+const tokenTimePrecision = time.Microsecond
+
+func init() {
+	jwt.TimePrecision = tokenTimePrecision
+}
+
+// Restricted (scoped and pre-auth) tokens are marked so that nothing but
+// the portal accepts them: their JOSE typ is restrictedTokenType and their
+// aud is restrictedAudience instead of jwt.audience. Verifiers that check
+// either reject them even though they are signed with the published keys.
+const (
+	restrictedTokenType = "restricted+jwt"
+	// defaultAudience stands in for jwt.audience in restrictedAudience
+	// when none is configured.
+	defaultAudience = "ldap-self-service"
+)
+
 type Claims struct {
 	Username string `json:"username"`
 	DN       string `json:"dn"`
+	// Scope is empty for a full session token.
+	Scope string `json:"scope,omitempty"`
+	// NextScope is the scope of the token a pre-auth token is exchanged for.
+	NextScope string `json:"nextScope,omitempty"`
+	// SessionID is shared by the access tokens of one login and the
+	// refresh tokens that renew them.
+	SessionID string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func NewAuthService(cfg *config.Config) *AuthService {
-	return &AuthService{config: cfg}
+func NewAuthService(cfg *config.Config, store VerificationStore, sessions SessionStore) (*AuthService, error) {
+	service := &AuthService{
+		config:   cfg,
+		store:    store,
+		sessions: sessions,
+		touched:  make(map[string]time.Time),
+	}
+	if len(cfg.JWT.Keys) == 0 {
+		if cfg.JWT.Secret == "" {
+			return nil, errors.New("jwt.secret or jwt.keys is required")
+		}
+		service.methods = []string{jwt.SigningMethodHS256.Alg()}
+		return service, nil
+	}
+
+	service.keys = make(map[string]*signingKey)
+	for _, keyConfig := range cfg.JWT.Keys {
+		key, err := loadSigningKey(keyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWT key: %w", err)
+		}
+		if _, ok := service.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate JWT key id %q", key.ID)
+		}
+		service.keys[key.ID] = key
+		service.ordered = append(service.ordered, key)
+		if !slices.Contains(service.methods, key.Method.Alg()) {
+			service.methods = append(service.methods, key.Method.Alg())
+		}
+	}
+
+	service.signer = service.ordered[0]
+	if cfg.JWT.SigningKey != "" {
+		service.signer = service.keys[cfg.JWT.SigningKey]
+		if service.signer == nil {
+			return nil, fmt.Errorf("jwt.signing_key %q is not one of jwt.keys", cfg.JWT.SigningKey)
+		}
+	}
+	if service.signer.Private == nil {
+		return nil, fmt.Errorf("JWT signing key %q has no private key", service.signer.ID)
+	}
+	return service, nil
 }
 
-func (s *AuthService) GenerateToken(username, dn string) (string, error) {
-	expirationTime := time.Now().Add(time.Duration(s.config.JWT.Expiration) * time.Second)
-	
-	claims := &Claims{
-		Username: username,
-		DN:       dn,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+// JWKS returns the public keys tokens may be signed with, or nil when
+// tokens are signed with the shared secret.
+func (s *AuthService) JWKS() *JWKSet {
+	if s.keys == nil {
+		return nil
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(s.config.JWT.Secret))
+	set := &JWKSet{Keys: make([]JWK, 0, len(s.ordered))}
+	for _, key := range s.ordered {
+		set.Keys = append(set.Keys, key.JWK())
+	}
+	return set
 }
 
-func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+// GenerateScopedToken issues a token limited to scope that expires after ttl.
+func (s *AuthService) GenerateScopedToken(username, dn, scope string, ttl time.Duration) (string, error) {
+	return s.sign(&Claims{Username: username, DN: dn, Scope: scope}, ttl)
+}
+
+// GeneratePreAuthToken issues a token for a user whose password has been
+// verified but who still has to pass the second factor. It is exchanged
+// for a token with scope next.
+func (s *AuthService) GeneratePreAuthToken(username, dn, next string, ttl time.Duration) (string, error) {
+	return s.sign(&Claims{Username: username, DN: dn, Scope: ScopePreAuth, NextScope: next}, ttl)
+}
+
+func (s *AuthService) sign(claims *Claims, ttl time.Duration) (string, error) {
+	id, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID:        id,
+		Issuer:    s.config.JWT.Issuer,
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(now),
+	}
+	if claims.Scope != "" {
+		claims.Audience = jwt.ClaimStrings{s.restrictedAudience()}
+	} else if s.config.JWT.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{s.config.JWT.Audience}
+	}
+
+	method := jwt.SigningMethod(jwt.SigningMethodHS256)
+	if s.signer != nil {
+		method = s.signer.Method
+	}
+	token := jwt.NewWithClaims(method, claims)
+	if claims.Scope != "" {
+		token.Header["typ"] = restrictedTokenType
+	}
+
+	if s.signer == nil {
+		return token.SignedString([]byte(s.config.JWT.Secret))
+	}
+	token.Header["kid"] = s.signer.ID
+	return token.SignedString(s.signer.Private)
+}
+
+// restrictedAudience is the aud of restricted tokens: jwt.audience, or a
+// default when none is set, with a "#restricted" suffix.
+func (s *AuthService) restrictedAudience() string {
+	audience := s.config.JWT.Audience
+	if audience == "" {
+		audience = defaultAudience
+	}
+	return audience + "#restricted"
+}
+
+// verificationKey picks the key for a token being validated: the shared
+// secret, or the configured key named by its kid, which must be for the
+// algorithm the token claims.
+func (s *AuthService) verificationKey(token *jwt.Token) (interface{}, error) {
+	if s.keys == nil {
 		return []byte(s.config.JWT.Secret), nil
-	})
+	}
+
+	id, _ := token.Header["kid"].(string)
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", id)
+	}
+	if key.Method.Alg() != token.Method.Alg() {
+		return nil, fmt.Errorf("key %q does not use %s", id, token.Method.Alg())
+	}
+	return key.Public, nil
+}
+
+// ValidateToken checks the algorithm, signature, expiry, issuer and
+// audience of tokenString and that neither the token, its session nor the user's tokens have been revoked.
+// Restricted tokens must carry the restricted typ and audience, and full
+// session tokens must not.
+func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(s.methods),
+		jwt.WithExpirationRequired(),
+	}
+	if s.config.JWT.Issuer != "" {
+		options = append(options, jwt.WithIssuer(s.config.JWT.Issuer))
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, s.verificationKey, options...)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims, nil
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, jwt.ErrSignatureInvalid
+	}
+
+	restricted := claims.Scope != ""
+	tokenType, _ := token.Header["typ"].(string)
+	if restricted != (tokenType == restrictedTokenType) {
+		return nil, ErrInvalidToken
+	}
+	audience := s.config.JWT.Audience
+	if restricted {
+		audience = s.restrictedAudience()
+	}
+	if audience != "" && !slices.Contains(claims.Audience, audience) {
+		return nil, ErrInvalidToken
+	}
+	if !restricted && slices.Contains(claims.Audience, s.restrictedAudience()) {
+		return nil, ErrInvalidToken
+	}
+	// Tokens without an ID could not be revoked.
+	if claims.ID == "" || claims.IssuedAt == nil {
+		return nil, ErrInvalidToken
+	}
+
+	if err := s.checkRevoked(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (s *AuthService) checkRevoked(claims *Claims) error {
+	revoked, err := s.store.Get(revokedTokenPrefix + claims.ID)
+	if err != nil {
+		return err
+	}
+	if revoked != nil {
+		return ErrInvalidToken
+	}
+
+	if claims.SessionID != "" {
+		session, err := s.sessions.Get(claims.SessionID)
+		if err != nil {
+			return err
+		}
+		if session == nil {
+			return ErrInvalidToken
+		}
 	}
 
-	return nil, jwt.ErrSignatureInvalid
-}
\ No newline at end of file
+	cutoff, err := s.userCutoff(claims.DN)
+	if err != nil {
+		return err
+	}
+	if revokedBy(claims.IssuedAt.Time, cutoff) {
+		return ErrInvalidToken
+	}
+	return nil
+}
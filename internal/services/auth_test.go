@@ -0,0 +1,163 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"ldap-self-service/internal/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestAuthService(t *testing.T, jwtConfig config.JWTConfig) *AuthService {
+	t.Helper()
+
+	if jwtConfig.Expiration == 0 {
+		jwtConfig.Expiration = 300
+	}
+	if jwtConfig.RefreshExpiration == 0 {
+		jwtConfig.RefreshExpiration = 3600
+	}
+	service, err := NewAuthService(&config.Config{JWT: jwtConfig}, NewMemoryVerificationStore(), NewMemorySessionStore())
+	if err != nil {
+		t.Fatalf("NewAuthService: %v", err)
+	}
+	return service
+}
+
+// writeEd25519Key writes a PKCS #8 Ed25519 private key and returns its
+// path and public key.
+func writeEd25519Key(t *testing.T) (string, ed25519.PublicKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path, public
+}
+
+func TestRestrictedTokensAreMarked(t *testing.T) {
+	keyFile, public := writeEd25519Key(t)
+	service := newTestAuthService(t, config.JWTConfig{
+		Issuer:   "https://portal.example.com",
+		Audience: "portal",
+		Keys:     []config.JWTKeyConfig{{ID: "k1", File: keyFile}},
+	})
+
+	session, err := service.GenerateSession("alice", "uid=alice,dc=example,dc=com", "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("GenerateSession: %v", err)
+	}
+	passwordChange, err := service.GenerateScopedToken("alice", "uid=alice,dc=example,dc=com", ScopePasswordChange, time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateScopedToken: %v", err)
+	}
+	totpEnroll, err := service.GenerateScopedToken("alice", "uid=alice,dc=example,dc=com", ScopeTOTPEnroll, time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateScopedToken: %v", err)
+	}
+	preAuth, err := service.GeneratePreAuthToken("alice", "uid=alice,dc=example,dc=com", "", time.Minute)
+	if err != nil {
+		t.Fatalf("GeneratePreAuthToken: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		scope      string
+		restricted bool
+	}{
+		{name: "session", token: session.AccessToken},
+		{name: "password change", token: passwordChange, scope: ScopePasswordChange, restricted: true},
+		{name: "TOTP enrollment", token: totpEnroll, scope: ScopeTOTPEnroll, restricted: true},
+		{name: "pre-auth", token: preAuth, scope: ScopePreAuth, restricted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := service.ValidateToken(tt.token)
+			if err != nil {
+				t.Fatalf("ValidateToken: %v", err)
+			}
+			if claims.Scope != tt.scope {
+				t.Fatalf("scope = %q, want %q", claims.Scope, tt.scope)
+			}
+
+			// A verifier using the published key and checking aud, as
+			// the README asks of other services.
+			token, err := jwt.Parse(tt.token, func(*jwt.Token) (interface{}, error) { return public, nil },
+				jwt.WithAudience("portal"), jwt.WithIssuer("https://portal.example.com"))
+			if tt.restricted && err == nil {
+				t.Fatal("an external verifier accepted a restricted token")
+			}
+			if !tt.restricted && err != nil {
+				t.Fatalf("an external verifier rejected a session token: %v", err)
+			}
+
+			if typ, _ := token.Header["typ"].(string); (typ == restrictedTokenType) != tt.restricted {
+				t.Fatalf("typ = %q, restricted %v", typ, tt.restricted)
+			}
+		})
+	}
+}
+
+func TestValidateTokenRejectsMismarkedTokens(t *testing.T) {
+	service := newTestAuthService(t, config.JWTConfig{Secret: "test-secret", Audience: "portal"})
+	now := time.Now()
+
+	sign := func(claims *Claims, typ string) string {
+		t.Helper()
+		claims.RegisteredClaims.ID = "id"
+		claims.RegisteredClaims.IssuedAt = jwt.NewNumericDate(now)
+		claims.RegisteredClaims.ExpiresAt = jwt.NewNumericDate(now.Add(time.Minute))
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["typ"] = typ
+		signed, err := token.SignedString([]byte("test-secret"))
+		if err != nil {
+			t.Fatalf("SignedString: %v", err)
+		}
+		return signed
+	}
+	audience := func(aud string) jwt.RegisteredClaims {
+		return jwt.RegisteredClaims{Audience: jwt.ClaimStrings{aud}}
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{name: "session", token: sign(&Claims{Username: "alice", RegisteredClaims: audience("portal")}, "JWT"), valid: true},
+		{name: "restricted", token: sign(&Claims{Username: "alice", Scope: ScopePasswordChange, RegisteredClaims: audience("portal#restricted")}, restrictedTokenType), valid: true},
+		{name: "scope with the session audience", token: sign(&Claims{Username: "alice", Scope: ScopePasswordChange, RegisteredClaims: audience("portal")}, restrictedTokenType)},
+		{name: "scope without the restricted typ", token: sign(&Claims{Username: "alice", Scope: ScopePasswordChange, RegisteredClaims: audience("portal#restricted")}, "JWT")},
+		{name: "session with the restricted typ", token: sign(&Claims{Username: "alice", RegisteredClaims: audience("portal")}, restrictedTokenType)},
+		{name: "session with the restricted audience", token: sign(&Claims{Username: "alice", RegisteredClaims: audience("portal#restricted")}, "JWT")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.ValidateToken(tt.token)
+			if tt.valid && err != nil {
+				t.Fatalf("ValidateToken: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("ValidateToken accepted the token")
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"ldap-self-service/internal/config"
+	"ldap-self-service/internal/models"
+	"log"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VerificationChannel is a way for a user to prove who they are, such as a
+// code sent by email. Channels are registered by name, which is the reset
+// "method" clients send. A channel also implements CodeSender, or
+// ChallengeStarter to create its challenges itself.
+type VerificationChannel interface {
+	// Name identifies the channel, e.g. "email" or "sms".
+	Name() string
+	// Destinations returns where challenges for user can be delivered, in
+	// a stable order; it is empty when the user has nothing configured.
+	Destinations(user *models.User) []string
+	// Mask hides most of destination so it can be shown to someone who
+	// has not proven who they are, e.g. "j***@example.com".
+	Mask(destination string) string
+}
+
+// CodeSender delivers one-time codes generated by the ChallengeManager.
+type CodeSender interface {
+	Send(destination, code string) error
+}
+
+// ChallengeStarter is implemented by channels that deliver something other
+// than a generated code. Start fills in challenge, which is stored once
+// Start returns, so it must not send anything to the user.
+type ChallengeStarter interface {
+	Start(user *models.User, destination string, challenge *VerificationCode) error
+}
+
+// ChallengeDeliverer is implemented by starters that send something, such
+// as a link, for a challenge. Deliver runs after the challenge is stored;
+// the challenge is deleted again when it fails.
+type ChallengeDeliverer interface {
+	Deliver(user *models.User, destination string, challenge *VerificationCode) error
+}
+
+// ChallengeVerifier is implemented by channels that check responses
+// themselves instead of comparing them with challenge.Code.
+type ChallengeVerifier interface {
+	Verify(challenge *VerificationCode, response ChallengeResponse) (bool, error)
+}
+
+// ChallengeResponse is what a user submits to answer a challenge.
+type ChallengeResponse struct {
+	Code    string
+	Answers []string
+	// Password is the user's current password, for channels that check it
+	// together with the code.
+	Password string
+	// Credential is a WebAuthn assertion response.
+	Credential []byte
+}
+
+// ChannelRegistry maps reset methods to the channels that serve them.
+type ChannelRegistry struct {
+	mutex    sync.RWMutex
+	channels map[string]VerificationChannel
+}
+
+func NewChannelRegistry(channels ...VerificationChannel) *ChannelRegistry {
+	registry := &ChannelRegistry{channels: make(map[string]VerificationChannel)}
+	for _, channel := range channels {
+		registry.Register(channel)
+	}
+	return registry
+}
+
+// Register adds channel, replacing any channel with the same name.
+func (r *ChannelRegistry) Register(channel VerificationChannel) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.channels[channel.Name()] = channel
+}
+
+func (r *ChannelRegistry) Get(name string) (VerificationChannel, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	channel, ok := r.channels[name]
+	return channel, ok
+}
+
+// Names returns the registered channel names in sorted order.
+func (r *ChannelRegistry) Names() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	names := make([]string, 0, len(r.channels))
+	for name := range r.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResetOption is a channel a user can reset through, with masked hints for
+// each destination in the order the reset request indexes them.
+type ResetOption struct {
+	Method       string              `json:"method"`
+	Destinations []MaskedDestination `json:"destinations"`
+}
+
+type MaskedDestination struct {
+	Index int    `json:"index"`
+	Hint  string `json:"hint"`
+}
+
+// challengeKeyPrefix namespaces challenges in the verification store.
+const challengeKeyPrefix = "challenge:"
+
+// ChallengeManager issues and verifies one-time codes for any registered
+// channel. Each challenge records the channel that issued it, so callers
+// holding only a token need not know where it came from.
+//
+// Sending is subject to the rate limiter. Verification is guarded against
+// guessing: a challenge is invalidated after MaxAttempts wrong codes, and
+// repeated failures lock out the username and the client address.
+type ChallengeManager struct {
+	config   config.VerificationConfig
+	store    VerificationStore
+	registry *ChannelRegistry
+	limiter  *RateLimiter
+	lockout  *LockoutTracker
+	ttl      time.Duration
+}
+
+func NewChallengeManager(cfg *config.Config, store VerificationStore, registry *ChannelRegistry, limiter *RateLimiter) *ChallengeManager {
+	verification := cfg.Verification
+	return &ChallengeManager{
+		config:   verification,
+		store:    store,
+		registry: registry,
+		limiter:  limiter,
+		lockout: NewLockoutTracker(store, "lockout:",
+			time.Duration(verification.FailureWindow)*time.Second,
+			time.Duration(verification.LockoutDuration)*time.Second,
+		),
+		ttl: 10 * time.Minute,
+	}
+}
+
+// Channel looks up the channel registered for method.
+func (m *ChallengeManager) Channel(method string) (VerificationChannel, error) {
+	channel, ok := m.registry.Get(method)
+	if !ok {
+		return nil, invalidRequest(fmt.Sprintf("invalid reset method, use one of: %s", strings.Join(m.registry.Names(), ", ")), nil)
+	}
+	return channel, nil
+}
+
+// Options lists the registered channels with at least one destination for
+// user.
+func (m *ChallengeManager) Options(user *models.User) []ResetOption {
+	options := []ResetOption{}
+	for _, name := range m.registry.Names() {
+		channel, _ := m.registry.Get(name)
+		destinations := channel.Destinations(user)
+		if len(destinations) == 0 {
+			continue
+		}
+
+		option := ResetOption{Method: name}
+		for i, destination := range destinations {
+			option.Destinations = append(option.Destinations, MaskedDestination{Index: i, Hint: channel.Mask(destination)})
+		}
+		options = append(options, option)
+	}
+	return options
+}
+
+// Methods lists every registered channel without destinations, for
+// callers that must not reveal anything about the user.
+func (m *ChallengeManager) Methods() []ResetOption {
+	options := []ResetOption{}
+	for _, name := range m.registry.Names() {
+		options = append(options, ResetOption{Method: name, Destinations: []MaskedDestination{}})
+	}
+	return options
+}
+
+// Issue sends a new code for user through channel to the destination at
+// index. It returns the challenge, whose Token identifies it and whose
+// Prompt and Options, if any, are for the client to answer.
+func (m *ChallengeManager) Issue(channel VerificationChannel, user *models.User, index int) (*VerificationCode, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.issue(channel, user, index, token)
+}
+
+// IssueDeferred returns a token straight away and resolves the user and
+// sends the code in the background. Callers learn nothing about whether
+// the account exists or has a destination for channel: when it does not,
+// the token simply never verifies. Failures are only logged.
+func (m *ChallengeManager) IssueDeferred(channel VerificationChannel, index int, lookup func() (*models.User, error)) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	go func() {
+		user, err := lookup()
+		if err == nil {
+			_, err = m.issue(channel, user, index, token)
+		}
+		if err != nil {
+			log.Printf("Deferred %s reset not sent: %v", channel.Name(), err)
+		}
+	}()
+
+	return token, nil
+}
+
+func (m *ChallengeManager) issue(channel VerificationChannel, user *models.User, index int, token string) (*VerificationCode, error) {
+	destinations := channel.Destinations(user)
+	if len(destinations) == 0 {
+		return nil, invalidRequest(fmt.Sprintf("no %s destination is configured for this user", channel.Name()), nil)
+	}
+	if index < 0 || index >= len(destinations) {
+		return nil, invalidRequest(fmt.Sprintf("invalid %s destination", channel.Name()), nil)
+	}
+	destination := destinations[index]
+
+	if err := m.limiter.AllowSend(user.Username, destination); err != nil {
+		return nil, err
+	}
+
+	challenge := &VerificationCode{
+		Token:       token,
+		Channel:     channel.Name(),
+		Destination: destination,
+		Username:    user.Username,
+		DN:          user.DN,
+		ExpiresAt:   time.Now().Add(m.ttl),
+	}
+
+	if starter, ok := channel.(ChallengeStarter); ok {
+		if err := starter.Start(user, destination, challenge); err != nil {
+			return nil, err
+		}
+		if err := m.store.Put(challengeKeyPrefix+token, challenge); err != nil {
+			return nil, fmt.Errorf("failed to store verification code: %w", err)
+		}
+		if deliverer, ok := channel.(ChallengeDeliverer); ok {
+			if err := deliverer.Deliver(user, destination, challenge); err != nil {
+				m.store.Delete(challengeKeyPrefix + token)
+				return nil, err
+			}
+		}
+		return challenge, nil
+	}
+
+	sender, ok := channel.(CodeSender)
+	if !ok {
+		return nil, fmt.Errorf("channel %s cannot issue challenges", channel.Name())
+	}
+
+	code, err := generateCode()
+	if err != nil {
+		return nil, err
+	}
+	challenge.Code = code
+
+	if err := m.store.Put(challengeKeyPrefix+token, challenge); err != nil {
+		return nil, fmt.Errorf("failed to store verification code: %w", err)
+	}
+
+	if err := sender.Send(destination, code); err != nil {
+		m.store.Delete(challengeKeyPrefix + token)
+		return nil, err
+	}
+
+	return challenge, nil
+}
+
+// Lookup returns the pending challenge for token, or nil.
+func (m *ChallengeManager) Lookup(token string) (*VerificationCode, error) {
+	return m.store.Get(challengeKeyPrefix + token)
+}
+
+// Verify consumes the challenge identified by token when response matches. An
+// empty channel accepts a challenge issued by any channel. It returns nil
+// for unknown, expired or mismatched challenges, and a *ThrottleError when
+// the username or clientIP is locked out.
+func (m *ChallengeManager) Verify(token string, response ChallengeResponse, channel, clientIP string) (*VerificationCode, error) {
+	ipKey := ipLockoutKey(clientIP)
+	if err := m.lockout.Check(ipKey); err != nil {
+		return nil, err
+	}
+
+	challenge, err := m.Lookup(token)
+	if err != nil {
+		return nil, err
+	}
+	if challenge == nil || (channel != "" && challenge.Channel != channel) {
+		m.lockout.Failure(ipKey, m.config.IPMaxFailures)
+		return nil, nil
+	}
+
+	userKey := userLockoutKey(challenge.Username)
+	if err := m.lockout.Check(userKey); err != nil {
+		return nil, err
+	}
+
+	valid, err := m.check(challenge, response)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		m.lockout.Failure(ipKey, m.config.IPMaxFailures)
+		m.lockout.Failure(userKey, m.config.UserMaxFailures)
+		m.recordWrongCode(challenge, clientIP)
+		return nil, nil
+	}
+
+	// Taking the challenge, rather than deleting it, makes sure only one
+	// request redeems it when several race with the same code.
+	taken, err := m.store.Take(challengeKeyPrefix + token)
+	if err != nil {
+		return nil, err
+	}
+	if taken == nil {
+		return nil, nil
+	}
+	m.lockout.Success(userKey)
+
+	return challenge, nil
+}
+
+// Release puts back a challenge Verify consumed when what it authorised
+// could not go ahead, e.g. because the directory refused the new password,
+// so the same code or link works for another try.
+func (m *ChallengeManager) Release(challenge *VerificationCode) error {
+	return m.store.Put(challengeKeyPrefix+challenge.Token, challenge)
+}
+
+// check asks the issuing channel to verify response, falling back to a
+// constant-time comparison with the stored code.
+func (m *ChallengeManager) check(challenge *VerificationCode, response ChallengeResponse) (bool, error) {
+	if channel, ok := m.registry.Get(challenge.Channel); ok {
+		if verifier, ok := channel.(ChallengeVerifier); ok {
+			return verifier.Verify(challenge, response)
+		}
+	}
+
+	return challenge.Code != "" && subtle.ConstantTimeCompare([]byte(challenge.Code), []byte(response.Code)) == 1, nil
+}
+
+// recordWrongCode counts a wrong code against the challenge and discards
+// it once MaxAttempts is reached. The count is updated atomically in the
+// store, so concurrent guesses on any replica all count.
+func (m *ChallengeManager) recordWrongCode(challenge *VerificationCode, clientIP string) {
+	attempts := 0
+	err := m.store.Update(challengeKeyPrefix+challenge.Token, func(current *VerificationCode) (*VerificationCode, error) {
+		if current == nil {
+			attempts = 0
+			return nil, nil
+		}
+		current.Attempts++
+		attempts = current.Attempts
+		if m.config.MaxAttempts > 0 && current.Attempts >= m.config.MaxAttempts {
+			return nil, nil
+		}
+		return current, nil
+	})
+	if err != nil {
+		log.Printf("Failed to update verification code: %v", err)
+		return
+	}
+
+	if m.config.MaxAttempts > 0 && attempts >= m.config.MaxAttempts {
+		log.Printf("SECURITY: %s challenge for %s invalidated after %d wrong codes (last from %s)",
+			challenge.Channel, challenge.Username, attempts, clientIP)
+	}
+}
+
+func generateCode() (string, error) {
+	const charset = "0123456789"
+	return randomString(charset, 6)
+}
+
+func generateToken() (string, error) {
+	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	return randomString(charset, 32)
+}
+
+func randomString(charset string, length int) (string, error) {
+	value := make([]byte, length)
+
+	for i := range value {
+		num, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			return "", err
+		}
+		value[i] = charset[num.Int64()]
+	}
+
+	return string(value), nil
+}
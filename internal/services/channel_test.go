@@ -0,0 +1,117 @@
+package services
+
+import (
+	"errors"
+	"ldap-self-service/internal/config"
+	"ldap-self-service/internal/models"
+	"testing"
+)
+
+// linkChannel is a starter that records whether its challenge was stored
+// by the time it was delivered.
+type linkChannel struct {
+	store      VerificationStore
+	deliverErr error
+	storedThen bool
+	token      string
+}
+
+func (c *linkChannel) Name() string                            { return "link" }
+func (c *linkChannel) Destinations(user *models.User) []string { return []string{user.Email} }
+func (c *linkChannel) Mask(destination string) string          { return destination }
+
+func (c *linkChannel) Start(user *models.User, destination string, challenge *VerificationCode) error {
+	challenge.Code = "signed"
+	return nil
+}
+
+func (c *linkChannel) Deliver(user *models.User, destination string, challenge *VerificationCode) error {
+	c.token = challenge.Token
+	stored, err := c.store.Get(challengeKeyPrefix + challenge.Token)
+	c.storedThen = err == nil && stored != nil && stored.Code == "signed"
+	return c.deliverErr
+}
+
+func TestIssueStoresChallengeBeforeDelivery(t *testing.T) {
+	user := &models.User{Username: "alice", DN: "uid=alice,dc=example,dc=com", Email: "alice@example.com"}
+	failure := errors.New("smtp unavailable")
+
+	tests := []struct {
+		name       string
+		deliverErr error
+		wantStored bool
+	}{
+		{name: "delivered", wantStored: true},
+		{name: "delivery failed", deliverErr: failure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryVerificationStore()
+			channel := &linkChannel{store: store, deliverErr: tt.deliverErr}
+			manager := NewChallengeManager(&config.Config{}, store, NewChannelRegistry(channel), nil)
+
+			_, err := manager.Issue(channel, user, 0)
+			if !errors.Is(err, tt.deliverErr) {
+				t.Fatalf("Issue error = %v, want %v", err, tt.deliverErr)
+			}
+			if !channel.storedThen {
+				t.Fatal("the challenge was not stored before it was delivered")
+			}
+
+			stored, _ := manager.Lookup(channel.token)
+			if (stored != nil) != tt.wantStored {
+				t.Fatalf("challenge stored after Issue = %v, want %v", stored != nil, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestVerifyRedeemsOnce(t *testing.T) {
+	store := NewMemoryVerificationStore()
+	channel := &linkChannel{store: store}
+	manager := NewChallengeManager(&config.Config{}, store, NewChannelRegistry(channel), nil)
+
+	user := &models.User{Username: "alice", Email: "alice@example.com"}
+	challenge, err := manager.Issue(channel, user, 0)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	if got, err := manager.Verify(challenge.Token, ChallengeResponse{Code: "wrong"}, "", "192.0.2.1"); err != nil || got != nil {
+		t.Fatalf("Verify(wrong code) = %+v, %v; want nil, nil", got, err)
+	}
+	if got, err := manager.Verify(challenge.Token, ChallengeResponse{Code: "signed"}, "", "192.0.2.1"); err != nil || got == nil {
+		t.Fatalf("Verify = %+v, %v; want the challenge", got, err)
+	}
+	if got, err := manager.Verify(challenge.Token, ChallengeResponse{Code: "signed"}, "", "192.0.2.1"); err != nil || got != nil {
+		t.Fatalf("second Verify = %+v, %v; want nil, nil", got, err)
+	}
+}
+
+func TestReleaseRestoresChallenge(t *testing.T) {
+	store := NewMemoryVerificationStore()
+	channel := &linkChannel{store: store}
+	manager := NewChallengeManager(&config.Config{}, store, NewChannelRegistry(channel), nil)
+
+	user := &models.User{Username: "alice", Email: "alice@example.com"}
+	challenge, err := manager.Issue(channel, user, 0)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	taken, err := manager.Verify(challenge.Token, ChallengeResponse{Code: "signed"}, "", "192.0.2.1")
+	if err != nil || taken == nil {
+		t.Fatalf("Verify = %+v, %v; want the challenge", taken, err)
+	}
+	// The directory refused the new password.
+	if err := manager.Release(taken); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got, err := manager.Verify(challenge.Token, ChallengeResponse{Code: "signed"}, "", "192.0.2.1"); err != nil || got == nil {
+		t.Fatalf("Verify after Release = %+v, %v; want the challenge", got, err)
+	}
+	if got, err := manager.Verify(challenge.Token, ChallengeResponse{Code: "signed"}, "", "192.0.2.1"); err != nil || got != nil {
+		t.Fatalf("Verify after redeeming = %+v, %v; want nil, nil", got, err)
+	}
+}
@@ -1,11 +1,12 @@
 package services
 
 import (
-	"crypto/rand"
+	"bytes"
 	"fmt"
+	"html/template"
 	"ldap-self-service/internal/config"
-	"math/big"
-	"sync"
+	"ldap-self-service/internal/models"
+	"strings"
 	"time"
 
 	"gopkg.in/gomail.v2"
@@ -13,93 +14,38 @@ import (
 
 type EmailService struct {
 	config *config.Config
-	codes  map[string]*VerificationCode
-	mutex  sync.RWMutex
-}
-
-type VerificationCode struct {
-	Code      string
-	Email     string
-	Username  string
-	ExpiresAt time.Time
-	Token     string
 }
 
 func NewEmailService(cfg *config.Config) *EmailService {
-	service := &EmailService{
-		config: cfg,
-		codes:  make(map[string]*VerificationCode),
-	}
-	
-	go service.cleanupExpiredCodes()
-	return service
+	return &EmailService{config: cfg}
 }
 
-func (s *EmailService) SendVerificationCode(email, username string) (string, error) {
-	code, err := s.generateCode()
-	if err != nil {
-		return "", err
-	}
-
-	token, err := s.generateToken()
-	if err != nil {
-		return "", err
-	}
-
-	s.mutex.Lock()
-	s.codes[token] = &VerificationCode{
-		Code:      code,
-		Email:     email,
-		Username:  username,
-		ExpiresAt: time.Now().Add(10 * time.Minute),
-		Token:     token,
-	}
-	s.mutex.Unlock()
-
-	if err := s.sendEmail(email, code); err != nil {
-		s.mutex.Lock()
-		delete(s.codes, token)
-		s.mutex.Unlock()
-		return "", err
-	}
-
-	return token, nil
+func (s *EmailService) Name() string {
+	return "email"
 }
 
-func (s *EmailService) VerifyCode(token, code string) (bool, string) {
-	s.mutex.RLock()
-	verificationCode, exists := s.codes[token]
-	s.mutex.RUnlock()
-
-	if !exists {
-		return false, ""
-	}
-
-	if time.Now().After(verificationCode.ExpiresAt) {
-		s.mutex.Lock()
-		delete(s.codes, token)
-		s.mutex.Unlock()
-		return false, ""
+func (s *EmailService) Destinations(user *models.User) []string {
+	if len(user.Emails) == 0 && user.Email != "" {
+		return []string{user.Email}
 	}
+	return user.Emails
+}
 
-	if verificationCode.Code != code {
-		return false, ""
+// Mask keeps the first character of the local part and the domain.
+func (s *EmailService) Mask(destination string) string {
+	at := strings.LastIndex(destination, "@")
+	if at < 1 {
+		return "***"
 	}
+	return destination[:1] + "***" + destination[at:]
+}
 
-	email := verificationCode.Email
-	s.mutex.Lock()
-	delete(s.codes, token)
-	s.mutex.Unlock()
-
-	return true, email
+// Send emails a verification code to destination.
+func (s *EmailService) Send(destination, code string) error {
+	return s.sendEmail(destination, code)
 }
 
 func (s *EmailService) sendEmail(email, code string) error {
-	m := gomail.NewMessage()
-	m.SetHeader("From", fmt.Sprintf("%s <%s>", s.config.Email.FromName, s.config.Email.FromEmail))
-	m.SetHeader("To", email)
-	m.SetHeader("Subject", "LDAP Self-Service - Email Verification")
-	
 	body := fmt.Sprintf(`
 		<html>
 		<body>
@@ -110,85 +56,82 @@ func (s *EmailService) sendEmail(email, code string) error {
 		</body>
 		</html>
 	`, code)
-	
-	m.SetBody("text/html", body)
 
-	d := gomail.NewDialer(
-		s.config.Email.SMTPHost,
-		s.config.Email.SMTPPort,
-		s.config.Email.SMTPUser,
-		s.config.Email.SMTPPassword,
-	)
-
-	return d.DialAndSend(m)
+	return s.send(email, "LDAP Self-Service - Email Verification", body)
 }
 
-func (s *EmailService) generateCode() (string, error) {
-	const charset = "0123456789"
-	code := make([]byte, 6)
-	
-	for i := range code {
-		num, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
-		if err != nil {
-			return "", err
-		}
-		code[i] = charset[num.Int64()]
-	}
-	
-	return string(code), nil
-}
+var expiryReminderTemplate = template.Must(template.New("expiry-reminder").Parse(`
+		<html>
+		<body>
+			<h2>Your password expires soon</h2>
+			<p>Hello {{if .FirstName}}{{.FirstName}}{{else}}{{.Username}}{{end}},</p>
+			<p>The password for your account <strong>{{.Username}}</strong> expires
+			{{if eq .Days 0}}today{{else if eq .Days 1}}tomorrow{{else}}in {{.Days}} days{{end}},
+			on {{.ExpiresAt.Format "Monday, 2 January 2006 at 15:04 MST"}}.</p>
+			<p>Change it before then to avoid being locked out:
+			<a href="{{.DashboardURL}}">{{.DashboardURL}}</a></p>
+			<p>{{.SiteName}}</p>
+		</body>
+		</html>
+`))
 
-func (s *EmailService) generateToken() (string, error) {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	token := make([]byte, 32)
-	
-	for i := range token {
-		num, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
-		if err != nil {
-			return "", err
-		}
-		token[i] = charset[num.Int64()]
+var resetLinkTemplate = template.Must(template.New("reset-link").Parse(`
+		<html>
+		<body>
+			<h2>Password Reset</h2>
+			<p>Open this link to choose a new password:</p>
+			<p><a href="{{.Link}}">{{.Link}}</a></p>
+			<p>The link can be used once and expires in {{.Minutes}} minutes.</p>
+			<p>If you didn't request a password reset, please ignore this email.</p>
+		</body>
+		</html>
+`))
+
+// SendResetLink emails a one-time password reset link valid for ttl.
+func (s *EmailService) SendResetLink(email, link string, ttl time.Duration) error {
+	var body bytes.Buffer
+	err := resetLinkTemplate.Execute(&body, map[string]interface{}{
+		"Link":    link,
+		"Minutes": int(ttl.Round(time.Minute).Minutes()),
+	})
+	if err != nil {
+		return err
 	}
-	
-	return string(token), nil
-}
 
-func (s *EmailService) cleanupExpiredCodes() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		s.mutex.Lock()
-		now := time.Now()
-		for token, code := range s.codes {
-			if now.After(code.ExpiresAt) {
-				delete(s.codes, token)
-			}
-		}
-		s.mutex.Unlock()
-	}
+	return s.send(email, fmt.Sprintf("%s - Password Reset", s.config.SiteName), body.String())
 }
 
-func (s *EmailService) HasToken(token string) bool {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	
-	entry, exists := s.codes[token]
-	if !exists {
-		return false
+// SendExpiryReminder tells a user that their password expires in days.
+func (s *EmailService) SendExpiryReminder(account ExpiringAccount, days int, dashboardURL string) error {
+	var body bytes.Buffer
+	err := expiryReminderTemplate.Execute(&body, map[string]interface{}{
+		"Username":     account.Username,
+		"FirstName":    account.FirstName,
+		"Days":         days,
+		"ExpiresAt":    account.ExpiresAt.Local(),
+		"DashboardURL": dashboardURL,
+		"SiteName":     s.config.SiteName,
+	})
+	if err != nil {
+		return err
 	}
-	
-	return time.Now().Before(entry.ExpiresAt)
+
+	return s.send(account.Email, fmt.Sprintf("%s - Your password expires soon", s.config.SiteName), body.String())
 }
 
-func (s *EmailService) GetUsernameForToken(token string) string {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	
-	entry, exists := s.codes[token]
-	if !exists || time.Now().After(entry.ExpiresAt) {
-		return ""
-	}
-	
-	return entry.Username
-}
\ No newline at end of file
+func (s *EmailService) send(to, subject, body string) error {
+	m := gomail.NewMessage()
+	m.SetHeader("From", fmt.Sprintf("%s <%s>", s.config.Email.FromName, s.config.Email.FromEmail))
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/html", body)
+
+	d := gomail.NewDialer(
+		s.config.Email.SMTPHost,
+		s.config.Email.SMTPPort,
+		s.config.Email.SMTPUser,
+		s.config.Email.SMTPPassword,
+	)
+
+	return d.DialAndSend(m)
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrorKind classifies failures so handlers can map them to stable API
+// error codes without inspecting directory messages.
+type ErrorKind string
+
+const (
+	KindInvalidRequest       ErrorKind = "invalid_request"
+	KindInvalidCredentials   ErrorKind = "invalid_credentials"
+	KindUserNotFound         ErrorKind = "user_not_found"
+	KindAccountLocked        ErrorKind = "account_locked"
+	KindAccountDisabled      ErrorKind = "account_disabled"
+	KindPasswordExpired      ErrorKind = "password_expired"
+	KindPasswordMustChange   ErrorKind = "password_must_change"
+	KindPasswordTooYoung     ErrorKind = "password_too_young"
+	KindPolicyViolation      ErrorKind = "password_policy"
+	KindInsufficientAccess   ErrorKind = "insufficient_access"
+	KindTooManyAttempts      ErrorKind = "too_many_attempts"
+	KindInvalidCode          ErrorKind = "invalid_code"
+	KindTOTPRequired         ErrorKind = "totp_required"
+	KindInvalidToken         ErrorKind = "invalid_token"
+	KindInvalidCSRFToken     ErrorKind = "invalid_csrf_token"
+	KindSessionNotFound      ErrorKind = "session_not_found"
+	KindReauthRequired       ErrorKind = "reauthentication_required"
+	KindDirectoryUnavailable ErrorKind = "directory_unavailable"
+	KindDirectoryError       ErrorKind = "directory_error"
+)
+
+// ServiceError is a classified failure. Message is safe to show to end
+// users; Err keeps the underlying cause for logs and never leaves the server.
+type ServiceError struct {
+	Kind    ErrorKind
+	Message string
+	Err     error
+}
+
+func (e *ServiceError) Error() string {
+	return e.Message
+}
+
+func (e *ServiceError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches another *ServiceError of the same kind, so the sentinels below
+// work with errors.Is regardless of message or cause.
+func (e *ServiceError) Is(target error) bool {
+	t, ok := target.(*ServiceError)
+	return ok && t.Kind == e.Kind
+}
+
+var (
+	ErrInvalidCredentials   = &ServiceError{Kind: KindInvalidCredentials, Message: "invalid credentials"}
+	ErrUserNotFound         = &ServiceError{Kind: KindUserNotFound, Message: "user not found"}
+	ErrAccountLocked        = &ServiceError{Kind: KindAccountLocked, Message: "the account is locked"}
+	ErrAccountDisabled      = &ServiceError{Kind: KindAccountDisabled, Message: "the account is disabled"}
+	ErrPasswordExpired      = &ServiceError{Kind: KindPasswordExpired, Message: "the password has expired"}
+	ErrPasswordMustChange   = &ServiceError{Kind: KindPasswordMustChange, Message: "the password must be changed"}
+	ErrPasswordTooYoung     = &ServiceError{Kind: KindPasswordTooYoung, Message: "the password was changed too recently to be changed again"}
+	ErrInsufficientAccess   = &ServiceError{Kind: KindInsufficientAccess, Message: "the directory does not allow this change"}
+	ErrDirectoryUnavailable = &ServiceError{Kind: KindDirectoryUnavailable, Message: "the directory is currently unavailable"}
+	ErrInvalidCode          = &ServiceError{Kind: KindInvalidCode, Message: "invalid verification code"}
+	ErrInvalidToken         = &ServiceError{Kind: KindInvalidToken, Message: "the token is invalid or has been revoked"}
+	ErrInvalidCSRFToken     = &ServiceError{Kind: KindInvalidCSRFToken, Message: "missing or invalid CSRF token"}
+	ErrSessionNotFound      = &ServiceError{Kind: KindSessionNotFound, Message: "session not found"}
+	ErrReauthRequired       = &ServiceError{Kind: KindReauthRequired, Message: "enter your current password to make this change"}
+)
+
+func newServiceError(kind *ServiceError, err error) *ServiceError {
+	return &ServiceError{Kind: kind.Kind, Message: kind.Message, Err: err}
+}
+
+func invalidRequest(message string, err error) *ServiceError {
+	return &ServiceError{Kind: KindInvalidRequest, Message: message, Err: err}
+}
+
+// ErrorKindOf returns the kind of a classified error, or KindDirectoryError
+// for anything else.
+func ErrorKindOf(err error) ErrorKind {
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		return KindPolicyViolation
+	}
+
+	var throttleErr *ThrottleError
+	if errors.As(err, &throttleErr) {
+		return KindTooManyAttempts
+	}
+
+	var serviceErr *ServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.Kind
+	}
+
+	return KindDirectoryError
+}
+
+func directoryPolicyError(rule, message string) *PolicyError {
+	return &PolicyError{Violations: []PolicyViolation{{Rule: rule, Message: message}}}
+}
+
+// translateLDAPError classifies an error returned by the directory. The
+// Behera password policy response control, when present, takes precedence
+// over the result code and diagnostic message.
+func translateLDAPError(err error, controls []ldap.Control) error {
+	if err == nil {
+		return nil
+	}
+
+	var policyErr *PolicyError
+	var serviceErr *ServiceError
+	if errors.As(err, &policyErr) || errors.As(err, &serviceErr) {
+		return err
+	}
+
+	if errors.Is(err, ErrNoServerAvailable) || errors.Is(err, ErrPoolExhausted) {
+		return newServiceError(ErrDirectoryUnavailable, err)
+	}
+
+	if ctrl, ok := ldap.FindControl(controls, ldap.ControlTypeBeheraPasswordPolicy).(*ldap.ControlBeheraPasswordPolicy); ok && ctrl.Error >= 0 {
+		if translated := translatePasswordPolicyError(ctrl.Error, err); translated != nil {
+			return translated
+		}
+	}
+
+	// 389-ds and FreeIPA reject binds with an expired password and attach
+	// the Netscape "password expired" control instead.
+	if ctrl, ok := ldap.FindControl(controls, ldap.ControlTypeVChuPasswordMustChange).(*ldap.ControlVChuPasswordMustChange); ok && ctrl.MustChange {
+		return newServiceError(ErrPasswordExpired, err)
+	}
+
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) {
+		return &ServiceError{Kind: KindDirectoryError, Message: "directory operation failed", Err: err}
+	}
+
+	diagnostic := ""
+	if ldapErr.Err != nil {
+		diagnostic = strings.ToLower(ldapErr.Err.Error())
+	}
+
+	switch ldapErr.ResultCode {
+	case ldap.LDAPResultInvalidCredentials:
+		return newServiceError(ErrInvalidCredentials, err)
+	case ldap.LDAPResultNoSuchObject:
+		return newServiceError(ErrUserNotFound, err)
+	case ldap.LDAPResultInsufficientAccessRights:
+		return newServiceError(ErrInsufficientAccess, err)
+	case ldap.LDAPResultBusy, ldap.LDAPResultUnavailable, ldap.ErrorNetwork, ldap.LDAPResultServerDown,
+		ldap.LDAPResultTimeout, ldap.LDAPResultConnectError:
+		return newServiceError(ErrDirectoryUnavailable, err)
+	case ldap.LDAPResultConstraintViolation, ldap.LDAPResultUnwillingToPerform:
+		if translated := translateDiagnostic(diagnostic, err); translated != nil {
+			return translated
+		}
+		if ldapErr.ResultCode == ldap.LDAPResultConstraintViolation {
+			return directoryPolicyError(RuleDirectoryPolicy, "password was rejected by the directory's password policy")
+		}
+		return newServiceError(ErrInsufficientAccess, err)
+	}
+
+	return &ServiceError{Kind: KindDirectoryError, Message: "directory operation failed", Err: err}
+}
+
+// translatePasswordPolicyError maps a Behera ppolicy error code.
+func translatePasswordPolicyError(code int8, err error) error {
+	switch code {
+	case 0:
+		return newServiceError(ErrPasswordExpired, err)
+	case 1:
+		return newServiceError(ErrAccountLocked, err)
+	case 2:
+		return newServiceError(ErrPasswordMustChange, err)
+	case 3:
+		return newServiceError(ErrInsufficientAccess, err)
+	case 4:
+		return invalidRequest("the current password must be supplied", err)
+	case 5:
+		return directoryPolicyError(RuleDirectoryPolicy, "password does not meet the directory's quality requirements")
+	case 6:
+		return directoryPolicyError(RuleMinLength, "password is shorter than the directory allows")
+	case 7:
+		return newServiceError(ErrPasswordTooYoung, err)
+	case 8:
+		return directoryPolicyError(RuleNoReuse, "password matches one of your previous passwords")
+	}
+	return nil
+}
+
+// translateDiagnostic recognises the diagnostic messages OpenLDAP, 389-ds
+// and FreeIPA send when no ppolicy control is available, e.g. for the
+// Password Modify extended operation.
+func translateDiagnostic(diagnostic string, err error) error {
+	switch {
+	case strings.Contains(diagnostic, "too young"), strings.Contains(diagnostic, "too soon"):
+		return newServiceError(ErrPasswordTooYoung, err)
+	case strings.Contains(diagnostic, "history"), strings.Contains(diagnostic, "reuse"):
+		return directoryPolicyError(RuleNoReuse, "password matches one of your previous passwords")
+	case strings.Contains(diagnostic, "too short"):
+		return directoryPolicyError(RuleMinLength, "password is shorter than the directory allows")
+	case strings.Contains(diagnostic, "quality"), strings.Contains(diagnostic, "character classes"),
+		strings.Contains(diagnostic, "dictionary"), strings.Contains(diagnostic, "too simple"):
+		return directoryPolicyError(RuleDirectoryPolicy, "password does not meet the directory's quality requirements")
+	case strings.Contains(diagnostic, "expired"):
+		return newServiceError(ErrPasswordExpired, err)
+	case strings.Contains(diagnostic, "locked"), strings.Contains(diagnostic, "exceed password retry limit"):
+		return newServiceError(ErrAccountLocked, err)
+	case strings.Contains(diagnostic, "inactivated"), strings.Contains(diagnostic, "disabled"):
+		return newServiceError(ErrAccountDisabled, err)
+	}
+	return nil
+}
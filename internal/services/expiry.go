@@ -0,0 +1,185 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"ldap-self-service/internal/models"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// expiryAttributes are read to work out when a user's password expires.
+var expiryAttributes = []string{
+	"pwdChangedTime",
+	"shadowLastChange",
+	"shadowMax",
+	"krbPasswordExpiration",
+	"msDS-UserPasswordExpiryTimeComputed",
+}
+
+const generalizedTime = "20060102150405Z"
+
+// passwordExpiresAt derives the expiry time from the entry's attributes.
+// Absolute expiry attributes (FreeIPA, Active Directory) are preferred;
+// shadow and ppolicy change times are combined with their maximum age. It
+// returns nil when the password does not expire or nothing is known.
+func (s *LDAPService) passwordExpiresAt(entry *ldap.Entry) *time.Time {
+	if value := entry.GetAttributeValue("krbPasswordExpiration"); value != "" {
+		if t, err := time.Parse(generalizedTime, value); err == nil {
+			return &t
+		}
+	}
+
+	if value := entry.GetAttributeValue("msDS-UserPasswordExpiryTimeComputed"); value != "" {
+		if filetime, err := strconv.ParseInt(value, 10, 64); err == nil && filetime > 0 && filetime != math.MaxInt64 {
+			// FILETIME counts 100ns intervals since 1601-01-01.
+			t := time.Unix((filetime-116444736000000000)/10000000, 0).UTC()
+			return &t
+		}
+	}
+
+	lastChange, err1 := strconv.Atoi(entry.GetAttributeValue("shadowLastChange"))
+	maxDays, err2 := strconv.Atoi(entry.GetAttributeValue("shadowMax"))
+	if err1 == nil && err2 == nil && maxDays > 0 && maxDays < 99999 {
+		t := time.Unix(0, 0).UTC().AddDate(0, 0, lastChange+maxDays)
+		return &t
+	}
+
+	if maxAge := s.config.PasswordPolicy.MaxAge; maxAge > 0 {
+		if changed, err := time.Parse(generalizedTime, entry.GetAttributeValue("pwdChangedTime")); err == nil {
+			t := changed.AddDate(0, 0, maxAge)
+			return &t
+		}
+	}
+
+	return nil
+}
+
+// buildPasswordExpiry combines directory attributes with the password
+// policy controls returned on the user's bind.
+func (s *LDAPService) buildPasswordExpiry(entry *ldap.Entry, controls []ldap.Control, now time.Time) *models.PasswordExpiry {
+	expiry := &models.PasswordExpiry{ExpiresAt: s.passwordExpiresAt(entry)}
+
+	if ctrl, ok := ldap.FindControl(controls, ldap.ControlTypeBeheraPasswordPolicy).(*ldap.ControlBeheraPasswordPolicy); ok {
+		if ctrl.Expire >= 0 {
+			t := now.Add(time.Duration(ctrl.Expire) * time.Second)
+			expiry.ExpiresAt = &t
+		}
+		if ctrl.Grace >= 0 {
+			grace := int(ctrl.Grace)
+			expiry.GraceLoginsRemaining = &grace
+			expiry.Expired = true
+		}
+		if ctrl.Error == 2 {
+			expiry.MustChange = true
+		}
+	}
+
+	if ctrl, ok := ldap.FindControl(controls, ldap.ControlTypeVChuPasswordWarning).(*ldap.ControlVChuPasswordWarning); ok && ctrl.Expire >= 0 {
+		t := now.Add(time.Duration(ctrl.Expire) * time.Second)
+		expiry.ExpiresAt = &t
+	}
+
+	if ctrl, ok := ldap.FindControl(controls, ldap.ControlTypeVChuPasswordMustChange).(*ldap.ControlVChuPasswordMustChange); ok && ctrl.MustChange {
+		expiry.MustChange = true
+	}
+
+	if expiry.ExpiresAt != nil {
+		days := int(math.Floor(expiry.ExpiresAt.Sub(now).Hours() / 24))
+		expiry.DaysUntilExpiry = &days
+		if !expiry.ExpiresAt.After(now) {
+			expiry.Expired = true
+		}
+	}
+
+	return expiry
+}
+
+// credentialsVerifiedButExpired reports whether a failed user bind still
+// proved the password: directories only report expiry or a forced change
+// once the supplied password has been accepted.
+func credentialsVerifiedButExpired(err error) bool {
+	return errors.Is(err, ErrPasswordExpired) || errors.Is(err, ErrPasswordMustChange)
+}
+
+// ExpiringAccount is a user whose password expires within a search window.
+type ExpiringAccount struct {
+	Username  string
+	DN        string
+	Email     string
+	FirstName string
+	ExpiresAt time.Time
+}
+
+// FindExpiringAccounts lists users under UserBaseDN whose password expires
+// after now and no later than now+within. Accounts without an email
+// address are skipped since they cannot be notified.
+func (s *LDAPService) FindExpiringAccounts(now time.Time, within time.Duration) ([]ExpiringAccount, error) {
+	conn, err := s.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	searchRequest := ldap.NewSearchRequest(
+		s.config.LDAP.UserBaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		// The user filter with a wildcard matches every account it would
+		// match for a single login.
+		fmt.Sprintf(s.config.LDAP.UserFilter, "*"),
+		append([]string{s.config.LDAP.UsernameAttr, s.config.LDAP.EmailAttr, "givenName"}, expiryAttributes...),
+		nil,
+	)
+
+	sr, err := conn.SearchWithPaging(searchRequest, 500)
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %w", s.translateError(err, nil))
+	}
+
+	deadline := now.Add(within)
+	var accounts []ExpiringAccount
+	for _, entry := range sr.Entries {
+		email := entry.GetAttributeValue(s.config.LDAP.EmailAttr)
+		if email == "" {
+			continue
+		}
+
+		expiresAt := s.passwordExpiresAt(entry)
+		if expiresAt == nil || !expiresAt.After(now) || expiresAt.After(deadline) {
+			continue
+		}
+
+		username := entry.GetAttributeValue(s.config.LDAP.UsernameAttr)
+		if username == "" {
+			username = loginFromDN(entry.DN)
+		}
+
+		accounts = append(accounts, ExpiringAccount{
+			Username:  username,
+			DN:        entry.DN,
+			Email:     email,
+			FirstName: entry.GetAttributeValue("givenName"),
+			ExpiresAt: *expiresAt,
+		})
+	}
+
+	return accounts, nil
+}
+
+// loginFromDN returns the value of the leading RDN. It is only a fallback
+// name for entries without ldap.username_attr; in AD, and for any entry
+// named by cn, it is the display name rather than the login.
+func loginFromDN(userDN string) string {
+	dn, err := ldap.ParseDN(userDN)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return ""
+	}
+	return dn.RDNs[0].Attributes[0].Value
+}
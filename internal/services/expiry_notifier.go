@@ -0,0 +1,231 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ldap-self-service/internal/config"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// expiryReminderPrefix keys the reminders sent to a user in the
+// verification store.
+const expiryReminderPrefix = "expiry-reminder:"
+
+// ExpiryNotifier periodically emails users whose password expires within
+// one of the configured windows. Each reminder is sent once per window and
+// per expiry date, so a user who changes their password starts afresh.
+//
+// Sent reminders are claimed in the verification store with an atomic
+// update before the email goes out, so replicas sharing a Redis store
+// can all run the scheduler without emailing anyone twice.
+type ExpiryNotifier struct {
+	config       *config.Config
+	ldapService  *LDAPService
+	emailService *EmailService
+	store        VerificationStore
+	windows      []int
+	dashboardURL string
+}
+
+// sentReminders is a user's record, kept as JSON in VerificationCode.Data
+// until their password expires.
+type sentReminders struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+	Windows   []int     `json:"windows"`
+}
+
+func NewExpiryNotifier(cfg *config.Config, ldapService *LDAPService, emailService *EmailService, store VerificationStore) (*ExpiryNotifier, error) {
+	if cfg.BaseURL == "" {
+		return nil, errors.New("base_url must be set to send expiry reminders")
+	}
+
+	var windows []int
+	for _, window := range cfg.ExpiryReminders.Windows {
+		if window >= 0 {
+			windows = append(windows, window)
+		}
+	}
+	if len(windows) == 0 {
+		return nil, errors.New("expiry_reminders.windows must list at least one number of days")
+	}
+	sort.Ints(windows)
+
+	return &ExpiryNotifier{
+		config:       cfg,
+		ldapService:  ldapService,
+		emailService: emailService,
+		store:        store,
+		windows:      windows,
+		dashboardURL: strings.TrimRight(cfg.BaseURL, "/") + "/dashboard",
+	}, nil
+}
+
+// Start runs a first pass immediately and then one every interval.
+func (n *ExpiryNotifier) Start() {
+	interval := time.Duration(n.config.ExpiryReminders.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	go func() {
+		n.Run(time.Now())
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			n.Run(now)
+		}
+	}()
+}
+
+// Run sends the reminders that are due at now.
+func (n *ExpiryNotifier) Run(now time.Time) {
+	maxWindow := n.windows[len(n.windows)-1]
+	accounts, err := n.ldapService.FindExpiringAccounts(now, time.Duration(maxWindow+1)*24*time.Hour)
+	if err != nil {
+		log.Printf("Expiry reminders: directory search failed: %v", err)
+		return
+	}
+
+	sentCount := 0
+	for _, account := range accounts {
+		days := int(math.Floor(account.ExpiresAt.Sub(now).Hours() / 24))
+		window, ok := n.dueWindow(days)
+		if !ok {
+			continue
+		}
+
+		claimed, err := n.claim(account, window)
+		if err != nil {
+			log.Printf("Expiry reminders: failed to record reminder for %s: %v", account.Username, err)
+			continue
+		}
+		if len(claimed) == 0 {
+			continue
+		}
+
+		if err := n.emailService.SendExpiryReminder(account, days, n.dashboardURL); err != nil {
+			log.Printf("Expiry reminders: failed to email %s: %v", account.Username, err)
+			if err := n.release(account, claimed); err != nil {
+				log.Printf("Expiry reminders: failed to release reminder for %s: %v", account.Username, err)
+			}
+			continue
+		}
+		sentCount++
+	}
+
+	if sentCount > 0 {
+		log.Printf("Expiry reminders: sent %d reminder(s)", sentCount)
+	}
+}
+
+// dueWindow returns the narrowest window that days falls within.
+func (n *ExpiryNotifier) dueWindow(days int) (int, bool) {
+	for _, window := range n.windows {
+		if days <= window {
+			return window, true
+		}
+	}
+	return 0, false
+}
+
+// claim marks window as sent for account's current expiry date, along
+// with the wider windows it covers: a user first seen three days before
+// expiry should not also get the 7-day reminder. It returns the windows it
+// marked, or none when the reminder was already sent, by this or another
+// replica.
+func (n *ExpiryNotifier) claim(account ExpiringAccount, window int) ([]int, error) {
+	var claimed []int
+	err := n.store.Update(n.key(account), func(current *VerificationCode) (*VerificationCode, error) {
+		claimed = nil
+		record, err := n.decode(current, account)
+		if err != nil || record.has(window) {
+			return current, err
+		}
+
+		for _, w := range n.windows {
+			if w >= window && !record.has(w) {
+				record.Windows = append(record.Windows, w)
+				claimed = append(claimed, w)
+			}
+		}
+		return n.encode(account, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// release unmarks windows claimed for a reminder that could not be sent,
+// so the next pass tries again.
+func (n *ExpiryNotifier) release(account ExpiringAccount, windows []int) error {
+	return n.store.Update(n.key(account), func(current *VerificationCode) (*VerificationCode, error) {
+		record, err := n.decode(current, account)
+		if err != nil {
+			return current, err
+		}
+
+		var kept []int
+		for _, w := range record.Windows {
+			if !slices.Contains(windows, w) {
+				kept = append(kept, w)
+			}
+		}
+		if len(kept) == 0 {
+			return nil, nil
+		}
+		record.Windows = kept
+		return n.encode(account, record)
+	})
+}
+
+func (n *ExpiryNotifier) key(account ExpiringAccount) string {
+	return expiryReminderPrefix + normalizeDN(account.DN)
+}
+
+// decode returns the reminders recorded for account's current expiry date;
+// a record for an earlier expiry is from before the last password change.
+func (n *ExpiryNotifier) decode(current *VerificationCode, account ExpiringAccount) (*sentReminders, error) {
+	record := &sentReminders{}
+	if current != nil {
+		if err := json.Unmarshal([]byte(current.Data), record); err != nil {
+			return nil, fmt.Errorf("invalid expiry reminder data: %w", err)
+		}
+	}
+	if !record.ExpiresAt.Equal(account.ExpiresAt) {
+		record = &sentReminders{ExpiresAt: account.ExpiresAt}
+	}
+	return record, nil
+}
+
+// encode builds the store record for record, which lapses when the
+// password expires.
+func (n *ExpiryNotifier) encode(account ExpiringAccount, record *sentReminders) (*VerificationCode, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return &VerificationCode{
+		Username:  account.Username,
+		DN:        account.DN,
+		ExpiresAt: account.ExpiresAt,
+		Data:      string(data),
+	}, nil
+}
+
+func (r *sentReminders) has(window int) bool {
+	for _, w := range r.Windows {
+		if w == window {
+			return true
+		}
+	}
+	return false
+}
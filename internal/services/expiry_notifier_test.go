@@ -0,0 +1,122 @@
+package services
+
+import (
+	"ldap-self-service/internal/config"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestExpiryNotifier(t *testing.T, store VerificationStore) *ExpiryNotifier {
+	t.Helper()
+
+	notifier, err := NewExpiryNotifier(&config.Config{
+		BaseURL:         "https://portal.example.com",
+		ExpiryReminders: config.ExpiryReminderConfig{Enabled: true, Windows: []int{1, 14, 7}},
+	}, nil, nil, store)
+	if err != nil {
+		t.Fatalf("NewExpiryNotifier: %v", err)
+	}
+	return notifier
+}
+
+func TestExpiryNotifierClaim(t *testing.T) {
+	expiresAt := time.Now().Add(10 * 24 * time.Hour).Truncate(time.Second)
+	account := ExpiringAccount{Username: "alice", DN: "uid=alice,dc=example,dc=com", ExpiresAt: expiresAt}
+
+	tests := []struct {
+		name    string
+		account ExpiringAccount
+		window  int
+		want    []int
+	}{
+		{name: "first reminder", account: account, window: 14, want: []int{14}},
+		{name: "same window again", account: account, window: 14},
+		{name: "narrower window", account: account, window: 7, want: []int{7}},
+		{name: "DN case differs", account: ExpiringAccount{Username: "alice", DN: "UID=Alice,DC=example,DC=com", ExpiresAt: expiresAt}, window: 7},
+		{name: "password changed", account: ExpiringAccount{Username: "alice", DN: account.DN, ExpiresAt: expiresAt.Add(90 * 24 * time.Hour)}, window: 14, want: []int{14}},
+		{name: "first seen inside the last window", account: ExpiringAccount{Username: "bob", DN: "uid=bob,dc=example,dc=com", ExpiresAt: expiresAt}, window: 1, want: []int{1, 7, 14}},
+	}
+
+	for name, store := range verificationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			notifier := newTestExpiryNotifier(t, store)
+			for _, tt := range tests {
+				claimed, err := notifier.claim(tt.account, tt.window)
+				if err != nil {
+					t.Fatalf("%s: claim: %v", tt.name, err)
+				}
+				if !slices.Equal(claimed, tt.want) {
+					t.Fatalf("%s: claim = %v, want %v", tt.name, claimed, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestExpiryNotifierRelease(t *testing.T) {
+	account := ExpiringAccount{Username: "alice", DN: "uid=alice,dc=example,dc=com", ExpiresAt: time.Now().Add(5 * 24 * time.Hour)}
+
+	for name, store := range verificationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			notifier := newTestExpiryNotifier(t, store)
+
+			if _, err := notifier.claim(account, 14); err != nil {
+				t.Fatalf("claim: %v", err)
+			}
+			claimed, err := notifier.claim(account, 7)
+			if err != nil {
+				t.Fatalf("claim: %v", err)
+			}
+			// The email failed.
+			if err := notifier.release(account, claimed); err != nil {
+				t.Fatalf("release: %v", err)
+			}
+
+			if claimed, err := notifier.claim(account, 14); err != nil || len(claimed) != 0 {
+				t.Fatalf("claim(14) after release = %v, %v; want the earlier reminder kept", claimed, err)
+			}
+			if claimed, err := notifier.claim(account, 7); err != nil || !slices.Equal(claimed, []int{7}) {
+				t.Fatalf("claim(7) after release = %v, %v; want [7]", claimed, err)
+			}
+		})
+	}
+}
+
+// TestExpiryNotifierReplicas has several replicas sharing a store claim the
+// same reminder at once. Only one may send it.
+func TestExpiryNotifierReplicas(t *testing.T) {
+	account := ExpiringAccount{Username: "alice", DN: "uid=alice,dc=example,dc=com", ExpiresAt: time.Now().Add(5 * 24 * time.Hour)}
+
+	for name, store := range verificationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			const replicas = 8
+			var wg sync.WaitGroup
+			var mutex sync.Mutex
+			sent := 0
+			for i := 0; i < replicas; i++ {
+				notifier := newTestExpiryNotifier(t, store)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					claimed, err := notifier.claim(account, 7)
+					if err != nil {
+						t.Errorf("claim: %v", err)
+						return
+					}
+					if len(claimed) > 0 {
+						mutex.Lock()
+						sent++
+						mutex.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			if sent != 1 {
+				t.Fatalf("%d replicas sent the reminder, want 1", sent)
+			}
+		})
+	}
+}
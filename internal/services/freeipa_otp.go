@@ -0,0 +1,423 @@
+package services
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
+	"ldap-self-service/internal/config"
+	"ldap-self-service/internal/models"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ipaTokenAttributes are read from FreeIPA ipatokenOTP entries.
+var ipaTokenAttributes = []string{
+	"objectClass",
+	"ipatokenUniqueID",
+	"ipatokenOTPkey",
+	"ipatokenOTPalgorithm",
+	"ipatokenOTPdigits",
+	"ipatokenTOTPtimeStep",
+	"ipatokenTOTPclockOffset",
+	"ipatokenHOTPcounter",
+	"ipatokenTOTPwatermark",
+	"ipatokenNotBefore",
+	"ipatokenNotAfter",
+}
+
+// FreeIPAOTPChannel is the "otp" reset method for FreeIPA users with HOTP
+// or TOTP tokens. Nothing is sent: the user reads the code off their token.
+//
+// In "key" mode the service account reads ipatokenOTPkey and checks the
+// code itself, advancing the HOTP counter or TOTP watermark so each code
+// works once; it needs read access to the keys, which FreeIPA grants only
+// to administrators by default. In "bind" mode the user binds with their
+// current password followed by the code, which FreeIPA checks, so the mode
+// only helps users who still know their password, for instance one that
+// has expired. It is limited to users FreeIPA requires the OTP from.
+type FreeIPAOTPChannel struct {
+	config config.OTPConfig
+	ldap   *LDAPService
+	baseDN string
+	// ipaConfigDN holds the global ipaUserAuthType.
+	ipaConfigDN string
+
+	// mutex serializes token updates from this replica; advance makes
+	// them safe across replicas.
+	mutex sync.Mutex
+}
+
+func NewFreeIPAOTPChannel(cfg *config.Config, ldapService *LDAPService) (*FreeIPAOTPChannel, error) {
+	otp := cfg.OTP
+	if otp.Verify != "key" && otp.Verify != "bind" {
+		return nil, fmt.Errorf("unknown otp.verify %q, use key or bind", otp.Verify)
+	}
+
+	baseDN := otp.TokenBaseDN
+	if baseDN == "" {
+		baseDN = "cn=otp," + cfg.LDAP.BaseDN
+	}
+
+	return &FreeIPAOTPChannel{
+		config:      otp,
+		ldap:        ldapService,
+		baseDN:      baseDN,
+		ipaConfigDN: "cn=ipaConfig,cn=etc," + cfg.LDAP.BaseDN,
+	}, nil
+}
+
+// RequiresPassword reports whether codes must be preceded by the user's
+// current password.
+func (c *FreeIPAOTPChannel) RequiresPassword() bool {
+	return c.config.Verify == "bind"
+}
+
+func (c *FreeIPAOTPChannel) Name() string {
+	return "otp"
+}
+
+// Destinations is the user's DN when they own an active token and, in bind
+// mode, FreeIPA requires it. Codes are checked against all of the user's
+// tokens, so there is nothing to choose.
+func (c *FreeIPAOTPChannel) Destinations(user *models.User) []string {
+	if c.RequiresPassword() {
+		enforced, err := c.otpEnforced(user.DN)
+		if err != nil {
+			log.Printf("Failed to read the authentication types of %s: %v", user.DN, err)
+			return nil
+		}
+		if !enforced {
+			return nil
+		}
+	}
+
+	conn, err := c.ldap.Connect()
+	if err != nil {
+		log.Printf("Failed to look up OTP tokens for %s: %v", user.DN, err)
+		return nil
+	}
+	defer conn.Close()
+
+	tokens, err := c.tokens(conn, user.DN)
+	if err != nil {
+		log.Printf("Failed to look up OTP tokens for %s: %v", user.DN, err)
+		return nil
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+	return []string{user.DN}
+}
+
+func (c *FreeIPAOTPChannel) Mask(destination string) string {
+	return "OTP token"
+}
+
+// Start records nothing beyond the challenge itself; the code comes from
+// the user's token.
+func (c *FreeIPAOTPChannel) Start(user *models.User, destination string, challenge *VerificationCode) error {
+	return nil
+}
+
+func (c *FreeIPAOTPChannel) Verify(challenge *VerificationCode, response ChallengeResponse) (bool, error) {
+	if response.Code == "" {
+		return false, nil
+	}
+	if c.RequiresPassword() {
+		return c.verifyBind(challenge.DN, response.Password, response.Code)
+	}
+	return c.verifyKey(challenge.DN, response.Code)
+}
+
+// verifyBind lets FreeIPA check the code by binding with password+code.
+// FreeIPA can't tell that bind from one with the password alone when the
+// user may also sign in without OTP, so such users are refused.
+func (c *FreeIPAOTPChannel) verifyBind(userDN, password, code string) (bool, error) {
+	if password == "" {
+		return false, nil
+	}
+
+	enforced, err := c.otpEnforced(userDN)
+	if err != nil {
+		return false, err
+	}
+	if !enforced {
+		log.Printf("Refusing an OTP bind check for %s: FreeIPA does not require OTP for the account", userDN)
+		return false, nil
+	}
+
+	conn, err := c.ldap.Connect()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := c.ldap.bindUser(conn, userDN, password+code); err != nil {
+		if credentialsVerifiedButExpired(err) {
+			return true, nil
+		}
+		if errors.Is(err, ErrInvalidCredentials) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// verifyKey checks code against each of the user's tokens and moves the
+// token's HOTP counter or TOTP watermark past it, so it can't be used
+// again.
+func (c *FreeIPAOTPChannel) verifyKey(userDN, code string) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Read the tokens from a writer, where counters and watermarks are
+	// updated; a lagging replica would offer a used code again.
+	conn, err := c.ldap.connectWrite()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	tokens, err := c.tokens(conn, userDN)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	for _, token := range tokens {
+		attribute := "ipatokenTOTPwatermark"
+		used, ok := token.matchTOTP(code, now, c.config.TOTPSkew)
+		if token.HOTP {
+			attribute = "ipatokenHOTPcounter"
+			used, ok = token.matchHOTP(code, c.config.HOTPWindow)
+		}
+		if ok {
+			return c.advance(conn, token, attribute, used+1)
+		}
+	}
+	return false, nil
+}
+
+// advance moves the token's HOTP counter or TOTP watermark from the value
+// it was read with to next, in a single modify that fails if another
+// request moved it first. FreeIPA's own binds use and advance the same
+// attributes.
+func (c *FreeIPAOTPChannel) advance(conn *PooledConn, token *ipaToken, attribute string, next int64) (bool, error) {
+	modifyRequest := ldap.NewModifyRequest(token.DN, nil)
+	if token.State != "" {
+		modifyRequest.Delete(attribute, []string{token.State})
+	}
+	modifyRequest.Add(attribute, []string{strconv.FormatInt(next, 10)})
+
+	err := conn.Modify(modifyRequest)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchAttribute) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultAttributeOrValueExists) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultConstraintViolation) {
+		// The code was used concurrently.
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update %s: %w", attribute, c.ldap.translateError(err, nil))
+	}
+	return true, nil
+}
+
+// otpEnforced reports whether FreeIPA requires an OTP when the user binds
+// with a password: their ipaUserAuthType, or the global one when they have
+// none, includes "otp" but not "password".
+func (c *FreeIPAOTPChannel) otpEnforced(userDN string) (bool, error) {
+	userTypes, err := c.ldap.readAttribute(userDN, "ipaUserAuthType")
+	if err != nil {
+		return false, err
+	}
+	if len(userTypes) > 0 {
+		return otpOnly(userTypes), nil
+	}
+
+	globalTypes, err := c.ldap.readAttribute(c.ipaConfigDN, "ipaUserAuthType")
+	if errors.Is(err, ErrUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return otpOnly(globalTypes), nil
+}
+
+func otpOnly(authTypes [][]byte) bool {
+	otp := false
+	for _, authType := range authTypes {
+		switch strings.ToLower(string(authType)) {
+		case "password":
+			return false
+		case "otp":
+			otp = true
+		}
+	}
+	return otp
+}
+
+// ipaToken is an active FreeIPA OTP token.
+type ipaToken struct {
+	DN      string
+	HOTP    bool
+	Key     []byte
+	NewHash func() hash.Hash
+	Digits  int
+	// Counter is the next HOTP counter and Watermark the first TOTP
+	// step that may still be used.
+	Counter   int64
+	Watermark int64
+	TimeStep  int64
+	Offset    int64
+	// State is the stored ipatokenHOTPcounter or ipatokenTOTPwatermark,
+	// empty when unset.
+	State string
+}
+
+func (t *ipaToken) matchHOTP(code string, window int) (int64, bool) {
+	for counter := t.Counter; counter <= t.Counter+int64(window); counter++ {
+		if subtle.ConstantTimeCompare([]byte(otpCode(t.NewHash, t.Key, counter, t.Digits)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// matchTOTP returns the step code is for, among those within skew of now
+// and not below the watermark.
+func (t *ipaToken) matchTOTP(code string, now time.Time, skew int) (int64, bool) {
+	current := (now.Unix() + t.Offset) / t.TimeStep
+	for step := max(current-int64(skew), t.Watermark); step <= current+int64(skew); step++ {
+		if subtle.ConstantTimeCompare([]byte(otpCode(t.NewHash, t.Key, step, t.Digits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// tokens returns the enabled, currently valid tokens owned by userDN. In
+// bind mode the keys are not needed and may not be readable.
+func (c *FreeIPAOTPChannel) tokens(conn *PooledConn, userDN string) ([]*ipaToken, error) {
+	searchRequest := ldap.NewSearchRequest(
+		c.baseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		fmt.Sprintf("(&(objectClass=ipaToken)(ipatokenOwner=%s)(!(ipatokenDisabled=TRUE)))", ldap.EscapeFilter(userDN)),
+		ipaTokenAttributes,
+		nil,
+	)
+
+	sr, err := conn.Search(searchRequest)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("search failed: %w", c.ldap.translateError(err, nil))
+	}
+
+	now := time.Now()
+	var tokens []*ipaToken
+	for _, entry := range sr.Entries {
+		if !tokenValidAt(entry, now) {
+			continue
+		}
+		token, err := parseIPAToken(entry)
+		if err != nil {
+			log.Printf("Skipping OTP token %s: %v", entry.DN, err)
+			continue
+		}
+		if !c.RequiresPassword() && len(token.Key) == 0 {
+			log.Printf("Skipping OTP token %s: ipatokenOTPkey is not readable", entry.DN)
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func tokenValidAt(entry *ldap.Entry, now time.Time) bool {
+	if value := entry.GetAttributeValue("ipatokenNotBefore"); value != "" {
+		if t, err := time.Parse(generalizedTime, value); err == nil && now.Before(t) {
+			return false
+		}
+	}
+	if value := entry.GetAttributeValue("ipatokenNotAfter"); value != "" {
+		if t, err := time.Parse(generalizedTime, value); err == nil && now.After(t) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseIPAToken(entry *ldap.Entry) (*ipaToken, error) {
+	token := &ipaToken{
+		DN:       entry.DN,
+		Key:      entry.GetRawAttributeValue("ipatokenOTPkey"),
+		Digits:   6,
+		TimeStep: 30,
+	}
+
+	for _, class := range entry.GetAttributeValues("objectClass") {
+		if strings.EqualFold(class, "ipatokenHOTP") {
+			token.HOTP = true
+		}
+	}
+
+	switch strings.ToLower(entry.GetAttributeValue("ipatokenOTPalgorithm")) {
+	case "", "sha1":
+		token.NewHash = sha1.New
+	case "sha256":
+		token.NewHash = sha256.New
+	case "sha384":
+		token.NewHash = sha512.New384
+	case "sha512":
+		token.NewHash = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", entry.GetAttributeValue("ipatokenOTPalgorithm"))
+	}
+
+	var err error
+	if value := entry.GetAttributeValue("ipatokenOTPdigits"); value != "" {
+		if token.Digits, err = strconv.Atoi(value); err != nil || token.Digits < 6 || token.Digits > 10 {
+			return nil, fmt.Errorf("invalid ipatokenOTPdigits %q", value)
+		}
+	}
+	if value := entry.GetAttributeValue("ipatokenHOTPcounter"); value != "" && token.HOTP {
+		if token.Counter, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid ipatokenHOTPcounter %q", value)
+		}
+		token.State = value
+	}
+	if value := entry.GetAttributeValue("ipatokenTOTPwatermark"); value != "" && !token.HOTP {
+		if token.Watermark, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid ipatokenTOTPwatermark %q", value)
+		}
+		token.State = value
+	}
+	if value := entry.GetAttributeValue("ipatokenTOTPtimeStep"); value != "" {
+		if token.TimeStep, err = strconv.ParseInt(value, 10, 64); err != nil || token.TimeStep <= 0 {
+			return nil, fmt.Errorf("invalid ipatokenTOTPtimeStep %q", value)
+		}
+	}
+	if value := entry.GetAttributeValue("ipatokenTOTPclockOffset"); value != "" {
+		if token.Offset, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid ipatokenTOTPclockOffset %q", value)
+		}
+	}
+
+	return token, nil
+}
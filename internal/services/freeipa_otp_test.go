@@ -0,0 +1,138 @@
+package services
+
+import (
+	"crypto/sha1"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestIPATokenMatchTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	now := time.Unix(1_700_000_000, 0)
+	current := now.Unix() / 30
+	code := func(step int64) string { return otpCode(sha1.New, key, step, 6) }
+
+	tests := []struct {
+		name      string
+		code      string
+		offset    int64
+		watermark int64
+		skew      int
+		wantStep  int64
+		wantOK    bool
+	}{
+		{name: "current step", code: code(current), wantStep: current, wantOK: true},
+		{name: "previous step without skew", code: code(current - 1)},
+		{name: "previous step within skew", code: code(current - 1), skew: 1, wantStep: current - 1, wantOK: true},
+		{name: "next step within skew", code: code(current + 1), skew: 1, wantStep: current + 1, wantOK: true},
+		{name: "beyond skew", code: code(current - 2), skew: 1},
+		{name: "clock offset", code: code(current + 2), offset: 60, wantStep: current + 2, wantOK: true},
+		{name: "step already used", code: code(current), watermark: current + 1},
+		{name: "earlier step already used", code: code(current - 1), skew: 1, watermark: current},
+		{name: "later step still usable", code: code(current + 1), skew: 1, watermark: current + 1, wantStep: current + 1, wantOK: true},
+		{name: "wrong code", code: "000000", skew: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := &ipaToken{Key: key, NewHash: sha1.New, Digits: 6, TimeStep: 30, Offset: tt.offset, Watermark: tt.watermark}
+			step, ok := token.matchTOTP(tt.code, now, tt.skew)
+			if ok != tt.wantOK || ok && step != tt.wantStep {
+				t.Fatalf("matchTOTP = %d, %v; want %d, %v", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestIPATokenMatchHOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	token := &ipaToken{HOTP: true, Key: key, NewHash: sha1.New, Digits: 6, Counter: 5}
+	code := func(counter int64) string { return otpCode(sha1.New, key, counter, 6) }
+
+	tests := []struct {
+		name        string
+		code        string
+		window      int
+		wantCounter int64
+		wantOK      bool
+	}{
+		{name: "next counter", code: code(5), wantCounter: 5, wantOK: true},
+		{name: "within window", code: code(8), window: 3, wantCounter: 8, wantOK: true},
+		{name: "beyond window", code: code(9), window: 3},
+		{name: "already used", code: code(4), window: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter, ok := token.matchHOTP(tt.code, tt.window)
+			if ok != tt.wantOK || ok && counter != tt.wantCounter {
+				t.Fatalf("matchHOTP = %d, %v; want %d, %v", counter, ok, tt.wantCounter, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseIPATokenState(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string][]string
+		wantState  string
+		wantHOTP   bool
+	}{
+		{
+			name:       "TOTP with watermark",
+			attributes: map[string][]string{"objectClass": {"ipatoken", "ipatokenTOTP"}, "ipatokenTOTPwatermark": {"56666667"}},
+			wantState:  "56666667",
+		},
+		{
+			name:       "TOTP never used",
+			attributes: map[string][]string{"objectClass": {"ipatoken", "ipatokenTOTP"}},
+		},
+		{
+			name:       "HOTP with counter",
+			attributes: map[string][]string{"objectClass": {"ipatoken", "ipatokenHOTP"}, "ipatokenHOTPcounter": {"12"}},
+			wantState:  "12",
+			wantHOTP:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := parseIPAToken(ldap.NewEntry("ipatokenUniqueID=t,cn=otp,dc=example,dc=com", tt.attributes))
+			if err != nil {
+				t.Fatalf("parseIPAToken: %v", err)
+			}
+			if token.State != tt.wantState || token.HOTP != tt.wantHOTP {
+				t.Fatalf("parseIPAToken = state %q, HOTP %v; want %q, %v", token.State, token.HOTP, tt.wantState, tt.wantHOTP)
+			}
+		})
+	}
+}
+
+func TestOTPOnly(t *testing.T) {
+	tests := []struct {
+		name      string
+		authTypes []string
+		want      bool
+	}{
+		{name: "default", want: false},
+		{name: "otp", authTypes: []string{"otp"}, want: true},
+		{name: "otp and password", authTypes: []string{"otp", "password"}, want: false},
+		{name: "otp and radius", authTypes: []string{"radius", "OTP"}, want: true},
+		{name: "password", authTypes: []string{"password"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var authTypes [][]byte
+			for _, authType := range tt.authTypes {
+				authTypes = append(authTypes, []byte(authType))
+			}
+			if got := otpOnly(authTypes); got != tt.want {
+				t.Fatalf("otpOnly(%v) = %v, want %v", tt.authTypes, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters follow the OWASP minimum recommendation.
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// hashSecret returns a salted Argon2id hash of secret in PHC string format.
+func hashSecret(secret string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(secret), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// verifySecret reports whether secret matches a hash produced by hashSecret.
+func verifySecret(encoded, secret string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	key := argon2.IDKey([]byte(secret), salt, time, memory, threads, uint32(len(expected)))
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+var ldapPasswordSchemes = map[string]struct {
+	newHash func() hash.Hash
+	salted  bool
+}{
+	"SHA":     {sha1.New, false},
+	"SSHA":    {sha1.New, true},
+	"SHA256":  {sha256.New, false},
+	"SSHA256": {sha256.New, true},
+	"SHA384":  {sha512.New384, false},
+	"SSHA384": {sha512.New384, true},
+	"SHA512":  {sha512.New, false},
+	"SSHA512": {sha512.New, true},
+	"MD5":     {md5.New, false},
+	"SMD5":    {md5.New, true},
+}
+
+// verifyLDAPPassword checks password against an RFC 2307 style userPassword
+// value such as "{SSHA}base64". Schemes the portal cannot evaluate (crypt,
+// PBKDF2, server-side only formats) report ok == false.
+func verifyLDAPPassword(stored, password string) (match bool, ok bool) {
+	if !strings.HasPrefix(stored, "{") {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, true
+	}
+
+	end := strings.Index(stored, "}")
+	if end < 0 {
+		return false, false
+	}
+	scheme := strings.ToUpper(stored[1:end])
+	value := stored[end+1:]
+
+	format, known := ldapPasswordSchemes[scheme]
+	if !known {
+		return false, false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return false, false
+	}
+
+	h := format.newHash()
+	size := h.Size()
+	if len(decoded) < size || (!format.salted && len(decoded) != size) {
+		return false, false
+	}
+
+	h.Write([]byte(password))
+	h.Write(decoded[size:])
+	return subtle.ConstantTimeCompare(h.Sum(nil), decoded[:size]) == 1, true
+}
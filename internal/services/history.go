@@ -0,0 +1,146 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RuleNoReuse = "no_reuse"
+
+// PasswordHistoryStore keeps salted hashes of previously set passwords,
+// keyed by user DN, for directories that do not expose pwdHistory.
+type PasswordHistoryStore interface {
+	// Hashes returns the stored hashes for userDN, most recent first.
+	Hashes(userDN string) ([]string, error)
+	// Add records hash as the most recent password for userDN and trims the
+	// history to keep entries.
+	Add(userDN, hash string, keep int) error
+}
+
+// fileHistoryStore is a PasswordHistoryStore persisted as a JSON document.
+// With an empty path it only keeps history in memory.
+type fileHistoryStore struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string][]string
+}
+
+func NewPasswordHistoryStore(path string) (PasswordHistoryStore, error) {
+	store := &fileHistoryStore{
+		path:    path,
+		entries: make(map[string][]string),
+	}
+
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &store.entries); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+func (s *fileHistoryStore) Hashes(userDN string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]string(nil), s.entries[normalizeDN(userDN)]...), nil
+}
+
+func (s *fileHistoryStore) Add(userDN, hash string, keep int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := normalizeDN(userDN)
+	hashes := append([]string{hash}, s.entries[key]...)
+	if keep > 0 && len(hashes) > keep {
+		hashes = hashes[:keep]
+	}
+	s.entries[key] = hashes
+
+	return s.save()
+}
+
+func (s *fileHistoryStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces path with data through a temporary file so that
+// readers never observe a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func normalizeDN(dn string) string {
+	return strings.ToLower(strings.TrimSpace(dn))
+}
+
+// directoryHistoryEntry is one decoded pwdHistory value. OpenLDAP ppolicy
+// stores them as "time#syntaxOID#length#userPassword".
+type directoryHistoryEntry struct {
+	changed  time.Time
+	password string
+}
+
+func parsePwdHistory(values []string) []directoryHistoryEntry {
+	var entries []directoryHistoryEntry
+	for _, value := range values {
+		parts := strings.SplitN(value, "#", 4)
+		if len(parts) != 4 {
+			continue
+		}
+		changed, _ := time.Parse("20060102150405Z", parts[0])
+		entries = append(entries, directoryHistoryEntry{changed: changed, password: parts[3]})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].changed.After(entries[j].changed)
+	})
+
+	return entries
+}
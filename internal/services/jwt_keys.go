@@ -0,0 +1,168 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"ldap-self-service/internal/config"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minRSAKeyBits is the smallest RSA key accepted for signing tokens.
+const minRSAKeyBits = 2048
+
+// signingKey is a key from jwt.keys. Private is nil for a key kept only to
+// verify tokens signed before a rotation.
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.PrivateKey
+	Public  crypto.PublicKey
+}
+
+// JWK is a public key in JSON Web Key form (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// loadSigningKey reads a PEM private or public key. The algorithm follows
+// from the key type: RS256 for RSA, ES256 for P-256 and EdDSA for Ed25519.
+// Without an id the key's RFC 7638 thumbprint is used.
+func loadSigningKey(cfg config.JWTKeyConfig) (*signingKey, error) {
+	data, err := os.ReadFile(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+
+	private, public, err := parsePEMKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.File, err)
+	}
+
+	key := &signingKey{ID: cfg.ID, Private: private, Public: public}
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("%s: RSA keys must be at least %d bits", cfg.File, minRSAKeyBits)
+		}
+		key.Method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s: only P-256 ECDSA keys are supported", cfg.File)
+		}
+		key.Method = jwt.SigningMethodES256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", cfg.File, public)
+	}
+
+	if key.ID == "" {
+		key.ID = key.thumbprint()
+	}
+	return key, nil
+}
+
+// parsePEMKey returns the private key in data, if any, and its public key.
+func parsePEMKey(data []byte) (crypto.PrivateKey, crypto.PublicKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, nil, errors.New("no key found in PEM data")
+		}
+
+		switch block.Type {
+		case "PRIVATE KEY":
+			private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			signer, ok := private.(crypto.Signer)
+			if !ok {
+				return nil, nil, fmt.Errorf("unsupported private key type %T", private)
+			}
+			return private, signer.Public(), nil
+		case "RSA PRIVATE KEY":
+			private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			return private, &private.PublicKey, nil
+		case "EC PRIVATE KEY":
+			private, err := x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			return private, &private.PublicKey, nil
+		case "PUBLIC KEY":
+			public, err := x509.ParsePKIXPublicKey(block.Bytes)
+			return nil, public, err
+		}
+		// Skip anything else, such as EC PARAMETERS.
+	}
+}
+
+// JWK returns the public half of the key.
+func (k *signingKey) JWK() JWK {
+	jwk := JWK{ID: k.ID, Use: "sig", Algorithm: k.Method.Alg()}
+	switch public := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.KeyType = "EC"
+		jwk.Curve = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, 32)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return jwk
+}
+
+// thumbprint is the RFC 7638 SHA-256 thumbprint of the public key: the
+// required members in lexicographic order, without whitespace.
+func (k *signingKey) thumbprint() string {
+	jwk := k.JWK()
+
+	var members string
+	switch jwk.KeyType {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk.Curve, jwk.X, jwk.Y)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, jwk.Curve, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -3,11 +3,12 @@ package services
 import (
 	"crypto/md5"
 	"crypto/sha256"
-	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"ldap-self-service/internal/config"
 	"ldap-self-service/internal/models"
+	"log"
 	"time"
 
 	"github.com/go-ldap/ldap/v3"
@@ -15,56 +16,105 @@ import (
 )
 
 type LDAPService struct {
-	config *config.Config
+	config  *config.Config
+	policy  *PasswordPolicy
+	pwned   *PwnedPasswordChecker
+	history PasswordHistoryStore
+	servers *serverSet
 }
 
-func NewLDAPService(cfg *config.Config) *LDAPService {
-	return &LDAPService{config: cfg}
-}
+func NewLDAPService(cfg *config.Config) (*LDAPService, error) {
+	pwned, err := NewPwnedPasswordChecker(cfg.PasswordPolicy)
+	if err != nil {
+		return nil, err
+	}
 
-func (s *LDAPService) Connect() (*ldap.Conn, error) {
-	addr := fmt.Sprintf("%s:%d", s.config.LDAP.Host, s.config.LDAP.Port)
-	
-	var conn *ldap.Conn
-	var err error
-	
-	// Configure TLS settings
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: s.config.LDAP.InsecureSkipVerify,
-		ServerName:         s.config.LDAP.Host,
-	}
-	
-	if s.config.LDAP.UseTLS {
-		if s.config.LDAP.Port == 636 {
-			// Direct TLS connection (LDAPS)
-			conn, err = ldap.DialTLS("tcp", addr, tlsConfig)
-		} else {
-			// StartTLS on standard port (usually 389)
-			conn, err = ldap.Dial("tcp", addr)
-			if err == nil {
-				err = conn.StartTLS(tlsConfig)
-			}
+	var history PasswordHistoryStore
+	if cfg.PasswordPolicy.NoReuse {
+		history, err = NewPasswordHistoryStore(cfg.PasswordPolicy.HistoryFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load password history: %w", err)
 		}
-	} else {
-		conn, err = ldap.Dial("tcp", addr)
 	}
-	
+
+	servers, err := newServerSet(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to LDAP: %w", err)
+		return nil, err
 	}
 
-	if err := conn.Bind(s.config.LDAP.BindDN, s.config.LDAP.BindPassword); err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to bind to LDAP: %w", err)
+	return &LDAPService{
+		config:  cfg,
+		policy:  NewPasswordPolicy(cfg.PasswordPolicy),
+		pwned:   pwned,
+		history: history,
+		servers: servers,
+	}, nil
+}
+
+// Connect borrows a service-bound connection to a server that can serve
+// reads. Callers must Close it to hand it back to the pool.
+func (s *LDAPService) Connect() (*PooledConn, error) {
+	conn, err := s.servers.read()
+	if err != nil {
+		return nil, translateLDAPError(err, nil)
 	}
+	return conn, nil
+}
 
+// connectWrite borrows a connection to the writable master for password
+// and attribute modifications.
+func (s *LDAPService) connectWrite() (*PooledConn, error) {
+	conn, err := s.servers.write()
+	if err != nil {
+		return nil, translateLDAPError(err, nil)
+	}
 	return conn, nil
 }
 
-func (s *LDAPService) Authenticate(username, password string) (*models.User, error) {
+// translateError classifies a directory error using the rules for the
+// configured directory type.
+func (s *LDAPService) translateError(err error, controls []ldap.Control) error {
+	if s.isActiveDirectory() {
+		return translateADError(err)
+	}
+	return translateLDAPError(err, controls)
+}
+
+// bindUser binds as an end user, requesting the password policy response
+// control so that lockout and expiry are reported precisely. The response
+// controls are returned for callers interested in expiry warnings.
+func (s *LDAPService) bindUser(conn *PooledConn, userDN, password string) ([]ldap.Control, error) {
+	bindRequest := ldap.NewSimpleBindRequest(userDN, password, []ldap.Control{ldap.NewControlBeheraPasswordPolicy()})
+	result, err := conn.SimpleBind(bindRequest)
+
+	var controls []ldap.Control
+	if result != nil {
+		controls = result.Controls
+	}
+	if err != nil {
+		return controls, s.translateError(err, controls)
+	}
+	return controls, nil
+}
+
+// ServerStatus reports the health and pool metrics of every LDAP server.
+func (s *LDAPService) ServerStatus() []ServerStatus {
+	return s.servers.status()
+}
+
+// Available reports whether reads and writes can currently be served.
+func (s *LDAPService) Available() (read, write bool) {
+	return available(s.servers.readers), available(s.servers.writers)
+}
+
+// Authenticate verifies the user's password and reports the state of its
+// expiry. A user whose password has expired but was otherwise accepted is
+// returned without error and with Expired or MustChange set, so the caller
+// can restrict the session to a password change.
+func (s *LDAPService) Authenticate(username, password string) (*models.User, *models.PasswordExpiry, error) {
 	conn, err := s.Connect()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer conn.Close()
 
@@ -76,31 +126,42 @@ func (s *LDAPService) Authenticate(username, password string) (*models.User, err
 		0,
 		false,
 		fmt.Sprintf(s.config.LDAP.UserFilter, ldap.EscapeFilter(username)),
-		[]string{"dn", "uid", s.config.LDAP.EmailAttr, s.config.LDAP.PhoneAttr, "givenName", "sn", s.config.LDAP.SSHKeyAttr},
+		append([]string{"dn", s.config.LDAP.UsernameAttr, s.config.LDAP.EmailAttr, s.config.LDAP.PhoneAttr, "givenName", "sn", s.config.LDAP.SSHKeyAttr}, expiryAttributes...),
 		nil,
 	)
 
 	sr, err := conn.Search(searchRequest)
 	if err != nil {
-		return nil, fmt.Errorf("search failed: %w", err)
+		return nil, nil, fmt.Errorf("search failed: %w", s.translateError(err, nil))
 	}
 
 	if len(sr.Entries) == 0 {
-		return nil, fmt.Errorf("user not found")
+		return nil, nil, ErrUserNotFound
 	}
 
 	entry := sr.Entries[0]
 	userDN := entry.DN
 
-	if err := conn.Bind(userDN, password); err != nil {
-		return nil, fmt.Errorf("authentication failed: %w", err)
+	controls, err := s.bindUser(conn, userDN, password)
+	if err != nil && !credentialsVerifiedButExpired(err) {
+		return nil, nil, fmt.Errorf("authentication failed: %w", err)
+	}
+
+	expiry := s.buildPasswordExpiry(entry, controls, time.Now())
+	if errors.Is(err, ErrPasswordExpired) {
+		expiry.Expired = true
+	}
+	if errors.Is(err, ErrPasswordMustChange) {
+		expiry.MustChange = true
 	}
 
 	user := &models.User{
 		DN:        userDN,
-		Username:  entry.GetAttributeValue("uid"),
+		Username:  entry.GetAttributeValue(s.config.LDAP.UsernameAttr),
 		Email:     entry.GetAttributeValue(s.config.LDAP.EmailAttr),
+		Emails:    entry.GetAttributeValues(s.config.LDAP.EmailAttr),
 		Phone:     entry.GetAttributeValue(s.config.LDAP.PhoneAttr),
+		Phones:    entry.GetAttributeValues(s.config.LDAP.PhoneAttr),
 		FirstName: entry.GetAttributeValue("givenName"),
 		LastName:  entry.GetAttributeValue("sn"),
 	}
@@ -117,12 +178,14 @@ func (s *LDAPService) Authenticate(username, password string) (*models.User, err
 		})
 	}
 
-	return user, nil
+	return user, expiry, nil
 }
 
-func (s *LDAPService) UpdatePassword(userDN, oldPassword, newPassword string) error {
-	if err := s.validatePassword(newPassword); err != nil {
-		return err
+// VerifyPassword checks password against the user at userDN, accepting an
+// expired password that is otherwise correct.
+func (s *LDAPService) VerifyPassword(userDN, password string) error {
+	if password == "" {
+		return ErrInvalidCredentials
 	}
 
 	conn, err := s.Connect()
@@ -131,87 +194,235 @@ func (s *LDAPService) UpdatePassword(userDN, oldPassword, newPassword string) er
 	}
 	defer conn.Close()
 
-	if err := conn.Bind(userDN, oldPassword); err != nil {
+	if _, err := s.bindUser(conn, userDN, password); err != nil && !credentialsVerifiedButExpired(err) {
+		return err
+	}
+	return nil
+}
+
+// UpdatePassword changes the password of the user at userDN, whose login
+// (the ldap.username_attr value) is username.
+func (s *LDAPService) UpdatePassword(userDN, username, oldPassword, newPassword string) error {
+	if err := s.CheckPassword(username, newPassword); err != nil {
+		return err
+	}
+
+	conn, err := s.connectWrite()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := s.bindUser(conn, userDN, oldPassword); err != nil && !credentialsVerifiedButExpired(err) {
 		return fmt.Errorf("current password verification failed: %w", err)
 	}
 
 	if err := conn.Bind(s.config.LDAP.BindDN, s.config.LDAP.BindPassword); err != nil {
-		return fmt.Errorf("admin bind failed: %w", err)
+		return fmt.Errorf("admin bind failed: %w", s.translateError(err, nil))
+	}
+
+	if s.config.PasswordPolicy.NoReuse && newPassword == oldPassword {
+		return s.reuseViolation()
+	}
+
+	if err := s.checkPasswordHistory(conn, userDN, newPassword); err != nil {
+		return err
+	}
+
+	if s.isActiveDirectory() {
+		if err := s.changeADPassword(conn, userDN, oldPassword, newPassword); err != nil {
+			return err
+		}
+		s.recordPasswordHistory(userDN, newPassword)
+		return nil
 	}
 
 	passwordModify := ldap.NewPasswordModifyRequest(userDN, oldPassword, newPassword)
 	_, err = conn.PasswordModify(passwordModify)
 	if err != nil {
-		return fmt.Errorf("password change failed: %w", err)
+		return fmt.Errorf("password change failed: %w", s.translateError(err, nil))
 	}
 
+	s.recordPasswordHistory(userDN, newPassword)
 	return nil
 }
 
-func (s *LDAPService) ResetPassword(userDN, newPassword string) error {
-	if err := s.validatePassword(newPassword); err != nil {
+// ResetPassword sets a new password for the user at userDN, whose login is
+// username, with the service account's privileges.
+func (s *LDAPService) ResetPassword(userDN, username, newPassword string) error {
+	if err := s.CheckPassword(username, newPassword); err != nil {
 		return err
 	}
 
-	conn, err := s.Connect()
+	conn, err := s.connectWrite()
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
+	if err := s.checkPasswordHistory(conn, userDN, newPassword); err != nil {
+		return err
+	}
+
+	if s.isActiveDirectory() {
+		if err := s.resetADPassword(conn, userDN, newPassword); err != nil {
+			return err
+		}
+		s.recordPasswordHistory(userDN, newPassword)
+		return nil
+	}
+
 	// Use admin privileges to reset password
 	passwordModify := ldap.NewPasswordModifyRequest(userDN, "", newPassword)
 	_, err = conn.PasswordModify(passwordModify)
 	if err != nil {
-		return fmt.Errorf("password reset failed: %w", err)
+		return fmt.Errorf("password reset failed: %w", s.translateError(err, nil))
 	}
 
+	s.recordPasswordHistory(userDN, newPassword)
 	return nil
 }
 
-func (s *LDAPService) validatePassword(password string) error {
-	policy := s.config.PasswordPolicy
-	
-	if len(password) < policy.MinLength {
-		return fmt.Errorf("password must be at least %d characters long", policy.MinLength)
-	}
-	
-	if policy.MaxLength > 0 && len(password) > policy.MaxLength {
-		return fmt.Errorf("password must be no more than %d characters long", policy.MaxLength)
-	}
-	
-	var lowerCount, upperCount, digitCount, specialCount int
-	
-	for _, char := range password {
-		switch {
-		case char >= 'a' && char <= 'z':
-			lowerCount++
-		case char >= 'A' && char <= 'Z':
-			upperCount++
-		case char >= '0' && char <= '9':
-			digitCount++
-		default:
-			specialCount++
+// checkPasswordHistory enforces no_reuse against the last history_count
+// passwords. The directory's pwdHistory is preferred when the service
+// account can read it; otherwise the portal's own history store is used.
+func (s *LDAPService) checkPasswordHistory(conn *PooledConn, userDN, newPassword string) error {
+	if !s.config.PasswordPolicy.NoReuse {
+		return nil
+	}
+	keep := s.config.PasswordPolicy.HistoryCount
+
+	reused, checked, err := s.matchDirectoryHistory(conn, userDN, newPassword, keep)
+	if err != nil {
+		return err
+	}
+
+	if !checked {
+		hashes, err := s.history.Hashes(userDN)
+		if err != nil {
+			return fmt.Errorf("failed to read password history: %w", err)
+		}
+		for i, hash := range hashes {
+			if keep > 0 && i >= keep {
+				break
+			}
+			if verifySecret(hash, newPassword) {
+				reused = true
+				break
+			}
 		}
 	}
-	
-	if lowerCount < policy.MinLower {
-		return fmt.Errorf("password must contain at least %d lowercase letter(s)", policy.MinLower)
+
+	if reused {
+		return s.reuseViolation()
 	}
-	
-	if upperCount < policy.MinUpper {
-		return fmt.Errorf("password must contain at least %d uppercase letter(s)", policy.MinUpper)
+	return nil
+}
+
+// matchDirectoryHistory compares newPassword against pwdHistory. checked is
+// false when the attribute is absent or holds no hashes the portal can verify.
+func (s *LDAPService) matchDirectoryHistory(conn *PooledConn, userDN, newPassword string, keep int) (reused, checked bool, err error) {
+	searchRequest := ldap.NewSearchRequest(
+		userDN,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		1,
+		0,
+		false,
+		"(objectClass=*)",
+		[]string{"pwdHistory"},
+		nil,
+	)
+
+	sr, err := conn.Search(searchRequest)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to read password history: %w", s.translateError(err, nil))
 	}
-	
-	if digitCount < policy.MinDigit {
-		return fmt.Errorf("password must contain at least %d digit(s)", policy.MinDigit)
+	if len(sr.Entries) == 0 {
+		return false, false, nil
 	}
-	
-	if specialCount < policy.MinSpecial {
-		return fmt.Errorf("password must contain at least %d special character(s)", policy.MinSpecial)
+
+	entries := parsePwdHistory(sr.Entries[0].GetAttributeValues("pwdHistory"))
+	for i, entry := range entries {
+		if keep > 0 && i >= keep {
+			break
+		}
+		match, ok := verifyLDAPPassword(entry.password, newPassword)
+		if !ok {
+			continue
+		}
+		checked = true
+		if match {
+			return true, true, nil
+		}
+	}
+
+	return false, checked, nil
+}
+
+func (s *LDAPService) recordPasswordHistory(userDN, password string) {
+	if s.history == nil {
+		return
+	}
+
+	hash, err := hashSecret(password)
+	if err == nil {
+		err = s.history.Add(userDN, hash, s.config.PasswordPolicy.HistoryCount)
+	}
+	if err != nil {
+		log.Printf("Failed to record password history for %s: %v", userDN, err)
 	}
-	
-	return nil
+}
+
+func (s *LDAPService) reuseViolation() error {
+	return &PolicyError{Violations: []PolicyViolation{{
+		Rule:    RuleNoReuse,
+		Message: fmt.Sprintf("password must not match any of your last %d passwords", s.config.PasswordPolicy.HistoryCount),
+	}}}
+}
+
+// CheckPassword runs the policy and breached-password checks for password
+// without touching the directory. login may be empty. When the breached
+// password lookup fails, the policy violations already found are still
+// returned, with the lookup error in PolicyError.Err.
+func (s *LDAPService) CheckPassword(login, password string) error {
+	err := s.policy.Validate(login, password)
+	if s.pwned == nil {
+		return err
+	}
+
+	violation, lookupErr := s.pwned.Check(password)
+	if violation == nil && lookupErr == nil {
+		return err
+	}
+
+	policyErr, ok := err.(*PolicyError)
+	if !ok {
+		if violation == nil {
+			return lookupErr
+		}
+		policyErr = &PolicyError{}
+	}
+	if violation != nil {
+		policyErr.Violations = append(policyErr.Violations, *violation)
+	}
+	policyErr.Err = lookupErr
+	return policyErr
+}
+
+// Close closes the connection pools and releases the breached password
+// corpus. Call it once the server has stopped serving requests.
+func (s *LDAPService) Close() error {
+	s.servers.close()
+	if s.pwned == nil {
+		return nil
+	}
+	return s.pwned.Close()
+}
+
+// PasswordPolicy returns the policy applied to new passwords.
+func (s *LDAPService) PasswordPolicy() *PasswordPolicy {
+	return s.policy
 }
 
 func (s *LDAPService) GetUser(username string) (*models.User, error) {
@@ -229,25 +440,27 @@ func (s *LDAPService) GetUser(username string) (*models.User, error) {
 		0,
 		false,
 		fmt.Sprintf(s.config.LDAP.UserFilter, ldap.EscapeFilter(username)),
-		[]string{"dn", "uid", s.config.LDAP.EmailAttr, s.config.LDAP.PhoneAttr, "givenName", "sn", s.config.LDAP.SSHKeyAttr},
+		[]string{"dn", s.config.LDAP.UsernameAttr, s.config.LDAP.EmailAttr, s.config.LDAP.PhoneAttr, "givenName", "sn", s.config.LDAP.SSHKeyAttr},
 		nil,
 	)
 
 	sr, err := conn.Search(searchRequest)
 	if err != nil {
-		return nil, fmt.Errorf("search failed: %w", err)
+		return nil, fmt.Errorf("search failed: %w", s.translateError(err, nil))
 	}
 
 	if len(sr.Entries) == 0 {
-		return nil, fmt.Errorf("user not found")
+		return nil, ErrUserNotFound
 	}
 
 	entry := sr.Entries[0]
 	user := &models.User{
 		DN:        entry.DN,
-		Username:  entry.GetAttributeValue("uid"),
+		Username:  entry.GetAttributeValue(s.config.LDAP.UsernameAttr),
 		Email:     entry.GetAttributeValue(s.config.LDAP.EmailAttr),
+		Emails:    entry.GetAttributeValues(s.config.LDAP.EmailAttr),
 		Phone:     entry.GetAttributeValue(s.config.LDAP.PhoneAttr),
+		Phones:    entry.GetAttributeValues(s.config.LDAP.PhoneAttr),
 		FirstName: entry.GetAttributeValue("givenName"),
 		LastName:  entry.GetAttributeValue("sn"),
 	}
@@ -271,7 +484,7 @@ func (s *LDAPService) AddSSHKey(userDN, sshKey string) error {
 		return err
 	}
 
-	conn, err := s.Connect()
+	conn, err := s.connectWrite()
 	if err != nil {
 		return err
 	}
@@ -281,14 +494,17 @@ func (s *LDAPService) AddSSHKey(userDN, sshKey string) error {
 	modifyRequest.Add(s.config.LDAP.SSHKeyAttr, []string{sshKey})
 
 	if err := conn.Modify(modifyRequest); err != nil {
-		return fmt.Errorf("failed to add SSH key: %w", err)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultAttributeOrValueExists) {
+			return invalidRequest("this SSH key is already registered", err)
+		}
+		return fmt.Errorf("failed to add SSH key: %w", s.translateError(err, nil))
 	}
 
 	return nil
 }
 
 func (s *LDAPService) RemoveSSHKey(userDN, sshKey string) error {
-	conn, err := s.Connect()
+	conn, err := s.connectWrite()
 	if err != nil {
 		return err
 	}
@@ -298,7 +514,7 @@ func (s *LDAPService) RemoveSSHKey(userDN, sshKey string) error {
 	modifyRequest.Delete(s.config.LDAP.SSHKeyAttr, []string{sshKey})
 
 	if err := conn.Modify(modifyRequest); err != nil {
-		return fmt.Errorf("failed to remove SSH key: %w", err)
+		return fmt.Errorf("failed to remove SSH key: %w", s.translateError(err, nil))
 	}
 
 	return nil
@@ -307,7 +523,7 @@ func (s *LDAPService) RemoveSSHKey(userDN, sshKey string) error {
 func (s *LDAPService) validateSSHKey(key string) error {
 	_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
 	if err != nil {
-		return fmt.Errorf("invalid SSH key format: %w", err)
+		return invalidRequest("invalid SSH key format", err)
 	}
 	return nil
 }
@@ -0,0 +1,341 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var ErrPoolExhausted = errors.New("timed out waiting for a free LDAP connection")
+
+var ErrPoolClosed = errors.New("LDAP connection pool is closed")
+
+// PoolStats is a snapshot of connection pool activity.
+type PoolStats struct {
+	MaxOpen       int    `json:"maxOpen"`
+	Open          int    `json:"open"`
+	Idle          int    `json:"idle"`
+	InUse         int    `json:"inUse"`
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Dials         uint64 `json:"dials"`
+	DialFailures  uint64 `json:"dialFailures"`
+	Rebinds       uint64 `json:"rebinds"`
+	ProbeFailures uint64 `json:"probeFailures"`
+	Discarded     uint64 `json:"discarded"`
+	WaitTimeouts  uint64 `json:"waitTimeouts"`
+}
+
+type poolOptions struct {
+	maxOpen       int
+	maxIdle       int
+	idleTimeout   time.Duration
+	probeInterval time.Duration
+	waitTimeout   time.Duration
+}
+
+// ldapPool hands out connections that are already bound as the service
+// account. Connections that were re-bound as an end user are bound back to
+// the service account before they are reused, and idle connections are
+// probed before being handed out again.
+type ldapPool struct {
+	dial      func() (*ldap.Conn, error)
+	bindDN    string
+	bindPass  string
+	options   poolOptions
+	semaphore chan struct{}
+	// done stops the idle reaper when the pool is closed.
+	done chan struct{}
+
+	mutex  sync.Mutex
+	idle   []*PooledConn
+	open   int
+	closed bool
+
+	hits, misses, dials, dialFailures atomic.Uint64
+	rebinds, probeFailures, discarded atomic.Uint64
+	waitTimeouts                      atomic.Uint64
+}
+
+// PooledConn is a service-bound connection borrowed from the pool. Close
+// returns it to the pool instead of closing the socket.
+type PooledConn struct {
+	*ldap.Conn
+	pool      *ldapPool
+	userBound bool
+	lastUsed  time.Time
+	released  bool
+}
+
+func newLDAPPool(dial func() (*ldap.Conn, error), bindDN, bindPass string, options poolOptions) *ldapPool {
+	if options.maxOpen < 1 {
+		options.maxOpen = 1
+	}
+	if options.maxIdle > options.maxOpen {
+		options.maxIdle = options.maxOpen
+	}
+	if options.waitTimeout <= 0 {
+		options.waitTimeout = 10 * time.Second
+	}
+
+	pool := &ldapPool{
+		dial:      dial,
+		bindDN:    bindDN,
+		bindPass:  bindPass,
+		options:   options,
+		semaphore: make(chan struct{}, options.maxOpen),
+		done:      make(chan struct{}),
+	}
+
+	if options.idleTimeout > 0 {
+		go pool.reapIdle()
+	}
+	return pool
+}
+
+// Get borrows a connection, waiting up to the configured wait timeout when
+// every connection is in use.
+func (p *ldapPool) Get() (*PooledConn, error) {
+	timer := time.NewTimer(p.options.waitTimeout)
+	defer timer.Stop()
+
+	select {
+	case p.semaphore <- struct{}{}:
+	case <-timer.C:
+		p.waitTimeouts.Add(1)
+		return nil, ErrPoolExhausted
+	case <-p.done:
+		return nil, ErrPoolClosed
+	}
+
+	p.mutex.Lock()
+	closed := p.closed
+	p.mutex.Unlock()
+	if closed {
+		<-p.semaphore
+		return nil, ErrPoolClosed
+	}
+
+	for {
+		conn := p.popIdle()
+		if conn == nil {
+			break
+		}
+		if p.healthy(conn) {
+			p.hits.Add(1)
+			conn.released = false
+			return conn, nil
+		}
+		p.discard(conn)
+	}
+
+	p.misses.Add(1)
+	raw, err := p.dial()
+	if err != nil {
+		p.dialFailures.Add(1)
+		<-p.semaphore
+		return nil, err
+	}
+	p.dials.Add(1)
+
+	p.mutex.Lock()
+	p.open++
+	p.mutex.Unlock()
+
+	return &PooledConn{Conn: raw, pool: p, lastUsed: time.Now()}, nil
+}
+
+func (p *ldapPool) popIdle() *PooledConn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n := len(p.idle)
+	if n == 0 {
+		return nil
+	}
+	conn := p.idle[n-1]
+	p.idle = p.idle[:n-1]
+	return conn
+}
+
+// healthy reports whether an idle connection can be reused, probing it if
+// it has been idle longer than the probe interval.
+func (p *ldapPool) healthy(conn *PooledConn) bool {
+	if conn.IsClosing() {
+		return false
+	}
+
+	idleFor := time.Since(conn.lastUsed)
+	if p.options.idleTimeout > 0 && idleFor > p.options.idleTimeout {
+		return false
+	}
+
+	if idleFor > p.options.probeInterval {
+		if err := probe(conn.Conn); err != nil {
+			p.probeFailures.Add(1)
+			return false
+		}
+	}
+
+	return true
+}
+
+// probe reads the root DSE, which every server answers cheaply.
+func probe(conn *ldap.Conn) error {
+	_, err := conn.Search(ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		1,
+		5,
+		false,
+		"(objectClass=*)",
+		[]string{"1.1"},
+		nil,
+	))
+	return err
+}
+
+func (p *ldapPool) put(conn *PooledConn) {
+	defer func() { <-p.semaphore }()
+
+	if conn.IsClosing() {
+		p.discard(conn)
+		return
+	}
+
+	if conn.userBound {
+		p.rebinds.Add(1)
+		if err := conn.Conn.Bind(p.bindDN, p.bindPass); err != nil {
+			p.discard(conn)
+			return
+		}
+		conn.userBound = false
+	}
+
+	conn.lastUsed = time.Now()
+
+	p.mutex.Lock()
+	if !p.closed && len(p.idle) < p.options.maxIdle {
+		p.idle = append(p.idle, conn)
+		p.mutex.Unlock()
+		return
+	}
+	p.mutex.Unlock()
+
+	p.discard(conn)
+}
+
+func (p *ldapPool) discard(conn *PooledConn) {
+	p.discarded.Add(1)
+	conn.Conn.Close()
+
+	p.mutex.Lock()
+	p.open--
+	p.mutex.Unlock()
+}
+
+// Close stops the idle reaper and closes the idle connections. Borrowed
+// connections are closed when they are returned, and Get fails from now on.
+func (p *ldapPool) Close() {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mutex.Unlock()
+
+	close(p.done)
+	for _, conn := range idle {
+		p.discard(conn)
+	}
+}
+
+func (p *ldapPool) reapIdle() {
+	ticker := time.NewTicker(p.options.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		var expired []*PooledConn
+
+		p.mutex.Lock()
+		kept := p.idle[:0]
+		for _, conn := range p.idle {
+			if time.Since(conn.lastUsed) > p.options.idleTimeout || conn.IsClosing() {
+				expired = append(expired, conn)
+			} else {
+				kept = append(kept, conn)
+			}
+		}
+		p.idle = kept
+		p.mutex.Unlock()
+
+		for _, conn := range expired {
+			p.discard(conn)
+		}
+	}
+}
+
+func (p *ldapPool) Stats() PoolStats {
+	p.mutex.Lock()
+	open, idle := p.open, len(p.idle)
+	p.mutex.Unlock()
+
+	return PoolStats{
+		MaxOpen:       p.options.maxOpen,
+		Open:          open,
+		Idle:          idle,
+		InUse:         open - idle,
+		Hits:          p.hits.Load(),
+		Misses:        p.misses.Load(),
+		Dials:         p.dials.Load(),
+		DialFailures:  p.dialFailures.Load(),
+		Rebinds:       p.rebinds.Load(),
+		ProbeFailures: p.probeFailures.Load(),
+		Discarded:     p.discarded.Load(),
+		WaitTimeouts:  p.waitTimeouts.Load(),
+	}
+}
+
+// Bind binds the connection as another identity. Unless that identity is
+// the service account, the pool re-binds the connection when it is returned.
+func (c *PooledConn) Bind(username, password string) error {
+	c.userBound = username != c.pool.bindDN || password != c.pool.bindPass
+	err := c.Conn.Bind(username, password)
+	if err != nil {
+		c.userBound = true
+	}
+	return err
+}
+
+// SimpleBind is Bind with request controls.
+func (c *PooledConn) SimpleBind(req *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+	c.userBound = req.Username != c.pool.bindDN || req.Password != c.pool.bindPass
+	result, err := c.Conn.SimpleBind(req)
+	if err != nil {
+		c.userBound = true
+	}
+	return result, err
+}
+
+// Close returns the connection to the pool.
+func (c *PooledConn) Close() error {
+	if c.released {
+		return nil
+	}
+	c.released = true
+	c.pool.put(c)
+	return nil
+}
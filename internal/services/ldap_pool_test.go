@@ -0,0 +1,434 @@
+package services
+
+import (
+	"errors"
+	"ldap-self-service/internal/config"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testBindDN       = "cn=service,dc=example,dc=com"
+	testBindPassword = "service-secret"
+)
+
+// fakeLDAPServer answers simple binds and searches, which is all the pool
+// sends. Searches return no entries.
+type fakeLDAPServer struct {
+	listener net.Listener
+	// passwords maps the DNs that may bind to their password.
+	passwords map[string]string
+
+	mutex      sync.Mutex
+	conns      []net.Conn
+	accepted   int
+	binds      []string
+	failSearch bool
+}
+
+func newFakeLDAPServer(t *testing.T) *fakeLDAPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	server := &fakeLDAPServer{
+		listener: listener,
+		passwords: map[string]string{
+			testBindDN:                    testBindPassword,
+			"uid=alice,dc=example,dc=com": "alice-secret",
+		},
+	}
+	t.Cleanup(server.close)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mutex.Lock()
+			server.conns = append(server.conns, conn)
+			server.accepted++
+			server.mutex.Unlock()
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeLDAPServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *fakeLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		var response *ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+
+			s.mutex.Lock()
+			expected, ok := s.passwords[dn]
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if ok && expected == password {
+				code = ldap.LDAPResultSuccess
+				s.binds = append(s.binds, dn)
+			}
+			s.mutex.Unlock()
+			response = ldapResult(id, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			s.mutex.Lock()
+			code := int64(ldap.LDAPResultSuccess)
+			if s.failSearch {
+				code = ldap.LDAPResultUnavailable
+			}
+			s.mutex.Unlock()
+			response = ldapResult(id, ldap.ApplicationSearchResultDone, code)
+		default:
+			return
+		}
+
+		if _, err := conn.Write(response.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// dropConnections closes every connection from the server's side, as a
+// server restart or an idle timeout on a firewall would.
+func (s *fakeLDAPServer) dropConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeLDAPServer) close() {
+	s.listener.Close()
+	s.dropConnections()
+}
+
+func (s *fakeLDAPServer) setFailSearch(fail bool) {
+	s.mutex.Lock()
+	s.failSearch = fail
+	s.mutex.Unlock()
+}
+
+func (s *fakeLDAPServer) setPassword(dn, password string) {
+	s.mutex.Lock()
+	s.passwords[dn] = password
+	s.mutex.Unlock()
+}
+
+// bindLog returns how many connections were accepted and the DN of every
+// successful bind, in order.
+func (s *fakeLDAPServer) bindLog() (int, []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.accepted, append([]string(nil), s.binds...)
+}
+
+func ldapResult(id int64, tag ber.Tag, code int64) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	envelope.AppendChild(result)
+	return envelope
+}
+
+func newTestLDAPPool(t *testing.T, server *fakeLDAPServer, options poolOptions) *ldapPool {
+	t.Helper()
+
+	parsed, err := url.Parse(server.url())
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	ldapCfg := config.LDAPConfig{BindDN: testBindDN, BindPassword: testBindPassword}
+	pool := newLDAPPool(func() (*ldap.Conn, error) { return dialLDAP(ldapCfg, parsed) }, testBindDN, testBindPassword, options)
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestLDAPPoolBound(t *testing.T) {
+	server := newFakeLDAPServer(t)
+	pool := newTestLDAPPool(t, server, poolOptions{maxOpen: 2, maxIdle: 2, probeInterval: time.Minute, waitTimeout: 50 * time.Millisecond})
+
+	first, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	second, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if _, err := pool.Get(); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("Get beyond max_open = %v, want %v", err, ErrPoolExhausted)
+	}
+
+	first.Close()
+	third, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get after Close: %v", err)
+	}
+	if third != first {
+		t.Fatal("Get dialed a new connection instead of reusing the idle one")
+	}
+	third.Close()
+	second.Close()
+
+	// Many borrowers never hold more than max_open connections.
+	pool.options.waitTimeout = 5 * time.Second
+	var inUse, maxInUse atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := pool.Get()
+			if err != nil {
+				t.Errorf("Get: %v", err)
+				return
+			}
+			current := inUse.Add(1)
+			for {
+				seen := maxInUse.Load()
+				if current <= seen || maxInUse.CompareAndSwap(seen, current) {
+					break
+				}
+			}
+			time.Sleep(2 * time.Millisecond)
+			inUse.Add(-1)
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+
+	if maxInUse.Load() > 2 {
+		t.Fatalf("%d connections in use at once, want at most 2", maxInUse.Load())
+	}
+	stats := pool.Stats()
+	if stats.Open > 2 || stats.Dials != 2 || stats.WaitTimeouts != 1 {
+		t.Fatalf("Stats = %+v, want 2 dials, at most 2 open and 1 wait timeout", stats)
+	}
+	if accepted, _ := server.bindLog(); accepted != 2 {
+		t.Fatalf("the server accepted %d connections, want 2", accepted)
+	}
+}
+
+func TestLDAPPoolProbesStaleConnections(t *testing.T) {
+	tests := []struct {
+		name      string
+		breakConn func(server *fakeLDAPServer, conn *PooledConn)
+	}{
+		{
+			name: "probe fails",
+			breakConn: func(server *fakeLDAPServer, conn *PooledConn) {
+				server.setFailSearch(true)
+			},
+		},
+		{
+			name: "server closed the connection",
+			breakConn: func(server *fakeLDAPServer, conn *PooledConn) {
+				server.dropConnections()
+				deadline := time.Now().Add(time.Second)
+				for !conn.IsClosing() && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeLDAPServer(t)
+			pool := newTestLDAPPool(t, server, poolOptions{maxOpen: 1, maxIdle: 1, waitTimeout: time.Second})
+
+			stale, err := pool.Get()
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			stale.Close()
+			tt.breakConn(server, stale)
+
+			conn, err := pool.Get()
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			defer conn.Close()
+			if conn == stale {
+				t.Fatal("Get handed out the stale connection")
+			}
+			if stats := pool.Stats(); stats.Dials != 2 || stats.Discarded != 1 || stats.Open != 1 {
+				t.Fatalf("Stats = %+v, want 2 dials, 1 discarded and 1 open", stats)
+			}
+		})
+	}
+}
+
+func TestLDAPPoolProbeInterval(t *testing.T) {
+	server := newFakeLDAPServer(t)
+	pool := newTestLDAPPool(t, server, poolOptions{maxOpen: 1, maxIdle: 1, probeInterval: time.Minute, waitTimeout: time.Second})
+
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	conn.Close()
+
+	// Recently used connections are handed out without a probe.
+	server.setFailSearch(true)
+	reused, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	reused.Close()
+	if reused != conn || pool.Stats().ProbeFailures != 0 {
+		t.Fatalf("Get probed a connection idle for less than probe_interval: %+v", pool.Stats())
+	}
+}
+
+func TestLDAPPoolRebindsAfterUserBind(t *testing.T) {
+	tests := []struct {
+		name        string
+		dn          string
+		password    string
+		wantBinds   []string
+		wantRebinds uint64
+	}{
+		{
+			name:        "user bind",
+			dn:          "uid=alice,dc=example,dc=com",
+			password:    "alice-secret",
+			wantBinds:   []string{testBindDN, "uid=alice,dc=example,dc=com", testBindDN},
+			wantRebinds: 1,
+		},
+		{
+			name:        "failed user bind",
+			dn:          "uid=alice,dc=example,dc=com",
+			password:    "wrong",
+			wantBinds:   []string{testBindDN, testBindDN},
+			wantRebinds: 1,
+		},
+		{
+			name:      "service account bind",
+			dn:        testBindDN,
+			password:  testBindPassword,
+			wantBinds: []string{testBindDN, testBindDN},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeLDAPServer(t)
+			pool := newTestLDAPPool(t, server, poolOptions{maxOpen: 1, maxIdle: 1, probeInterval: time.Minute, waitTimeout: time.Second})
+
+			conn, err := pool.Get()
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			conn.Bind(tt.dn, tt.password)
+			conn.Close()
+
+			reused, err := pool.Get()
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			reused.Close()
+			if reused != conn {
+				t.Fatal("the connection was not reused")
+			}
+
+			accepted, binds := server.bindLog()
+			if accepted != 1 || !slices.Equal(binds, tt.wantBinds) {
+				t.Fatalf("server saw %d connections and binds %v, want 1 and %v", accepted, binds, tt.wantBinds)
+			}
+			if rebinds := pool.Stats().Rebinds; rebinds != tt.wantRebinds {
+				t.Fatalf("Rebinds = %d, want %d", rebinds, tt.wantRebinds)
+			}
+		})
+	}
+}
+
+func TestLDAPPoolDiscardsWhenRebindFails(t *testing.T) {
+	server := newFakeLDAPServer(t)
+	pool := newTestLDAPPool(t, server, poolOptions{maxOpen: 1, maxIdle: 1, probeInterval: time.Minute, waitTimeout: time.Second})
+
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if err := conn.Bind("uid=alice,dc=example,dc=com", "alice-secret"); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	// The service account's password changed while alice was bound.
+	server.setPassword(testBindDN, "rotated")
+	conn.Close()
+
+	if stats := pool.Stats(); stats.Idle != 0 || stats.Open != 0 || stats.Discarded != 1 {
+		t.Fatalf("Stats = %+v, want the user-bound connection discarded", stats)
+	}
+}
+
+func TestLDAPPoolClose(t *testing.T) {
+	server := newFakeLDAPServer(t)
+	pool := newTestLDAPPool(t, server, poolOptions{maxOpen: 2, maxIdle: 2, idleTimeout: time.Minute, waitTimeout: time.Second})
+
+	idle, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	borrowed, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	idle.Close()
+
+	pool.Close()
+	pool.Close()
+
+	select {
+	case <-pool.done:
+	default:
+		t.Fatal("Close did not stop the idle reaper")
+	}
+	if !idle.IsClosing() {
+		t.Fatal("Close left an idle connection open")
+	}
+	if _, err := pool.Get(); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("Get after Close = %v, want %v", err, ErrPoolClosed)
+	}
+
+	borrowed.Close()
+	if !borrowed.IsClosing() {
+		t.Fatal("a connection returned after Close was kept open")
+	}
+	if stats := pool.Stats(); stats.Open != 0 || stats.Idle != 0 {
+		t.Fatalf("Stats after Close = %+v, want nothing open", stats)
+	}
+}
@@ -0,0 +1,337 @@
+package services
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"ldap-self-service/internal/config"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var ErrNoServerAvailable = errors.New("no LDAP server available")
+
+// ServerStatus is the health of one configured LDAP server.
+type ServerStatus struct {
+	URL                 string     `json:"url"`
+	Role                string     `json:"role"`
+	Up                  bool       `json:"up"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastChecked         *time.Time `json:"lastChecked,omitempty"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Pool                PoolStats  `json:"pool"`
+}
+
+type ldapServer struct {
+	url  string
+	role string
+	pool *ldapPool
+
+	mutex       sync.RWMutex
+	up          bool
+	lastError   string
+	lastChecked time.Time
+	failures    int
+}
+
+// serverSet routes reads through an ordered list of servers and writes to
+// the designated master, failing over past servers that are marked down.
+type serverSet struct {
+	readers []*ldapServer
+	writers []*ldapServer
+	// done stops the health monitor when the set is closed.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newServerSet(cfg *config.Config) (*serverSet, error) {
+	ldapCfg := cfg.LDAP
+	poolCfg := ldapCfg.Pool
+	options := poolOptions{
+		maxOpen:       poolCfg.MaxOpen,
+		maxIdle:       poolCfg.MaxIdle,
+		idleTimeout:   time.Duration(poolCfg.IdleTimeout) * time.Second,
+		probeInterval: time.Duration(poolCfg.ProbeInterval) * time.Second,
+		waitTimeout:   time.Duration(poolCfg.WaitTimeout) * time.Second,
+	}
+
+	servers := make(map[string]*ldapServer)
+	newServer := func(rawURL, role string) (*ldapServer, error) {
+		if server, ok := servers[rawURL]; ok {
+			if server.role != role {
+				server.role = "read-write"
+			}
+			return server, nil
+		}
+
+		parsed, err := url.Parse(rawURL)
+		if err != nil || (parsed.Scheme != "ldap" && parsed.Scheme != "ldaps") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid LDAP URL %q", rawURL)
+		}
+
+		server := &ldapServer{url: rawURL, role: role, up: true}
+		dial := func() (*ldap.Conn, error) {
+			return dialLDAP(ldapCfg, parsed)
+		}
+		server.pool = newLDAPPool(dial, ldapCfg.BindDN, ldapCfg.BindPassword, options)
+		servers[rawURL] = server
+		return server, nil
+	}
+
+	urls := ldapCfg.URLs
+	if len(urls) == 0 && ldapCfg.MasterURL == "" {
+		urls = []string{legacyLDAPURL(ldapCfg)}
+	}
+
+	set := &serverSet{done: make(chan struct{})}
+	if ldapCfg.MasterURL != "" {
+		master, err := newServer(ldapCfg.MasterURL, "write")
+		if err != nil {
+			return nil, err
+		}
+		set.writers = []*ldapServer{master}
+	}
+
+	for _, rawURL := range urls {
+		server, err := newServer(rawURL, "read")
+		if err != nil {
+			return nil, err
+		}
+		set.readers = append(set.readers, server)
+	}
+
+	if len(set.readers) == 0 {
+		set.readers = set.writers
+	}
+	if len(set.writers) == 0 {
+		set.writers = set.readers
+		for _, server := range set.readers {
+			server.role = "read-write"
+		}
+	}
+
+	for _, server := range set.all() {
+		log.Printf("LDAP server %s configured (%s)", server.url, server.role)
+	}
+
+	if ldapCfg.HealthCheckInterval > 0 {
+		go set.monitor(time.Duration(ldapCfg.HealthCheckInterval) * time.Second)
+	}
+
+	return set, nil
+}
+
+// legacyLDAPURL builds a URL from the host/port/use_tls settings so that
+// single-server configurations keep working unchanged.
+func legacyLDAPURL(ldapCfg config.LDAPConfig) string {
+	scheme := "ldap"
+	if ldapCfg.UseTLS && ldapCfg.Port == 636 {
+		scheme = "ldaps"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, ldapCfg.Host, ldapCfg.Port)
+}
+
+func dialLDAP(ldapCfg config.LDAPConfig, serverURL *url.URL) (*ldap.Conn, error) {
+	// Configure TLS settings
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: ldapCfg.InsecureSkipVerify,
+		ServerName:         serverURL.Hostname(),
+	}
+
+	conn, err := ldap.DialURL(serverURL.String(), ldap.DialWithTLSConfig(tlsConfig))
+	if err == nil && serverURL.Scheme == "ldap" && ldapCfg.UseTLS {
+		// StartTLS on standard port (usually 389)
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP: %w", err)
+	}
+
+	if err := conn.Bind(ldapCfg.BindDN, ldapCfg.BindPassword); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to bind to LDAP: %w", err)
+	}
+
+	return conn, nil
+}
+
+func (s *serverSet) read() (*PooledConn, error) {
+	return s.connect(s.readers)
+}
+
+func (s *serverSet) write() (*PooledConn, error) {
+	return s.connect(s.writers)
+}
+
+// connect borrows a connection from the first healthy server in order.
+// Servers marked down are skipped, but are still tried as a last resort so
+// that a recovered server is picked up before the next health check.
+func (s *serverSet) connect(servers []*ldapServer) (*PooledConn, error) {
+	var lastErr error
+	var down []*ldapServer
+
+	for _, server := range servers {
+		if !server.isUp() {
+			down = append(down, server)
+			continue
+		}
+		conn, err := server.pool.Get()
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, ErrPoolExhausted) {
+			server.markDown(err)
+		}
+		lastErr = err
+	}
+
+	for _, server := range down {
+		conn, err := server.pool.Get()
+		if err == nil {
+			server.markUp()
+			return conn, nil
+		}
+		if !errors.Is(err, ErrPoolExhausted) {
+			server.markDown(err)
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return nil, ErrNoServerAvailable
+	}
+	return nil, fmt.Errorf("%w: %v", ErrNoServerAvailable, lastErr)
+}
+
+func (s *serverSet) all() []*ldapServer {
+	seen := make(map[*ldapServer]bool)
+	var servers []*ldapServer
+	for _, server := range append(append([]*ldapServer{}, s.writers...), s.readers...) {
+		if !seen[server] {
+			seen[server] = true
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// close stops the health monitor and closes every server's pool.
+func (s *serverSet) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		for _, server := range s.all() {
+			server.pool.Close()
+		}
+	})
+}
+
+func (s *serverSet) monitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, server := range s.all() {
+			server.check()
+		}
+	}
+}
+
+func (s *serverSet) status() []ServerStatus {
+	var statuses []ServerStatus
+	for _, server := range s.all() {
+		statuses = append(statuses, server.status())
+	}
+	return statuses
+}
+
+// available reports whether at least one server in servers is up.
+func available(servers []*ldapServer) bool {
+	for _, server := range servers {
+		if server.isUp() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ldapServer) check() {
+	conn, err := s.pool.Get()
+	if err == nil {
+		err = probe(conn.Conn)
+		conn.Close()
+	}
+
+	if errors.Is(err, ErrPoolExhausted) {
+		// Every connection is busy, which says nothing about health.
+		return
+	}
+	if err != nil {
+		s.markDown(err)
+		return
+	}
+	s.markUp()
+}
+
+func (s *ldapServer) isUp() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.up
+}
+
+func (s *ldapServer) markUp() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.up {
+		log.Printf("LDAP server %s (%s) is UP", s.url, s.role)
+	}
+	s.up = true
+	s.lastError = ""
+	s.failures = 0
+	s.lastChecked = time.Now()
+}
+
+func (s *ldapServer) markDown(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.up {
+		log.Printf("LDAP server %s (%s) is DOWN: %v", s.url, s.role, err)
+	}
+	s.up = false
+	s.lastError = err.Error()
+	s.failures++
+	s.lastChecked = time.Now()
+}
+
+func (s *ldapServer) status() ServerStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	status := ServerStatus{
+		URL:                 s.url,
+		Role:                s.role,
+		Up:                  s.up,
+		LastError:           s.lastError,
+		ConsecutiveFailures: s.failures,
+		Pool:                s.pool.Stats(),
+	}
+	if !s.lastChecked.IsZero() {
+		checked := s.lastChecked
+		status.LastChecked = &checked
+	}
+	return status
+}
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"errors"
+	"ldap-self-service/internal/config"
+	"net"
+	"testing"
+)
+
+// unreachableLDAPURL returns the URL of a port nothing listens on.
+func unreachableLDAPURL(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return "ldap://" + addr
+}
+
+func newTestServerSet(t *testing.T, urls ...string) *serverSet {
+	t.Helper()
+
+	set, err := newServerSet(&config.Config{LDAP: config.LDAPConfig{
+		BindDN:       testBindDN,
+		BindPassword: testBindPassword,
+		URLs:         urls,
+		Pool:         config.LDAPPoolConfig{MaxOpen: 2, MaxIdle: 2, WaitTimeout: 1},
+	}})
+	if err != nil {
+		t.Fatalf("newServerSet: %v", err)
+	}
+	t.Cleanup(set.close)
+	return set
+}
+
+func TestServerSetOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		// reachable and down say, per server in order, whether it
+		// accepts connections and whether it is marked down beforehand.
+		reachable []bool
+		down      []bool
+		want      int
+		wantUp    []bool
+	}{
+		{
+			name:      "first server",
+			reachable: []bool{true, true},
+			down:      []bool{false, false},
+			want:      0,
+			wantUp:    []bool{true, true},
+		},
+		{
+			name:      "skips a server marked down",
+			reachable: []bool{true, true},
+			down:      []bool{true, false},
+			want:      1,
+			wantUp:    []bool{false, true},
+		},
+		{
+			name:      "fails over and marks the server down",
+			reachable: []bool{false, true, true},
+			down:      []bool{false, false, false},
+			want:      1,
+			wantUp:    []bool{false, true, true},
+		},
+		{
+			name:      "up servers before down ones",
+			reachable: []bool{true, false, true},
+			down:      []bool{true, false, false},
+			want:      2,
+			wantUp:    []bool{false, false, true},
+		},
+		{
+			name:      "down server as a last resort",
+			reachable: []bool{false, true},
+			down:      []bool{false, true},
+			want:      1,
+			wantUp:    []bool{false, true},
+		},
+		{
+			name:      "nothing reachable",
+			reachable: []bool{false, false},
+			down:      []bool{false, true},
+			want:      -1,
+			wantUp:    []bool{false, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var urls []string
+			for _, reachable := range tt.reachable {
+				if reachable {
+					urls = append(urls, newFakeLDAPServer(t).url())
+				} else {
+					urls = append(urls, unreachableLDAPURL(t))
+				}
+			}
+			set := newTestServerSet(t, urls...)
+			for i, down := range tt.down {
+				if down {
+					set.readers[i].markDown(errors.New("health check failed"))
+				}
+			}
+
+			conn, err := set.read()
+			if tt.want < 0 {
+				if !errors.Is(err, ErrNoServerAvailable) {
+					t.Fatalf("read = %v, want %v", err, ErrNoServerAvailable)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				defer conn.Close()
+				if conn.pool != set.readers[tt.want].pool {
+					t.Fatalf("read used %s, want %s", poolURL(set, conn.pool), urls[tt.want])
+				}
+			}
+
+			for i, server := range set.readers {
+				if server.isUp() != tt.wantUp[i] {
+					t.Fatalf("%s up = %v, want %v", server.url, server.isUp(), tt.wantUp[i])
+				}
+			}
+		})
+	}
+}
+
+func TestServerSetWritesGoToMaster(t *testing.T) {
+	replica := newFakeLDAPServer(t)
+	master := newFakeLDAPServer(t)
+
+	set, err := newServerSet(&config.Config{LDAP: config.LDAPConfig{
+		BindDN:       testBindDN,
+		BindPassword: testBindPassword,
+		URLs:         []string{replica.url()},
+		MasterURL:    master.url(),
+		Pool:         config.LDAPPoolConfig{MaxOpen: 1, MaxIdle: 1, WaitTimeout: 1},
+	}})
+	if err != nil {
+		t.Fatalf("newServerSet: %v", err)
+	}
+	defer set.close()
+
+	read, err := set.read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	read.Close()
+	write, err := set.write()
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	write.Close()
+
+	if read.pool != set.readers[0].pool || write.pool != set.writers[0].pool || read.pool == write.pool {
+		t.Fatal("reads and writes were not routed to the replica and the master")
+	}
+}
+
+func poolURL(set *serverSet, pool *ldapPool) string {
+	for _, server := range set.all() {
+		if server.pool == pool {
+			return server.url
+		}
+	}
+	return "an unknown server"
+}
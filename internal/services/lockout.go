@@ -0,0 +1,177 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// ThrottleError reports that the caller has to wait RetryAfter before trying
+// again. Handlers answer it with 429 and a Retry-After header.
+type ThrottleError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *ThrottleError) Error() string {
+	return e.Message
+}
+
+// RetryAfterSeconds rounds RetryAfter up to whole seconds, at least one.
+func (e *ThrottleError) RetryAfterSeconds() int {
+	return int(math.Max(1, math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// LockoutTracker counts failed attempts per key within a sliding window and
+// locks the key out once a limit is reached. Keys carry their kind, e.g.
+// "user:alice" or "ip:192.0.2.1", so one tracker serves every dimension.
+//
+// Counts live in the verification store, so with a shared store every
+// replica counts against the same limits.
+type LockoutTracker struct {
+	store    VerificationStore
+	prefix   string
+	window   time.Duration
+	duration time.Duration
+}
+
+// lockoutState is a key's record, kept as JSON in VerificationCode.Data.
+type lockoutState struct {
+	Failures    []time.Time `json:"failures,omitempty"`
+	LockedUntil time.Time   `json:"lockedUntil,omitempty"`
+}
+
+// NewLockoutTracker keeps its counts in store under prefix.
+func NewLockoutTracker(store VerificationStore, prefix string, window, duration time.Duration) *LockoutTracker {
+	return &LockoutTracker{
+		store:    store,
+		prefix:   prefix,
+		window:   window,
+		duration: duration,
+	}
+}
+
+// Check returns a *ThrottleError when key is locked out.
+func (t *LockoutTracker) Check(key string) error {
+	record, err := t.store.Get(t.prefix + key)
+	if err != nil || record == nil {
+		return err
+	}
+
+	state, err := decodeLockoutState(record)
+	if err != nil {
+		return err
+	}
+	if remaining := time.Until(state.LockedUntil); remaining > 0 {
+		return &ThrottleError{Message: "too many failed attempts, try again later", RetryAfter: remaining}
+	}
+	return nil
+}
+
+// Failure records a failed attempt for key and locks it out when limit
+// failures fall within the window. A limit of zero disables the lockout.
+// The attempt has already failed, so store errors are only logged.
+func (t *LockoutTracker) Failure(key string, limit int) {
+	if limit <= 0 {
+		return
+	}
+
+	var locked *lockoutState
+	err := t.store.Update(t.prefix+key, func(record *VerificationCode) (*VerificationCode, error) {
+		locked = nil
+		state := &lockoutState{}
+		if record != nil {
+			var err error
+			if state, err = decodeLockoutState(record); err != nil {
+				return nil, err
+			}
+		}
+
+		now := time.Now()
+		state.Failures = append(pruneFailures(state.Failures, now.Add(-t.window)), now)
+		if len(state.Failures) >= limit && !now.Before(state.LockedUntil) {
+			state.LockedUntil = now.Add(t.duration)
+			locked = &lockoutState{Failures: state.Failures, LockedUntil: state.LockedUntil}
+			state.Failures = nil
+		}
+		return t.encode(key, state, now)
+	})
+	if err != nil {
+		log.Printf("Failed to record failed attempt for %s: %v", key, err)
+		return
+	}
+
+	if locked != nil {
+		log.Printf("SECURITY: lockout %s after %d failed verification attempts in %s, locked until %s",
+			key, len(locked.Failures), t.window, locked.LockedUntil.Format(time.RFC3339))
+	}
+}
+
+// Success clears the failures recorded for key, unless it is locked out.
+func (t *LockoutTracker) Success(key string) {
+	err := t.store.Update(t.prefix+key, func(record *VerificationCode) (*VerificationCode, error) {
+		if record == nil {
+			return nil, nil
+		}
+		state, err := decodeLockoutState(record)
+		if err != nil {
+			return nil, err
+		}
+		if time.Now().Before(state.LockedUntil) {
+			return record, nil
+		}
+		return nil, nil
+	})
+	if err != nil {
+		log.Printf("Failed to clear failed attempts for %s: %v", key, err)
+	}
+}
+
+// encode builds the record for state, which expires once neither its
+// lockout nor any of its failures matter any more.
+func (t *LockoutTracker) encode(key string, state *lockoutState, now time.Time) (*VerificationCode, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := state.LockedUntil
+	if len(state.Failures) > 0 {
+		if windowEnd := now.Add(t.window); windowEnd.After(expiresAt) {
+			expiresAt = windowEnd
+		}
+	}
+	if !expiresAt.After(now) {
+		return nil, nil
+	}
+	return &VerificationCode{Token: key, ExpiresAt: expiresAt, Data: string(data)}, nil
+}
+
+func decodeLockoutState(record *VerificationCode) (*lockoutState, error) {
+	var state lockoutState
+	if err := json.Unmarshal([]byte(record.Data), &state); err != nil {
+		return nil, fmt.Errorf("invalid lockout data: %w", err)
+	}
+	return &state, nil
+}
+
+func pruneFailures(failures []time.Time, since time.Time) []time.Time {
+	kept := failures[:0]
+	for _, failure := range failures {
+		if failure.After(since) {
+			kept = append(kept, failure)
+		}
+	}
+	return kept
+}
+
+func userLockoutKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func ipLockoutKey(ip string) string {
+	return "ip:" + ip
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockoutTracker(t *testing.T) {
+	for name, store := range verificationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// Two trackers on one store stand in for two replicas.
+			first := NewLockoutTracker(store, "lockout:", time.Minute, time.Minute)
+			second := NewLockoutTracker(store, "lockout:", time.Minute, time.Minute)
+
+			first.Failure("user:alice", 3)
+			second.Failure("user:alice", 3)
+			if err := first.Check("user:alice"); err != nil {
+				t.Fatalf("Check after 2 of 3 failures = %v, want nil", err)
+			}
+
+			first.Failure("user:alice", 3)
+			var throttle *ThrottleError
+			if err := second.Check("user:alice"); !errors.As(err, &throttle) {
+				t.Fatalf("Check after 3 failures = %v, want a *ThrottleError", err)
+			}
+			if throttle.RetryAfterSeconds() < 1 || throttle.RetryAfter > time.Minute {
+				t.Fatalf("RetryAfter = %s, want up to a minute", throttle.RetryAfter)
+			}
+
+			second.Success("user:alice")
+			if err := first.Check("user:alice"); err == nil {
+				t.Fatal("Success lifted an active lockout")
+			}
+
+			if err := first.Check("user:bob"); err != nil {
+				t.Fatalf("Check(unrelated key) = %v, want nil", err)
+			}
+			first.Failure("user:bob", 3)
+			first.Success("user:bob")
+			first.Failure("user:bob", 3)
+			first.Failure("user:bob", 3)
+			if err := first.Check("user:bob"); err != nil {
+				t.Fatalf("Success did not clear earlier failures: %v", err)
+			}
+
+			first.Failure("user:carol", 0)
+			if err := first.Check("user:carol"); err != nil {
+				t.Fatalf("a zero limit locked the key out: %v", err)
+			}
+		})
+	}
+}
+
+func TestLockoutTrackerWindow(t *testing.T) {
+	tracker := NewLockoutTracker(NewMemoryVerificationStore(), "lockout:", 50*time.Millisecond, time.Minute)
+
+	tracker.Failure("ip:192.0.2.1", 2)
+	time.Sleep(100 * time.Millisecond)
+	tracker.Failure("ip:192.0.2.1", 2)
+	if err := tracker.Check("ip:192.0.2.1"); err != nil {
+		t.Fatalf("failures outside the window locked the key out: %v", err)
+	}
+
+	tracker.Failure("ip:192.0.2.1", 2)
+	if err := tracker.Check("ip:192.0.2.1"); err == nil {
+		t.Fatal("failures within the window did not lock the key out")
+	}
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"ldap-self-service/internal/config"
+	"ldap-self-service/internal/models"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// passwordChangeAttributes change whenever a user's password is set.
+// userPassword is included for directories without a change timestamp; its
+// value is only ever hashed.
+var passwordChangeAttributes = []string{
+	"pwdChangedTime",
+	"krbLastPwdChange",
+	"shadowLastChange",
+	"pwdLastSet",
+	"passwordExpirationTime",
+	"userPassword",
+}
+
+// PasswordNonce returns an opaque value that changes whenever username's
+// password changes, derived from the directory's change attributes and the
+// local password history.
+func (s *LDAPService) PasswordNonce(username string) (string, error) {
+	conn, err := s.Connect()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	searchRequest := ldap.NewSearchRequest(
+		s.config.LDAP.UserBaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		fmt.Sprintf(s.config.LDAP.UserFilter, ldap.EscapeFilter(username)),
+		passwordChangeAttributes,
+		nil,
+	)
+
+	sr, err := conn.Search(searchRequest)
+	if err != nil {
+		return "", fmt.Errorf("search failed: %w", s.translateError(err, nil))
+	}
+	if len(sr.Entries) == 0 {
+		return "", ErrUserNotFound
+	}
+	entry := sr.Entries[0]
+
+	hash := sha256.New()
+	hash.Write([]byte(normalizeDN(entry.DN)))
+	for _, attr := range passwordChangeAttributes {
+		for _, value := range entry.GetRawAttributeValues(attr) {
+			hash.Write([]byte{0})
+			hash.Write([]byte(attr))
+			hash.Write([]byte{0})
+			hash.Write(value)
+		}
+	}
+	if s.history != nil {
+		if hashes, err := s.history.Hashes(entry.DN); err == nil && len(hashes) > 0 {
+			hash.Write([]byte{0})
+			hash.Write([]byte(hashes[0]))
+		}
+	}
+
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// MagicLinkChannel emails a one-time reset link instead of a code. The link
+// carries the challenge token and a signature over the token, username,
+// expiry and the user's password nonce, so it stops working once used, once
+// expired, or as soon as the password changes by any means.
+type MagicLinkChannel struct {
+	email   *EmailService
+	ldap    *LDAPService
+	key     []byte
+	ttl     time.Duration
+	baseURL string
+}
+
+func NewMagicLinkChannel(cfg *config.Config, emailService *EmailService, ldapService *LDAPService) (*MagicLinkChannel, error) {
+	if cfg.BaseURL == "" {
+		return nil, errors.New("base_url must be set to send reset links")
+	}
+
+	// Derive a dedicated key so link signatures can never be confused with
+	// other uses of the session secret.
+	mac := hmac.New(sha256.New, []byte(cfg.SessionSecret))
+	mac.Write([]byte("ldap-self-service magic link"))
+
+	return &MagicLinkChannel{
+		email:   emailService,
+		ldap:    ldapService,
+		key:     mac.Sum(nil),
+		ttl:     time.Duration(cfg.Reset.LinkTTL) * time.Second,
+		baseURL: strings.TrimRight(cfg.BaseURL, "/"),
+	}, nil
+}
+
+func (c *MagicLinkChannel) Name() string {
+	return "link"
+}
+
+func (c *MagicLinkChannel) Destinations(user *models.User) []string {
+	return c.email.Destinations(user)
+}
+
+func (c *MagicLinkChannel) Mask(destination string) string {
+	return c.email.Mask(destination)
+}
+
+// Start sets the link's lifetime.
+func (c *MagicLinkChannel) Start(user *models.User, destination string, challenge *VerificationCode) error {
+	if c.ttl > 0 {
+		challenge.ExpiresAt = time.Now().Add(c.ttl)
+	}
+	return nil
+}
+
+// Deliver signs the stored challenge and emails the link. Nothing secret is
+// stored: the signature is recomputed from the current nonce on
+// verification.
+func (c *MagicLinkChannel) Deliver(user *models.User, destination string, challenge *VerificationCode) error {
+	nonce, err := c.ldap.PasswordNonce(user.Username)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/reset?t=%s", c.baseURL, url.QueryEscape(challenge.Token+"."+c.sign(challenge, nonce)))
+	return c.email.SendResetLink(destination, link, time.Until(challenge.ExpiresAt))
+}
+
+// Verify checks the signature half of the link against the user's current
+// password nonce.
+func (c *MagicLinkChannel) Verify(challenge *VerificationCode, response ChallengeResponse) (bool, error) {
+	nonce, err := c.ldap.PasswordNonce(challenge.Username)
+	if err != nil {
+		return false, err
+	}
+
+	return hmac.Equal([]byte(c.sign(challenge, nonce)), []byte(response.Code)), nil
+}
+
+func (c *MagicLinkChannel) sign(challenge *VerificationCode, nonce string) string {
+	mac := hmac.New(sha256.New, c.key)
+	for _, part := range []string{challenge.Token, strings.ToLower(challenge.Username), nonce, strconv.FormatInt(challenge.ExpiresAt.Unix(), 10)} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,501 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ldap-self-service/internal/config"
+	"ldap-self-service/internal/models"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// passkeyKeyPrefix namespaces ceremony state in the verification store.
+const passkeyKeyPrefix = "passkey:"
+
+// Ceremony kinds, recorded as the Channel of their stored state.
+const (
+	passkeyRegistration = "passkey-registration"
+	passkeyLogin        = "passkey-login"
+)
+
+// PasskeyService registers WebAuthn credentials (passkeys) for users and
+// verifies assertions made with them, to sign in and as the "passkey"
+// reset channel. Credentials are stored per user DN.
+//
+// Each ceremony is started and finished in separate requests; the state in
+// between is kept in the verification store under a random token, so any
+// replica can finish it.
+type PasskeyService struct {
+	webauthn *webauthn.WebAuthn
+	store    UserDataStore
+	sessions VerificationStore
+	ttl      time.Duration
+	decoyKey []byte
+
+	// mutex serializes read-modify-write of credential lists.
+	mutex sync.Mutex
+}
+
+// Passkey describes a registered credential without its key material.
+type Passkey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+type storedPasskey struct {
+	Passkey
+	Credential webauthn.Credential `json:"credential"`
+}
+
+func NewPasskeyService(cfg *config.Config, ldapService *LDAPService, sessions VerificationStore) (*PasskeyService, error) {
+	settings := cfg.WebAuthn
+
+	origins := settings.RPOrigins
+	if len(origins) == 0 && cfg.BaseURL != "" {
+		origins = []string{strings.TrimRight(cfg.BaseURL, "/")}
+	}
+	rpID := settings.RPID
+	if rpID == "" && cfg.BaseURL != "" {
+		base, err := url.Parse(cfg.BaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base_url: %w", err)
+		}
+		rpID = base.Hostname()
+	}
+	if rpID == "" || len(origins) == 0 {
+		return nil, errors.New("webauthn needs rp_id and rp_origins, or base_url")
+	}
+
+	displayName := settings.RPDisplayName
+	if displayName == "" {
+		displayName = cfg.SiteName
+	}
+
+	ttl := 5 * time.Minute
+	relyingParty, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: displayName,
+		RPOrigins:     origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+			UserVerification: protocol.VerificationPreferred,
+		},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: ttl},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: ttl},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := NewUserDataStore(ldapService, settings.Attribute, settings.StoreFile, "webauthn")
+	if err != nil {
+		return nil, err
+	}
+
+	// Derive a dedicated key for decoy credential IDs, as for magic link
+	// signatures.
+	mac := hmac.New(sha256.New, []byte(cfg.SessionSecret))
+	mac.Write([]byte("ldap-self-service passkey decoy"))
+
+	return &PasskeyService{
+		webauthn: relyingParty,
+		store:    store,
+		sessions: sessions,
+		ttl:      ttl,
+		decoyKey: mac.Sum(nil),
+	}, nil
+}
+
+// List returns the passkeys registered for userDN.
+func (s *PasskeyService) List(userDN string) ([]Passkey, error) {
+	stored, err := s.load(userDN)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys := make([]Passkey, 0, len(stored))
+	for _, passkey := range stored {
+		passkeys = append(passkeys, passkey.Passkey)
+	}
+	return passkeys, nil
+}
+
+// Delete removes the passkey with id from userDN's credentials.
+func (s *PasskeyService) Delete(userDN, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, err := s.load(userDN)
+	if err != nil {
+		return err
+	}
+
+	kept := stored[:0]
+	for _, passkey := range stored {
+		if passkey.ID != id {
+			kept = append(kept, passkey)
+		}
+	}
+	if len(kept) == len(stored) {
+		return invalidRequest("passkey not found", nil)
+	}
+	return s.save(userDN, kept)
+}
+
+// BeginRegistration starts registering a new passkey for user. It returns
+// the token to finish with and the options for navigator.credentials.create.
+func (s *PasskeyService) BeginRegistration(user *models.User) (string, *protocol.CredentialCreation, error) {
+	stored, err := s.load(user.DN)
+	if err != nil {
+		return "", nil, err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(stored))
+	for _, passkey := range stored {
+		exclusions = append(exclusions, passkey.Credential.Descriptor())
+	}
+
+	options, session, err := s.webauthn.BeginRegistration(newPasskeyUser(user, stored), webauthn.WithExclusions(exclusions))
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := s.saveSession(passkeyRegistration, user, session)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, options, nil
+}
+
+// FinishRegistration verifies the authenticator's response to the
+// registration identified by token and stores the new passkey as name.
+func (s *PasskeyService) FinishRegistration(user *models.User, token, name string, response []byte) (*Passkey, error) {
+	ceremony, session, err := s.takeSession(passkeyRegistration, token)
+	if err != nil {
+		return nil, err
+	}
+	if normalizeDN(ceremony.DN) != normalizeDN(user.DN) {
+		return nil, invalidRequest("invalid or expired passkey registration", nil)
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return nil, invalidRequest("invalid passkey response", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, err := s.load(user.DN)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := s.webauthn.CreateCredential(newPasskeyUser(user, stored), *session, parsed)
+	if err != nil {
+		return nil, invalidRequest("the passkey could not be verified", err)
+	}
+
+	if name == "" {
+		name = fmt.Sprintf("Passkey %d", len(stored)+1)
+	}
+	passkey := storedPasskey{
+		Passkey: Passkey{
+			ID:        base64.RawURLEncoding.EncodeToString(credential.ID),
+			Name:      name,
+			CreatedAt: time.Now().UTC(),
+		},
+		Credential: *credential,
+	}
+	if err := s.save(user.DN, append(stored, passkey)); err != nil {
+		return nil, err
+	}
+	return &passkey.Passkey, nil
+}
+
+// BeginLogin starts an assertion with the passkeys of username, whose
+// entry is user. It returns the token to finish with and the options for
+// navigator.credentials.get.
+//
+// When user is nil (no such account) or has no passkeys, it answers with a
+// decoy: options listing a credential ID derived from username, so the
+// response doesn't reveal which accounts exist or have passkeys, and a
+// token that FinishLogin always rejects.
+func (s *PasskeyService) BeginLogin(username string, user *models.User) (string, *protocol.CredentialAssertion, error) {
+	var stored []storedPasskey
+	if user != nil {
+		var err error
+		if stored, err = s.load(user.DN); err != nil {
+			return "", nil, err
+		}
+	}
+	if len(stored) == 0 {
+		user = &models.User{Username: username}
+		stored = []storedPasskey{{Credential: webauthn.Credential{ID: s.decoyCredentialID(username)}}}
+	}
+
+	options, session, err := s.webauthn.BeginLogin(newPasskeyUser(user, stored))
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := s.saveSession(passkeyLogin, user, session)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, options, nil
+}
+
+// FinishLogin verifies the assertion for the login identified by token and
+// returns the username it was started for.
+func (s *PasskeyService) FinishLogin(token string, response []byte) (string, error) {
+	ceremony, session, err := s.takeSession(passkeyLogin, token)
+	if err != nil {
+		return "", err
+	}
+	if ceremony.DN == "" {
+		// A decoy from BeginLogin; no assertion can match it.
+		return "", ErrInvalidCredentials
+	}
+
+	if err := s.validateAssertion(ceremony.Username, ceremony.DN, session, response); err != nil {
+		return "", err
+	}
+	return ceremony.Username, nil
+}
+
+func (s *PasskeyService) Name() string {
+	return "passkey"
+}
+
+// Destinations is the user's DN once they have registered a passkey.
+func (s *PasskeyService) Destinations(user *models.User) []string {
+	stored, err := s.load(user.DN)
+	if err != nil {
+		log.Printf("Failed to load passkeys for %s: %v", user.DN, err)
+		return nil
+	}
+	if len(stored) == 0 {
+		return nil
+	}
+	return []string{user.DN}
+}
+
+func (s *PasskeyService) Mask(destination string) string {
+	return "passkey"
+}
+
+// Start begins an assertion and hands its options to the client with the
+// challenge; the WebAuthn session stays on the server in challenge.Data.
+func (s *PasskeyService) Start(user *models.User, destination string, challenge *VerificationCode) error {
+	options, session, err := s.beginAssertion(user)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	challenge.Data = string(data)
+	challenge.Options, err = json.Marshal(options)
+	return err
+}
+
+func (s *PasskeyService) Verify(challenge *VerificationCode, response ChallengeResponse) (bool, error) {
+	if len(response.Credential) == 0 {
+		return false, nil
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(challenge.Data), &session); err != nil {
+		return false, fmt.Errorf("invalid passkey challenge: %w", err)
+	}
+
+	err := s.validateAssertion(challenge.Username, challenge.DN, &session, response.Credential)
+	if errors.Is(err, ErrInvalidCredentials) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *PasskeyService) beginAssertion(user *models.User) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	stored, err := s.load(user.DN)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(stored) == 0 {
+		return nil, nil, invalidRequest("no passkey is registered for this user", nil)
+	}
+
+	return s.webauthn.BeginLogin(newPasskeyUser(user, stored))
+}
+
+// decoyCredentialID is a stable, unguessable stand-in for the credential
+// ID of username, for accounts without passkeys.
+func (s *PasskeyService) decoyCredentialID(username string) []byte {
+	mac := hmac.New(sha256.New, s.decoyKey)
+	mac.Write([]byte(strings.ToLower(username)))
+	return mac.Sum(nil)
+}
+
+// validateAssertion checks an assertion against the passkeys of userDN and
+// records the new signature counter.
+func (s *PasskeyService) validateAssertion(username, userDN string, session *webauthn.SessionData, response []byte) error {
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return newServiceError(ErrInvalidCredentials, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, err := s.load(userDN)
+	if err != nil {
+		return err
+	}
+
+	user := &models.User{DN: userDN, Username: username}
+	credential, err := s.webauthn.ValidateLogin(newPasskeyUser(user, stored), *session, parsed)
+	if err != nil {
+		return newServiceError(ErrInvalidCredentials, err)
+	}
+	if credential.Authenticator.CloneWarning {
+		log.Printf("SECURITY: passkey for %s reported a signature counter that went backwards, it may have been cloned", username)
+		return newServiceError(ErrInvalidCredentials, errors.New("signature counter went backwards"))
+	}
+
+	now := time.Now().UTC()
+	for i := range stored {
+		if bytes.Equal(stored[i].Credential.ID, credential.ID) {
+			stored[i].Credential.Authenticator = credential.Authenticator
+			stored[i].LastUsedAt = &now
+		}
+	}
+	return s.save(userDN, stored)
+}
+
+// saveSession keeps the WebAuthn session for a ceremony until it is
+// finished or expires.
+func (s *PasskeyService) saveSession(kind string, user *models.User, session *webauthn.SessionData) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.sessions.Put(passkeyKeyPrefix+token, &VerificationCode{
+		Token:     token,
+		Channel:   kind,
+		Username:  user.Username,
+		DN:        user.DN,
+		ExpiresAt: time.Now().Add(s.ttl),
+		Data:      string(data),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store passkey session: %w", err)
+	}
+	return token, nil
+}
+
+// takeSession returns and discards the state of a ceremony, so each can be
+// finished once.
+func (s *PasskeyService) takeSession(kind, token string) (*VerificationCode, *webauthn.SessionData, error) {
+	ceremony, err := s.sessions.Take(passkeyKeyPrefix + token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ceremony == nil || ceremony.Channel != kind {
+		return nil, nil, invalidRequest("invalid or expired passkey request, start again", nil)
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(ceremony.Data), &session); err != nil {
+		return nil, nil, fmt.Errorf("invalid passkey session: %w", err)
+	}
+	return ceremony, &session, nil
+}
+
+func (s *PasskeyService) load(userDN string) ([]storedPasskey, error) {
+	data, err := s.store.Load(userDN)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+
+	var stored []storedPasskey
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("invalid passkey data: %w", err)
+	}
+	return stored, nil
+}
+
+func (s *PasskeyService) save(userDN string, stored []storedPasskey) error {
+	if len(stored) == 0 {
+		return s.store.Save(userDN, nil)
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return s.store.Save(userDN, data)
+}
+
+// passkeyUser adapts a directory user to webauthn.User. The user handle is
+// a hash of the DN, so it is stable without being stored and reveals
+// nothing about the account.
+type passkeyUser struct {
+	user        *models.User
+	credentials []webauthn.Credential
+}
+
+func newPasskeyUser(user *models.User, stored []storedPasskey) *passkeyUser {
+	credentials := make([]webauthn.Credential, 0, len(stored))
+	for _, passkey := range stored {
+		credentials = append(credentials, passkey.Credential)
+	}
+	return &passkeyUser{user: user, credentials: credentials}
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	handle := sha256.Sum256([]byte(normalizeDN(u.user.DN)))
+	return handle[:]
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	if name := strings.TrimSpace(u.user.FirstName + " " + u.user.LastName); name != "" {
+		return name
+	}
+	return u.user.Username
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func (u *passkeyUser) WebAuthnIcon() string {
+	return ""
+}
@@ -0,0 +1,380 @@
+package services
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"ldap-self-service/internal/config"
+	"ldap-self-service/internal/models"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+const (
+	testRPID   = "portal.example.com"
+	testOrigin = "https://portal.example.com"
+)
+
+// softAuthenticator is a WebAuthn authenticator with a P-256 key held in
+// memory. It answers with "none" attestation, as most passkeys do.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	return &softAuthenticator{key: key, credentialID: credentialID}
+}
+
+// authenticatorData builds the authenticator data, with the attested
+// credential when attested is set.
+func (a *softAuthenticator) authenticatorData(t *testing.T, attested bool) []byte {
+	t.Helper()
+
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	flags := byte(protocol.FlagUserPresent | protocol.FlagUserVerified)
+	if attested {
+		flags |= byte(protocol.FlagAttestedCredentialData)
+	}
+
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if !attested {
+		return data
+	}
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+	data = append(data, a.credentialID...)
+	return append(data, publicKey...)
+}
+
+func clientData(t *testing.T, ceremony string, challenge []byte) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		t.Fatalf("marshal client data: %v", err)
+	}
+	return data
+}
+
+// create answers navigator.credentials.create.
+func (a *softAuthenticator) create(t *testing.T, options *protocol.CredentialCreation) []byte {
+	t.Helper()
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(t, true),
+	})
+	if err != nil {
+		t.Fatalf("marshal attestation: %v", err)
+	}
+
+	return a.credential(t, map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData(t, "webauthn.create", options.Response.Challenge)),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+	})
+}
+
+// get answers navigator.credentials.get.
+func (a *softAuthenticator) get(t *testing.T, options *protocol.CredentialAssertion) []byte {
+	t.Helper()
+
+	a.signCount++
+	authData := a.authenticatorData(t, false)
+	client := clientData(t, "webauthn.get", options.Response.Challenge)
+
+	clientHash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	return a.credential(t, map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(client),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+func (a *softAuthenticator) credential(t *testing.T, response map[string]string) []byte {
+	t.Helper()
+
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	data, err := json.Marshal(map[string]any{
+		"id":       id,
+		"rawId":    id,
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatalf("marshal credential: %v", err)
+	}
+	return data
+}
+
+func newTestPasskeyService(t *testing.T) *PasskeyService {
+	t.Helper()
+
+	cfg := &config.Config{
+		SiteName:      "Example",
+		SessionSecret: "test-secret",
+		WebAuthn: config.WebAuthnConfig{
+			Enabled:   true,
+			RPID:      testRPID,
+			RPOrigins: []string{testOrigin},
+			StoreFile: filepath.Join(t.TempDir(), "passkeys.json"),
+		},
+	}
+	service, err := NewPasskeyService(cfg, nil, NewMemoryVerificationStore())
+	if err != nil {
+		t.Fatalf("NewPasskeyService: %v", err)
+	}
+	return service
+}
+
+// registerPasskey registers authenticator for user.
+func registerPasskey(t *testing.T, service *PasskeyService, user *models.User, authenticator *softAuthenticator) {
+	t.Helper()
+
+	token, options, err := service.BeginRegistration(user)
+	if err != nil {
+		t.Fatalf("BeginRegistration: %v", err)
+	}
+	if _, err := service.FinishRegistration(user, token, "Laptop", authenticator.create(t, options)); err != nil {
+		t.Fatalf("FinishRegistration: %v", err)
+	}
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	service := newTestPasskeyService(t)
+	alice := &models.User{Username: "alice", DN: "uid=alice,dc=example,dc=com"}
+	bob := &models.User{Username: "bob", DN: "uid=bob,dc=example,dc=com"}
+	authenticator := newSoftAuthenticator(t)
+
+	token, options, err := service.BeginRegistration(alice)
+	if err != nil {
+		t.Fatalf("BeginRegistration: %v", err)
+	}
+	response := authenticator.create(t, options)
+
+	if _, err := service.FinishRegistration(bob, token, "", response); err == nil {
+		t.Fatal("FinishRegistration accepted another user's registration")
+	}
+
+	token, options, err = service.BeginRegistration(alice)
+	if err != nil {
+		t.Fatalf("BeginRegistration: %v", err)
+	}
+	response = authenticator.create(t, options)
+	passkey, err := service.FinishRegistration(alice, token, "Laptop", response)
+	if err != nil {
+		t.Fatalf("FinishRegistration: %v", err)
+	}
+	if passkey.Name != "Laptop" || passkey.ID != base64.RawURLEncoding.EncodeToString(authenticator.credentialID) {
+		t.Fatalf("FinishRegistration = %+v", passkey)
+	}
+	if _, err := service.FinishRegistration(alice, token, "Laptop", response); err == nil {
+		t.Fatal("FinishRegistration accepted a registration token twice")
+	}
+
+	list, err := service.List(alice.DN)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list) != 1 || list[0].ID != passkey.ID {
+		t.Fatalf("List = %+v, want the new passkey", list)
+	}
+
+	_, options, err = service.BeginRegistration(alice)
+	if err != nil {
+		t.Fatalf("BeginRegistration: %v", err)
+	}
+	excluded := options.Response.CredentialExcludeList
+	if len(excluded) != 1 || !bytes.Equal(excluded[0].CredentialID, authenticator.credentialID) {
+		t.Fatalf("exclude list = %+v, want the registered passkey", excluded)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	service := newTestPasskeyService(t)
+	alice := &models.User{Username: "alice", DN: "uid=alice,dc=example,dc=com"}
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, service, alice, authenticator)
+
+	token, options, err := service.BeginLogin(alice.Username, alice)
+	if err != nil {
+		t.Fatalf("BeginLogin: %v", err)
+	}
+	response := authenticator.get(t, options)
+
+	username, err := service.FinishLogin(token, response)
+	if err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if username != "alice" {
+		t.Fatalf("FinishLogin = %q, want alice", username)
+	}
+	if _, err := service.FinishLogin(token, response); err == nil {
+		t.Fatal("FinishLogin accepted a login token twice")
+	}
+
+	list, _ := service.List(alice.DN)
+	if len(list) != 1 || list[0].LastUsedAt == nil {
+		t.Fatalf("List = %+v, want the passkey marked as used", list)
+	}
+
+	// An assertion from a different key for the same credential ID.
+	token, options, err = service.BeginLogin(alice.Username, alice)
+	if err != nil {
+		t.Fatalf("BeginLogin: %v", err)
+	}
+	impostor := newSoftAuthenticator(t)
+	impostor.credentialID = authenticator.credentialID
+	impostor.signCount = authenticator.signCount
+	if _, err := service.FinishLogin(token, impostor.get(t, options)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("FinishLogin with the wrong key = %v, want %v", err, ErrInvalidCredentials)
+	}
+
+	// A signature counter that goes backwards suggests a cloned key.
+	token, options, err = service.BeginLogin(alice.Username, alice)
+	if err != nil {
+		t.Fatalf("BeginLogin: %v", err)
+	}
+	authenticator.signCount = 0
+	if _, err := service.FinishLogin(token, authenticator.get(t, options)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("FinishLogin with a stale counter = %v, want %v", err, ErrInvalidCredentials)
+	}
+}
+
+func TestPasskeyLoginDecoy(t *testing.T) {
+	service := newTestPasskeyService(t)
+	alice := &models.User{Username: "alice", DN: "uid=alice,dc=example,dc=com"}
+	registerPasskey(t, service, alice, newSoftAuthenticator(t))
+	carol := &models.User{Username: "carol", DN: "uid=carol,dc=example,dc=com"}
+
+	tests := []struct {
+		name     string
+		username string
+		user     *models.User
+	}{
+		{name: "unknown user", username: "mallory"},
+		{name: "no passkeys", username: "carol", user: carol},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, options, err := service.BeginLogin(tt.username, tt.user)
+			if err != nil {
+				t.Fatalf("BeginLogin: %v", err)
+			}
+			allowed := options.Response.AllowedCredentials
+			if len(allowed) != 1 {
+				t.Fatalf("allowCredentials = %+v, want one decoy", allowed)
+			}
+
+			_, again, err := service.BeginLogin(tt.username, tt.user)
+			if err != nil {
+				t.Fatalf("BeginLogin: %v", err)
+			}
+			if !bytes.Equal(again.Response.AllowedCredentials[0].CredentialID, allowed[0].CredentialID) {
+				t.Fatal("decoy credential ID changed between attempts")
+			}
+
+			// Even an authenticator claiming the decoy ID is refused.
+			authenticator := newSoftAuthenticator(t)
+			authenticator.credentialID = allowed[0].CredentialID
+			if _, err := service.FinishLogin(token, authenticator.get(t, options)); !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("FinishLogin = %v, want %v", err, ErrInvalidCredentials)
+			}
+		})
+	}
+}
+
+func TestPasskeyResetAssertion(t *testing.T) {
+	service := newTestPasskeyService(t)
+	alice := &models.User{Username: "alice", DN: "uid=alice,dc=example,dc=com"}
+	authenticator := newSoftAuthenticator(t)
+
+	if got := service.Destinations(alice); len(got) != 0 {
+		t.Fatalf("Destinations before registering = %v, want none", got)
+	}
+	registerPasskey(t, service, alice, authenticator)
+	destinations := service.Destinations(alice)
+	if len(destinations) != 1 {
+		t.Fatalf("Destinations = %v, want the user's DN", destinations)
+	}
+
+	start := func() (*VerificationCode, *protocol.CredentialAssertion) {
+		t.Helper()
+		challenge := &VerificationCode{Username: alice.Username, DN: alice.DN, ExpiresAt: time.Now().Add(time.Minute)}
+		if err := service.Start(alice, destinations[0], challenge); err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		var options protocol.CredentialAssertion
+		if err := json.Unmarshal(challenge.Options, &options); err != nil {
+			t.Fatalf("unmarshal options: %v", err)
+		}
+		return challenge, &options
+	}
+
+	challenge, options := start()
+	ok, err := service.Verify(challenge, ChallengeResponse{Credential: authenticator.get(t, options)})
+	if err != nil || !ok {
+		t.Fatalf("Verify = %v, %v; want true", ok, err)
+	}
+
+	challenge, options = start()
+	if ok, err := service.Verify(challenge, ChallengeResponse{}); err != nil || ok {
+		t.Fatalf("Verify without a credential = %v, %v; want false", ok, err)
+	}
+
+	other, _ := start()
+	response := authenticator.get(t, options)
+	if ok, err := service.Verify(other, ChallengeResponse{Credential: response}); err != nil || ok {
+		t.Fatalf("Verify with another challenge's assertion = %v, %v; want false", ok, err)
+	}
+}
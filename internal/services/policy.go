@@ -0,0 +1,290 @@
+package services
+
+import (
+	"fmt"
+	"ldap-self-service/internal/config"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rule identifiers reported in policy violations. They are stable so that
+// API clients can key translations or UI hints off them.
+const (
+	RuleMinLength  = "min_length"
+	RuleMaxLength  = "max_length"
+	RuleMinLower   = "min_lower"
+	RuleMinUpper   = "min_upper"
+	RuleMinDigit   = "min_digit"
+	RuleMinSpecial = "min_special"
+	RuleComplexity = "complexity"
+	RuleDiffLogin  = "diff_login"
+)
+
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError carries every violated rule for a candidate password. Err is
+// set when a check could not be completed, e.g. the breached password
+// lookup failed, so the violations may not be the full list.
+type PolicyError struct {
+	Violations []PolicyViolation
+	Err        error
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *PolicyError) Unwrap() error {
+	return e.Err
+}
+
+type PasswordPolicy struct {
+	config config.PasswordPolicyConfig
+}
+
+func NewPasswordPolicy(cfg config.PasswordPolicyConfig) *PasswordPolicy {
+	return &PasswordPolicy{config: cfg}
+}
+
+// CharacterClasses holds per-class rune counts for a password.
+type CharacterClasses struct {
+	Lower   int
+	Upper   int
+	Digit   int
+	Special int
+	Other   int
+}
+
+// Distinct returns how many of the four policy classes are present.
+func (c CharacterClasses) Distinct() int {
+	n := 0
+	for _, count := range []int{c.Lower, c.Upper, c.Digit, c.Special} {
+		if count > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Classify counts the character classes in password. When special_chars is
+// configured only those runes count as special; anything else that is not a
+// letter or digit is reported as Other and satisfies no rule.
+func (p *PasswordPolicy) Classify(password string) CharacterClasses {
+	var classes CharacterClasses
+
+	for _, char := range password {
+		switch {
+		case unicode.IsLower(char):
+			classes.Lower++
+		case unicode.IsUpper(char):
+			classes.Upper++
+		case unicode.IsDigit(char):
+			classes.Digit++
+		case p.isSpecial(char):
+			classes.Special++
+		default:
+			classes.Other++
+		}
+	}
+
+	return classes
+}
+
+func (p *PasswordPolicy) isSpecial(char rune) bool {
+	if p.config.SpecialChars != "" {
+		return strings.ContainsRune(p.config.SpecialChars, char)
+	}
+	return !unicode.IsLetter(char) && !unicode.IsSpace(char) && !unicode.IsControl(char)
+}
+
+// Validate checks password against every configured rule and returns a
+// *PolicyError listing all violations, or nil if the password is acceptable.
+// login is the account name used for the diff_login rule and may be empty.
+func (p *PasswordPolicy) Validate(login, password string) error {
+	var violations []PolicyViolation
+	add := func(rule, format string, args ...interface{}) {
+		violations = append(violations, PolicyViolation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	policy := p.config
+	length := utf8.RuneCountInString(password)
+
+	if length < policy.MinLength {
+		add(RuleMinLength, "password must be at least %d characters long", policy.MinLength)
+	}
+
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		add(RuleMaxLength, "password must be no more than %d characters long", policy.MaxLength)
+	}
+
+	classes := p.Classify(password)
+
+	if classes.Lower < policy.MinLower {
+		add(RuleMinLower, "password must contain at least %d lowercase letter(s)", policy.MinLower)
+	}
+
+	if classes.Upper < policy.MinUpper {
+		add(RuleMinUpper, "password must contain at least %d uppercase letter(s)", policy.MinUpper)
+	}
+
+	if classes.Digit < policy.MinDigit {
+		add(RuleMinDigit, "password must contain at least %d digit(s)", policy.MinDigit)
+	}
+
+	if classes.Special < policy.MinSpecial {
+		if policy.SpecialChars != "" {
+			add(RuleMinSpecial, "password must contain at least %d special character(s) from %q", policy.MinSpecial, policy.SpecialChars)
+		} else {
+			add(RuleMinSpecial, "password must contain at least %d special character(s)", policy.MinSpecial)
+		}
+	}
+
+	if policy.Complexity > 0 && classes.Distinct() < policy.Complexity {
+		add(RuleComplexity, "password must contain at least %d of: lowercase letters, uppercase letters, digits, special characters", policy.Complexity)
+	}
+
+	if policy.DiffLogin && login != "" && strings.Contains(strings.ToLower(password), strings.ToLower(login)) {
+		add(RuleDiffLogin, "password must not contain the username")
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+// PolicyRule describes one enforced rule for clients that want to validate
+// passwords before submitting them.
+type PolicyRule struct {
+	Rule        string      `json:"rule"`
+	Value       interface{} `json:"value"`
+	Description string      `json:"description"`
+}
+
+// Rules returns the effective policy as a list of enabled rules.
+func (p *PasswordPolicy) Rules() []PolicyRule {
+	policy := p.config
+	var rules []PolicyRule
+	add := func(rule string, value interface{}, format string, args ...interface{}) {
+		rules = append(rules, PolicyRule{Rule: rule, Value: value, Description: fmt.Sprintf(format, args...)})
+	}
+
+	if policy.MinLength > 0 {
+		add(RuleMinLength, policy.MinLength, "At least %d characters", policy.MinLength)
+	}
+	if policy.MaxLength > 0 {
+		add(RuleMaxLength, policy.MaxLength, "No more than %d characters", policy.MaxLength)
+	}
+	if policy.MinLower > 0 {
+		add(RuleMinLower, policy.MinLower, "At least %d lowercase letter(s)", policy.MinLower)
+	}
+	if policy.MinUpper > 0 {
+		add(RuleMinUpper, policy.MinUpper, "At least %d uppercase letter(s)", policy.MinUpper)
+	}
+	if policy.MinDigit > 0 {
+		add(RuleMinDigit, policy.MinDigit, "At least %d digit(s)", policy.MinDigit)
+	}
+	if policy.MinSpecial > 0 {
+		if policy.SpecialChars != "" {
+			add(RuleMinSpecial, policy.MinSpecial, "At least %d special character(s) from %s", policy.MinSpecial, policy.SpecialChars)
+		} else {
+			add(RuleMinSpecial, policy.MinSpecial, "At least %d special character(s)", policy.MinSpecial)
+		}
+	}
+	if policy.Complexity > 0 {
+		add(RuleComplexity, policy.Complexity, "At least %d of: lowercase, uppercase, digits, special characters", policy.Complexity)
+	}
+	if policy.DiffLogin {
+		add(RuleDiffLogin, true, "Must not contain your username")
+	}
+	if policy.NoReuse {
+		add(RuleNoReuse, policy.HistoryCount, "Must not match any of your last %d passwords", policy.HistoryCount)
+	}
+	if policy.UsePwnedPasswords {
+		add(RulePwned, true, "Must not appear in known data breaches")
+	}
+
+	return rules
+}
+
+// PasswordStrength is an estimate of how hard a password is to guess.
+type PasswordStrength struct {
+	Entropy float64 `json:"entropy"`
+	Score   int     `json:"score"`
+	Label   string  `json:"label"`
+}
+
+var strengthLabels = []string{"very weak", "weak", "fair", "strong", "very strong"}
+
+// EstimateStrength approximates the entropy of password in bits from the
+// size of the character pool it draws on. Immediately repeated characters
+// and runs of consecutive code points add only a single bit each, which
+// keeps "aaaaaaaa" and "12345678" from scoring as well as random strings.
+func (p *PasswordPolicy) EstimateStrength(password string) PasswordStrength {
+	classes := p.Classify(password)
+
+	pool := 0
+	if classes.Lower > 0 {
+		pool += 26
+	}
+	if classes.Upper > 0 {
+		pool += 26
+	}
+	if classes.Digit > 0 {
+		pool += 10
+	}
+	if classes.Special > 0 {
+		if p.config.SpecialChars != "" {
+			pool += utf8.RuneCountInString(p.config.SpecialChars)
+		} else {
+			pool += 33
+		}
+	}
+	if classes.Other > 0 {
+		pool += 100
+	}
+
+	var entropy float64
+	if pool > 1 {
+		perChar := math.Log2(float64(pool))
+		var prev rune = -1
+		for _, char := range password {
+			if prev >= 0 && (char == prev || char == prev+1 || char == prev-1) {
+				entropy++
+			} else {
+				entropy += perChar
+			}
+			prev = char
+		}
+	}
+
+	var score int
+	switch {
+	case entropy < 28:
+		score = 0
+	case entropy < 36:
+		score = 1
+	case entropy < 60:
+		score = 2
+	case entropy < 128:
+		score = 3
+	default:
+		score = 4
+	}
+
+	return PasswordStrength{
+		Entropy: math.Round(entropy*10) / 10,
+		Score:   score,
+		Label:   strengthLabels[score],
+	}
+}
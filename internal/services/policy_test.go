@@ -0,0 +1,169 @@
+package services
+
+import (
+	"errors"
+	"ldap-self-service/internal/config"
+	"slices"
+	"testing"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   config.PasswordPolicyConfig
+		login    string
+		password string
+		want     []string
+	}{
+		{
+			name:     "no rules",
+			password: "x",
+		},
+		{
+			name:     "too short",
+			policy:   config.PasswordPolicyConfig{MinLength: 8},
+			password: "short",
+			want:     []string{RuleMinLength},
+		},
+		{
+			name:     "length counts runes, not bytes",
+			policy:   config.PasswordPolicyConfig{MinLength: 4, MaxLength: 4},
+			password: "ééééé",
+			want:     []string{RuleMaxLength},
+		},
+		{
+			name:     "too long",
+			policy:   config.PasswordPolicyConfig{MaxLength: 8},
+			password: "muchtoolongforthis",
+			want:     []string{RuleMaxLength},
+		},
+		{
+			name:     "missing classes",
+			policy:   config.PasswordPolicyConfig{MinLower: 1, MinUpper: 2, MinDigit: 1, MinSpecial: 1},
+			password: "Password",
+			want:     []string{RuleMinUpper, RuleMinDigit, RuleMinSpecial},
+		},
+		{
+			name:     "all classes present",
+			policy:   config.PasswordPolicyConfig{MinLower: 1, MinUpper: 1, MinDigit: 1, MinSpecial: 1},
+			password: "Pa55word!",
+		},
+		{
+			name:     "special characters restricted",
+			policy:   config.PasswordPolicyConfig{MinSpecial: 1, SpecialChars: "!@#"},
+			password: "Password$",
+			want:     []string{RuleMinSpecial},
+		},
+		{
+			name:     "special character from the list",
+			policy:   config.PasswordPolicyConfig{MinSpecial: 1, SpecialChars: "!@#"},
+			password: "Password@",
+		},
+		{
+			name:     "space is not special",
+			policy:   config.PasswordPolicyConfig{MinSpecial: 1},
+			password: "pass word",
+			want:     []string{RuleMinSpecial},
+		},
+		{
+			name:     "complexity not met",
+			policy:   config.PasswordPolicyConfig{Complexity: 3},
+			password: "password1",
+			want:     []string{RuleComplexity},
+		},
+		{
+			name:     "complexity met",
+			policy:   config.PasswordPolicyConfig{Complexity: 3},
+			password: "Password1",
+		},
+		{
+			name:     "contains the login",
+			policy:   config.PasswordPolicyConfig{DiffLogin: true},
+			login:    "jdoe",
+			password: "myJDoe2024",
+			want:     []string{RuleDiffLogin},
+		},
+		{
+			name:     "diff_login without a login",
+			policy:   config.PasswordPolicyConfig{DiffLogin: true},
+			password: "myJDoe2024",
+		},
+		{
+			name:     "every violation reported",
+			policy:   config.PasswordPolicyConfig{MinLength: 12, MinDigit: 1, Complexity: 3, DiffLogin: true},
+			login:    "jdoe",
+			password: "jdoe",
+			want:     []string{RuleMinLength, RuleMinDigit, RuleComplexity, RuleDiffLogin},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewPasswordPolicy(tt.policy).Validate(tt.login, tt.password)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate = %v, want nil", err)
+				}
+				return
+			}
+
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("Validate = %v, want a *PolicyError", err)
+			}
+			var rules []string
+			for _, violation := range policyErr.Violations {
+				rules = append(rules, violation.Rule)
+			}
+			if !slices.Equal(rules, tt.want) {
+				t.Fatalf("violated rules = %v, want %v", rules, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyClassify(t *testing.T) {
+	tests := []struct {
+		name         string
+		specialChars string
+		password     string
+		want         CharacterClasses
+	}{
+		{name: "ASCII", password: "aB3$", want: CharacterClasses{Lower: 1, Upper: 1, Digit: 1, Special: 1}},
+		{name: "non-ASCII letters", password: "éÉ", want: CharacterClasses{Lower: 1, Upper: 1}},
+		{name: "restricted specials", specialChars: "!", password: "!?", want: CharacterClasses{Special: 1, Other: 1}},
+		{name: "space", password: " ", want: CharacterClasses{Other: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := NewPasswordPolicy(config.PasswordPolicyConfig{SpecialChars: tt.specialChars})
+			if got := policy.Classify(tt.password); got != tt.want {
+				t.Fatalf("Classify(%q) = %+v, want %+v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyEstimateStrength(t *testing.T) {
+	policy := NewPasswordPolicy(config.PasswordPolicyConfig{})
+
+	tests := []struct {
+		password string
+		score    int
+	}{
+		{password: "", score: 0},
+		{password: "aaaaaaaaaaaa", score: 0},
+		{password: "123456789012", score: 0},
+		{password: "Tr0ub4dor&3", score: 3},
+		{password: "correct horse battery staple", score: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			if got := policy.EstimateStrength(tt.password); got.Score != tt.score {
+				t.Fatalf("EstimateStrength(%q) = %+v, want score %d", tt.password, got, tt.score)
+			}
+		})
+	}
+}
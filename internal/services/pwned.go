@@ -0,0 +1,278 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"ldap-self-service/internal/config"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const RulePwned = "pwned"
+
+const pwnedPrefixLen = 5
+
+// PwnedPasswordChecker looks passwords up in a local copy of the Have I Been
+// Pwned corpus. Lookups are k-anonymity style: the SHA-1 of the password is
+// split into a 5 character prefix and a 35 character suffix, the range for
+// the prefix is read from disk and the suffix is matched within it, so the
+// full hash never needs to be held alongside the corpus.
+//
+// Two on-disk layouts are supported:
+//   - a single file of "HASH:COUNT" lines sorted by hash, as produced by the
+//     HIBP downloader; ranges are located by binary search, either through
+//     positioned reads or over a memory mapping of the file
+//   - a directory of range files named by prefix ("ABCDE" or "ABCDE.txt")
+//     containing "SUFFIX:COUNT" lines, mirroring the range API
+type PwnedPasswordChecker struct {
+	source   pwnedSource
+	minCount int
+}
+
+type pwnedSource interface {
+	// Range returns the count recorded for every suffix under prefix.
+	Range(prefix string) (map[string]int, error)
+	Close() error
+}
+
+// NewPwnedPasswordChecker opens the corpus configured in the password policy.
+// It returns nil when the check is disabled.
+func NewPwnedPasswordChecker(cfg config.PasswordPolicyConfig) (*PwnedPasswordChecker, error) {
+	if !cfg.UsePwnedPasswords {
+		return nil, nil
+	}
+	if cfg.PwnedPasswordsPath == "" {
+		return nil, fmt.Errorf("use_pwned_passwords is enabled but pwned_passwords_path is not set")
+	}
+
+	info, err := os.Stat(cfg.PwnedPasswordsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pwned passwords corpus: %w", err)
+	}
+
+	var source pwnedSource
+	if info.IsDir() {
+		source = &pwnedRangeDir{dir: cfg.PwnedPasswordsPath}
+	} else if cfg.PwnedPasswordsMmap {
+		source, err = openMappedHashFile(cfg.PwnedPasswordsPath)
+	} else {
+		source, err = openSortedHashFile(cfg.PwnedPasswordsPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pwned passwords corpus: %w", err)
+	}
+
+	minCount := cfg.PwnedPasswordsMinCount
+	if minCount < 1 {
+		minCount = 1
+	}
+
+	return &PwnedPasswordChecker{source: source, minCount: minCount}, nil
+}
+
+// Count returns how many times password appears in the corpus.
+func (c *PwnedPasswordChecker) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, err := c.source.Range(hash[:pwnedPrefixLen])
+	if err != nil {
+		return 0, err
+	}
+
+	return suffixes[hash[pwnedPrefixLen:]], nil
+}
+
+// Check returns a policy violation if password appears in the corpus at
+// least min_count times.
+func (c *PwnedPasswordChecker) Check(password string) (*PolicyViolation, error) {
+	count, err := c.Count(password)
+	if err != nil {
+		return nil, fmt.Errorf("breached password lookup failed: %w", err)
+	}
+
+	if count < c.minCount {
+		return nil, nil
+	}
+
+	return &PolicyViolation{
+		Rule:    RulePwned,
+		Message: fmt.Sprintf("password has appeared in a known data breach %d time(s) and cannot be used", count),
+	}, nil
+}
+
+func (c *PwnedPasswordChecker) Close() error {
+	return c.source.Close()
+}
+
+// parseHashLine splits a "HASH:COUNT" line. Lines without a count are
+// treated as having been seen once.
+func parseHashLine(line []byte) (string, int, bool) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return "", 0, false
+	}
+
+	hash, countStr, found := bytes.Cut(line, []byte(":"))
+	if !found {
+		return strings.ToUpper(string(hash)), 1, true
+	}
+
+	count, err := strconv.Atoi(string(countStr))
+	if err != nil {
+		return "", 0, false
+	}
+
+	return strings.ToUpper(string(hash)), count, true
+}
+
+type pwnedRangeDir struct {
+	dir string
+}
+
+func (d *pwnedRangeDir) Range(prefix string) (map[string]int, error) {
+	var file *os.File
+	var err error
+	for _, name := range []string{prefix, prefix + ".txt", strings.ToLower(prefix), strings.ToLower(prefix) + ".txt"} {
+		file, err = os.Open(filepath.Join(d.dir, name))
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]int{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	suffixes := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if suffix, count, ok := parseHashLine(scanner.Bytes()); ok {
+			suffixes[suffix] = count
+		}
+	}
+
+	return suffixes, scanner.Err()
+}
+
+func (d *pwnedRangeDir) Close() error {
+	return nil
+}
+
+// sortedHashFile binary searches a sorted "HASH:COUNT" file for the first
+// line of a range and then scans forward until the prefix changes.
+type sortedHashFile struct {
+	r      io.ReaderAt
+	size   int64
+	closer io.Closer
+}
+
+func openSortedHashFile(path string) (*sortedHashFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &sortedHashFile{r: file, size: info.Size(), closer: file}, nil
+}
+
+func (f *sortedHashFile) Range(prefix string) (map[string]int, error) {
+	start, err := f.search(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	suffixes := make(map[string]int)
+	scanner := bufio.NewScanner(io.NewSectionReader(f.r, start, f.size-start))
+	for scanner.Scan() {
+		hash, count, ok := parseHashLine(scanner.Bytes())
+		if !ok || len(hash) <= pwnedPrefixLen {
+			continue
+		}
+		switch linePrefix := hash[:pwnedPrefixLen]; {
+		case linePrefix < prefix:
+			continue
+		case linePrefix > prefix:
+			return suffixes, nil
+		}
+		suffixes[hash[pwnedPrefixLen:]] = count
+	}
+
+	return suffixes, scanner.Err()
+}
+
+// search returns the offset of a line at or shortly before the first line
+// whose hash starts with prefix. Every line before the returned offset sorts
+// strictly below prefix.
+func (f *sortedHashFile) search(prefix string) (int64, error) {
+	lo, hi := int64(0), f.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		next, linePrefix, err := f.nextLine(mid)
+		if err != nil {
+			return 0, err
+		}
+		if next >= f.size || linePrefix >= prefix {
+			hi = mid
+		} else {
+			lo = next
+		}
+	}
+	return lo, nil
+}
+
+// nextLine returns the offset and hash prefix of the first line starting
+// after off.
+func (f *sortedHashFile) nextLine(off int64) (int64, string, error) {
+	buf := make([]byte, 128)
+	for {
+		n, err := f.r.ReadAt(buf, off)
+		if n == 0 {
+			if err == io.EOF {
+				return f.size, "", nil
+			}
+			return 0, "", err
+		}
+
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			next := off + int64(i) + 1
+			head := make([]byte, pwnedPrefixLen)
+			m, err := f.r.ReadAt(head, next)
+			if m < pwnedPrefixLen {
+				if err == io.EOF {
+					return f.size, "", nil
+				}
+				return 0, "", err
+			}
+			return next, strings.ToUpper(string(head)), nil
+		}
+
+		if err == io.EOF {
+			return f.size, "", nil
+		}
+		off += int64(n)
+	}
+}
+
+func (f *sortedHashFile) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
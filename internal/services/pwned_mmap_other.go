@@ -0,0 +1,9 @@
+//go:build !unix
+
+package services
+
+// openMappedHashFile falls back to positioned reads on platforms without
+// mmap support.
+func openMappedHashFile(path string) (*sortedHashFile, error) {
+	return openSortedHashFile(path)
+}
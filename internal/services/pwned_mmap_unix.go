@@ -0,0 +1,55 @@
+//go:build unix
+
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+type mappedFile struct {
+	data []byte
+}
+
+func (m *mappedFile) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.data)
+	m.data = nil
+	return err
+}
+
+// openMappedHashFile maps a sorted hash file into memory so that range
+// searches are served from the page cache without read syscalls.
+func openMappedHashFile(path string) (*sortedHashFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return &sortedHashFile{r: bytes.NewReader(nil)}, nil
+	}
+	if int64(int(info.Size())) != info.Size() {
+		return nil, fmt.Errorf("%s is too large to memory-map on this platform", path)
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap failed: %w", err)
+	}
+
+	return &sortedHashFile{
+		r:      bytes.NewReader(data),
+		size:   int64(len(data)),
+		closer: &mappedFile{data: data},
+	}, nil
+}
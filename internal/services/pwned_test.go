@@ -0,0 +1,226 @@
+package services
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"ldap-self-service/internal/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// pwnedCorpus is the breached passwords of the tests and their counts.
+var pwnedCorpus = map[string]int{
+	"password":  9545824,
+	"123456":    37359195,
+	"letmein":   1010,
+	"hunter2":   3,
+	"rarelyset": 1,
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// writePwnedCorpus writes pwnedCorpus, padded with filler hashes so the
+// binary search has ranges on both sides, as a sorted hash file and as a
+// directory of range files. Lines end in CRLF like the HIBP downloads.
+func writePwnedCorpus(t *testing.T) (file, dir string) {
+	t.Helper()
+
+	counts := make(map[string]int)
+	for password, count := range pwnedCorpus {
+		counts[sha1Hex(password)] = count
+	}
+	for i := 0; i < 2000; i++ {
+		counts[sha1Hex(fmt.Sprintf("filler-%d", i))] = i + 1
+	}
+	// Extremes of the hash space.
+	counts["0000000000000000000000000000000000000000"] = 1
+	counts["FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"] = 1
+
+	hashes := make([]string, 0, len(counts))
+	for hash := range counts {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	root := t.TempDir()
+	dir = filepath.Join(root, "ranges")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	var sorted strings.Builder
+	ranges := make(map[string]*strings.Builder)
+	for _, hash := range hashes {
+		fmt.Fprintf(&sorted, "%s:%d\r\n", hash, counts[hash])
+		prefix := hash[:pwnedPrefixLen]
+		if ranges[prefix] == nil {
+			ranges[prefix] = &strings.Builder{}
+		}
+		fmt.Fprintf(ranges[prefix], "%s:%d\r\n", hash[pwnedPrefixLen:], counts[hash])
+	}
+
+	file = filepath.Join(root, "pwned.txt")
+	if err := os.WriteFile(file, []byte(sorted.String()), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	for prefix, lines := range ranges {
+		if err := os.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(lines.String()), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	return file, dir
+}
+
+func TestPwnedPasswordCheckerCount(t *testing.T) {
+	file, dir := writePwnedCorpus(t)
+
+	layouts := map[string]config.PasswordPolicyConfig{
+		"sorted file": {PwnedPasswordsPath: file},
+		"mapped file": {PwnedPasswordsPath: file, PwnedPasswordsMmap: true},
+		"range dir":   {PwnedPasswordsPath: dir},
+	}
+
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{password: "password", want: 9545824},
+		{password: "123456", want: 37359195},
+		{password: "letmein", want: 1010},
+		{password: "hunter2", want: 3},
+		{password: "rarelyset", want: 1},
+		{password: "filler-0", want: 1},
+		{password: "filler-1999", want: 2000},
+		{password: "correct horse battery staple", want: 0},
+		{password: "", want: 0},
+	}
+
+	for name, cfg := range layouts {
+		t.Run(name, func(t *testing.T) {
+			cfg.UsePwnedPasswords = true
+			checker, err := NewPwnedPasswordChecker(cfg)
+			if err != nil {
+				t.Fatalf("NewPwnedPasswordChecker: %v", err)
+			}
+			defer checker.Close()
+
+			for _, tt := range tests {
+				got, err := checker.Count(tt.password)
+				if err != nil {
+					t.Fatalf("Count(%q): %v", tt.password, err)
+				}
+				if got != tt.want {
+					t.Errorf("Count(%q) = %d, want %d", tt.password, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPwnedPasswordCheckerMinCount(t *testing.T) {
+	file, _ := writePwnedCorpus(t)
+
+	tests := []struct {
+		name      string
+		minCount  int
+		password  string
+		violation bool
+	}{
+		{name: "default minimum", password: "rarelyset", violation: true},
+		{name: "below minimum", minCount: 10, password: "hunter2"},
+		{name: "at minimum", minCount: 3, password: "hunter2", violation: true},
+		{name: "not breached", minCount: 1, password: "correct horse battery staple"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker, err := NewPwnedPasswordChecker(config.PasswordPolicyConfig{
+				UsePwnedPasswords:      true,
+				PwnedPasswordsPath:     file,
+				PwnedPasswordsMinCount: tt.minCount,
+			})
+			if err != nil {
+				t.Fatalf("NewPwnedPasswordChecker: %v", err)
+			}
+			defer checker.Close()
+
+			violation, err := checker.Check(tt.password)
+			if err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			if (violation != nil) != tt.violation {
+				t.Fatalf("Check(%q) = %+v, want violation %v", tt.password, violation, tt.violation)
+			}
+			if violation != nil && violation.Rule != RulePwned {
+				t.Fatalf("violation rule = %q, want %q", violation.Rule, RulePwned)
+			}
+		})
+	}
+}
+
+func TestPwnedPasswordCheckerConfig(t *testing.T) {
+	checker, err := NewPwnedPasswordChecker(config.PasswordPolicyConfig{})
+	if err != nil || checker != nil {
+		t.Fatalf("NewPwnedPasswordChecker(disabled) = %v, %v; want nil, nil", checker, err)
+	}
+
+	if _, err := NewPwnedPasswordChecker(config.PasswordPolicyConfig{UsePwnedPasswords: true}); err == nil {
+		t.Fatal("NewPwnedPasswordChecker accepted a missing path")
+	}
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	if _, err := NewPwnedPasswordChecker(config.PasswordPolicyConfig{UsePwnedPasswords: true, PwnedPasswordsPath: missing}); err == nil {
+		t.Fatal("NewPwnedPasswordChecker accepted a missing corpus")
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.txt")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	for _, mmap := range []bool{false, true} {
+		checker, err := NewPwnedPasswordChecker(config.PasswordPolicyConfig{UsePwnedPasswords: true, PwnedPasswordsPath: empty, PwnedPasswordsMmap: mmap})
+		if err != nil {
+			t.Fatalf("NewPwnedPasswordChecker(empty, mmap %v): %v", mmap, err)
+		}
+		if count, err := checker.Count("password"); err != nil || count != 0 {
+			t.Fatalf("Count on an empty corpus = %d, %v; want 0, nil", count, err)
+		}
+		checker.Close()
+	}
+}
+
+func TestSortedHashFileRangeEdges(t *testing.T) {
+	file, _ := writePwnedCorpus(t)
+
+	source, err := openSortedHashFile(file)
+	if err != nil {
+		t.Fatalf("openSortedHashFile: %v", err)
+	}
+	defer source.Close()
+
+	tests := []struct {
+		prefix string
+		suffix string
+	}{
+		{prefix: "00000", suffix: strings.Repeat("0", 35)},
+		{prefix: "FFFFF", suffix: strings.Repeat("F", 35)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			suffixes, err := source.Range(tt.prefix)
+			if err != nil {
+				t.Fatalf("Range: %v", err)
+			}
+			if suffixes[tt.suffix] != 1 {
+				t.Fatalf("Range(%s) = %v, want %s", tt.prefix, suffixes, tt.suffix)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package services
+
+import (
+	"fmt"
+	"ldap-self-service/internal/config"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitStore holds limiter state. A shared store lets every replica
+// enforce the same limits.
+type RateLimitStore interface {
+	// TakeToken removes a token from the bucket at key, which holds up to
+	// burst tokens and regains one every interval. When the bucket is
+	// empty it returns how long until the next token is available.
+	TakeToken(key string, burst int, interval time.Duration) (time.Duration, error)
+	// ReturnToken puts back a token taken from the bucket at key, up to
+	// burst tokens.
+	ReturnToken(key string, burst int) error
+	// Increment adds one to the counter at key, which resets window after
+	// its first increment, and returns the new count and the time left.
+	Increment(key string, window time.Duration) (int, time.Duration, error)
+}
+
+// RateLimiter applies the configured abuse limits to reset-code sending:
+// token buckets per client IP, username and destination, a minimum interval
+// between codes for the same user, and a daily cap per user.
+type RateLimiter struct {
+	config config.RateLimitConfig
+	store  RateLimitStore
+}
+
+// NewRateLimiter returns nil when rate limiting is disabled; a nil
+// *RateLimiter allows everything.
+func NewRateLimiter(cfg *config.Config) (*RateLimiter, error) {
+	rateCfg := cfg.RateLimit
+	if !rateCfg.Enabled {
+		return nil, nil
+	}
+
+	var store RateLimitStore
+	switch rateCfg.Store {
+	case "", VerificationStoreMemory:
+		store = NewMemoryRateLimitStore()
+	case VerificationStoreRedis:
+		var err error
+		store, err = NewRedisRateLimitStore(rateCfg.RedisURL, rateCfg.KeyPrefix)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported rate limit store: %s", rateCfg.Store)
+	}
+
+	return &RateLimiter{config: rateCfg, store: store}, nil
+}
+
+// AllowIP takes a token from the client address's bucket.
+func (l *RateLimiter) AllowIP(ip string) error {
+	if l == nil {
+		return nil
+	}
+	if wait, _ := l.take("ip:"+ip, l.config.IP); wait > 0 {
+		return &ThrottleError{Message: "too many requests, try again later", RetryAfter: wait}
+	}
+	return nil
+}
+
+// sendLimit is one of the buckets AllowSend takes from.
+type sendLimit struct {
+	key     string
+	bucket  config.RateBucket
+	message string
+}
+
+// AllowSend checks every per-user and per-destination limit before a code
+// is sent to destination for username. Tokens are only spent when every
+// check passes: those taken before a check fails are returned, so refused
+// requests can't exhaust a user's quota and lock them out of resets.
+func (l *RateLimiter) AllowSend(username, destination string) error {
+	if l == nil {
+		return nil
+	}
+
+	username = strings.ToLower(strings.TrimSpace(username))
+	destination = strings.ToLower(strings.TrimSpace(destination))
+
+	limits := []sendLimit{
+		{"user:" + username, l.config.Username, "too many codes requested for this account, try again later"},
+		{"destination:" + destination, l.config.Destination, "too many codes sent to this destination, try again later"},
+		// A bucket holding a single token is exactly a minimum interval.
+		{"resend:" + username, config.RateBucket{Burst: 1, Interval: l.config.ResendInterval}, "a code was sent recently, wait before requesting another"},
+	}
+
+	var taken []sendLimit
+	for _, limit := range limits {
+		wait, took := l.take(limit.key, limit.bucket)
+		if wait > 0 {
+			l.giveBack(taken)
+			return &ThrottleError{Message: limit.message, RetryAfter: wait}
+		}
+		if took {
+			taken = append(taken, limit)
+		}
+	}
+
+	if l.config.DailyCap > 0 {
+		count, reset, err := l.store.Increment("daily:"+username, 24*time.Hour)
+		if err != nil {
+			log.Printf("Rate limiter unavailable, allowing request: %v", err)
+			return nil
+		}
+		if count > l.config.DailyCap {
+			l.giveBack(taken)
+			log.Printf("SECURITY: daily reset code cap of %d reached for %s", l.config.DailyCap, username)
+			return &ThrottleError{Message: "too many codes requested today, try again later", RetryAfter: reset}
+		}
+	}
+
+	return nil
+}
+
+// take returns how long to wait before bucket has a token for key, and
+// whether a token was taken. It fails open when the store is unreachable:
+// an outage of the limiter should not stop users from resetting their
+// passwords.
+func (l *RateLimiter) take(key string, bucket config.RateBucket) (time.Duration, bool) {
+	if bucket.Burst <= 0 || bucket.Interval <= 0 {
+		return 0, false
+	}
+
+	wait, err := l.store.TakeToken(key, bucket.Burst, time.Duration(bucket.Interval)*time.Second)
+	if err != nil {
+		log.Printf("Rate limiter unavailable, allowing request: %v", err)
+		return 0, false
+	}
+	return wait, wait == 0
+}
+
+// giveBack returns the tokens taken for a request that was refused.
+func (l *RateLimiter) giveBack(taken []sendLimit) {
+	for _, limit := range taken {
+		err := l.store.ReturnToken(limit.key, limit.bucket.Burst)
+		if err != nil {
+			log.Printf("Failed to return rate limit token: %v", err)
+		}
+	}
+}
+
+// memoryRateLimitStore keeps limiter state in process.
+type memoryRateLimitStore struct {
+	mutex    sync.Mutex
+	buckets  map[string]*tokenBucket
+	counters map[string]*windowCounter
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	expires time.Time
+}
+
+type windowCounter struct {
+	count   int
+	resetAt time.Time
+}
+
+func NewMemoryRateLimitStore() RateLimitStore {
+	store := &memoryRateLimitStore{
+		buckets:  make(map[string]*tokenBucket),
+		counters: make(map[string]*windowCounter),
+	}
+
+	go store.cleanup()
+	return store
+}
+
+func (s *memoryRateLimitStore) TakeToken(key string, burst int, interval time.Duration) (time.Duration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), updated: now}
+		s.buckets[key] = bucket
+	}
+
+	elapsed := now.Sub(bucket.updated)
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+float64(elapsed)/float64(interval))
+	bucket.updated = now
+	// A bucket that has refilled completely carries no state.
+	bucket.expires = now.Add(time.Duration(burst) * interval)
+
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) * float64(interval)), nil
+	}
+	bucket.tokens--
+	return 0, nil
+}
+
+func (s *memoryRateLimitStore) ReturnToken(key string, burst int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if bucket, ok := s.buckets[key]; ok {
+		bucket.tokens = math.Min(float64(burst), bucket.tokens+1)
+	}
+	return nil
+}
+
+func (s *memoryRateLimitStore) Increment(key string, window time.Duration) (int, time.Duration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	counter, ok := s.counters[key]
+	if !ok || !now.Before(counter.resetAt) {
+		counter = &windowCounter{resetAt: now.Add(window)}
+		s.counters[key] = counter
+	}
+
+	counter.count++
+	return counter.count, counter.resetAt.Sub(now), nil
+}
+
+func (s *memoryRateLimitStore) cleanup() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mutex.Lock()
+		now := time.Now()
+		for key, bucket := range s.buckets {
+			if now.After(bucket.expires) {
+				delete(s.buckets, key)
+			}
+		}
+		for key, counter := range s.counters {
+			if !now.Before(counter.resetAt) {
+				delete(s.counters, key)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeTokenScript refills and takes from a bucket stored as a hash in one
+// atomic step. It returns the milliseconds to wait, or 0 when a token was
+// taken.
+var takeTokenScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(state[1])
+local updated = tonumber(state[2])
+if tokens == nil or updated == nil then
+	tokens = burst
+	updated = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - updated) / interval)
+local wait = 0
+if tokens < 1 then
+	wait = math.ceil((1 - tokens) * interval)
+else
+	tokens = tokens - 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(now))
+redis.call("PEXPIRE", KEYS[1], burst * interval)
+return wait
+`)
+
+// returnTokenScript adds a token back to an existing bucket, up to burst.
+var returnTokenScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+if tokens ~= nil then
+	redis.call("HSET", KEYS[1], "tokens", tostring(math.min(burst, tokens + 1)))
+end
+return 0
+`)
+
+// incrementScript increments a counter and starts its window on first use.
+// It returns the count and the milliseconds left in the window.
+var incrementScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {count, redis.call("PTTL", KEYS[1])}
+`)
+
+// redisRateLimitStore keeps limiter state in Redis so that replicas share
+// it. Buckets and counters expire through key TTLs.
+type redisRateLimitStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisRateLimitStore(redisURL, prefix string) (RateLimitStore, error) {
+	client, err := connectRedis(redisURL, "rate_limit.redis_url")
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisRateLimitStore{client: client, prefix: prefix + "ratelimit:"}, nil
+}
+
+func (s *redisRateLimitStore) TakeToken(key string, burst int, interval time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	wait, err := takeTokenScript.Run(ctx, s.client, []string{s.prefix + key},
+		burst, interval.Milliseconds(), time.Now().UnixMilli()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+func (s *redisRateLimitStore) ReturnToken(key string, burst int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return returnTokenScript.Run(ctx, s.client, []string{s.prefix + key}, burst).Err()
+}
+
+func (s *redisRateLimitStore) Increment(key string, window time.Duration) (int, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := incrementScript.Run(ctx, s.client, []string{s.prefix + key}, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(result[0]), time.Duration(result[1]) * time.Millisecond, nil
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"errors"
+	"ldap-self-service/internal/config"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func rateLimitStores(t *testing.T) map[string]RateLimitStore {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	redis, err := NewRedisRateLimitStore("redis://"+server.Addr(), "test:")
+	if err != nil {
+		t.Fatalf("NewRedisRateLimitStore: %v", err)
+	}
+
+	return map[string]RateLimitStore{
+		VerificationStoreMemory: NewMemoryRateLimitStore(),
+		VerificationStoreRedis:  redis,
+	}
+}
+
+func TestAllowSendRefusedRequestsKeepQuota(t *testing.T) {
+	for name, store := range rateLimitStores(t) {
+		t.Run(name, func(t *testing.T) {
+			limiter := &RateLimiter{
+				store: store,
+				config: config.RateLimitConfig{
+					Username:       config.RateBucket{Burst: 2, Interval: 3600},
+					Destination:    config.RateBucket{Burst: 10, Interval: 3600},
+					ResendInterval: 3600,
+				},
+			}
+
+			if err := limiter.AllowSend("alice", "alice@example.com"); err != nil {
+				t.Fatalf("first send: %v", err)
+			}
+
+			// Requests refused by the resend interval must not use up
+			// the account's bucket.
+			for i := 0; i < 5; i++ {
+				var throttle *ThrottleError
+				if err := limiter.AllowSend("alice", "alice@example.com"); !errors.As(err, &throttle) {
+					t.Fatalf("send within the resend interval = %v, want a *ThrottleError", err)
+				}
+			}
+
+			if err := store.ReturnToken("resend:alice", 1); err != nil {
+				t.Fatalf("ReturnToken: %v", err)
+			}
+			if err := limiter.AllowSend("alice", "alice@example.com"); err != nil {
+				t.Fatalf("second send after the resend interval: %v", err)
+			}
+		})
+	}
+}
+
+func TestAllowSendLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  config.RateLimitConfig
+		sends   []string
+		refused int
+	}{
+		{
+			name:    "username bucket",
+			config:  config.RateLimitConfig{Username: config.RateBucket{Burst: 2, Interval: 3600}},
+			sends:   []string{"a@example.com", "b@example.com", "c@example.com"},
+			refused: 2,
+		},
+		{
+			name:    "destination bucket",
+			config:  config.RateLimitConfig{Destination: config.RateBucket{Burst: 1, Interval: 3600}},
+			sends:   []string{"a@example.com", "a@example.com", "b@example.com"},
+			refused: 1,
+		},
+		{
+			name:    "daily cap",
+			config:  config.RateLimitConfig{DailyCap: 1},
+			sends:   []string{"a@example.com", "b@example.com"},
+			refused: 1,
+		},
+		{
+			name:    "no limits",
+			sends:   []string{"a@example.com", "a@example.com", "a@example.com"},
+			refused: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &RateLimiter{config: tt.config, store: NewMemoryRateLimitStore()}
+			for i, destination := range tt.sends {
+				err := limiter.AllowSend("alice", destination)
+				if want := i == tt.refused; (err != nil) != want {
+					t.Fatalf("send %d to %s = %v, want refused %v", i, destination, err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Key prefixes for token state in the verification store.
+const (
+	refreshTokenPrefix = "refresh:"
+	revokedTokenPrefix = "revoked-token:"
+	revokedUserPrefix  = "revoked-user:"
+)
+
+// errRefreshTokenReused aborts the rotation of a refresh token that was
+// already rotated.
+var errRefreshTokenReused = errors.New("refresh token reused")
+
+// sessionTouchInterval is how often a session's last-seen time is written.
+const sessionTouchInterval = time.Minute
+
+// TokenPair is a full session: an access token for the API and a refresh
+// token that exchanges it for a new pair when it expires.
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+// refreshState is a refresh token's record. Refresh tokens are opaque and
+// stored by hash; a rotated token is kept until it expires so presenting it
+// again is recognised as reuse.
+type refreshState struct {
+	SessionID string    `json:"sessionId"`
+	IssuedAt  time.Time `json:"issuedAt"`
+	Rotated   bool      `json:"rotated,omitempty"`
+}
+
+// GenerateSession starts a full session for the user, recording the
+// client it was started from.
+func (s *AuthService) GenerateSession(username, dn, userAgent, ip string) (*TokenPair, error) {
+	sessionID, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	err = s.sessions.Put(&Session{
+		ID:         sessionID,
+		Username:   username,
+		DN:         dn,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.maxTokenLifetime()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.issuePair(username, dn, sessionID)
+}
+
+// Refresh exchanges refreshToken for a new pair in the same session. Each
+// refresh token works once: presenting a rotated one means it was copied,
+// so the whole session is revoked. The token is marked rotated with an
+// atomic update of the store, so only one of any concurrent refreshes, on
+// any replica, wins.
+func (s *AuthService) Refresh(refreshToken string) (*TokenPair, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := refreshTokenPrefix + hashRefreshToken(refreshToken)
+	var record *VerificationCode
+	var state refreshState
+	err := s.store.Update(key, func(current *VerificationCode) (*VerificationCode, error) {
+		if current == nil {
+			return nil, ErrInvalidToken
+		}
+		record, state = current, refreshState{}
+		if err := json.Unmarshal([]byte(current.Data), &state); err != nil {
+			return nil, fmt.Errorf("invalid refresh token data: %w", err)
+		}
+		if state.Rotated {
+			return nil, errRefreshTokenReused
+		}
+
+		rotated := state
+		rotated.Rotated = true
+		data, err := json.Marshal(rotated)
+		if err != nil {
+			return nil, err
+		}
+		updated := *current
+		updated.Data = string(data)
+		return &updated, nil
+	})
+	if errors.Is(err, errRefreshTokenReused) {
+		log.Printf("SECURITY: refresh token reused for %s, revoking session", record.Username)
+		if err := s.revokeSession(state.SessionID); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff, err := s.userCutoff(record.DN)
+	if err != nil {
+		return nil, err
+	}
+	if revokedBy(state.IssuedAt, cutoff) {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+	session, err := s.sessions.Update(state.SessionID, func(session *Session) {
+		session.LastSeenAt = now
+		session.ExpiresAt = now.Add(s.maxTokenLifetime())
+	})
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, ErrInvalidToken
+	}
+
+	return s.issuePair(record.Username, record.DN, state.SessionID)
+}
+
+// Revoke invalidates the token described by claims until it expires, and
+// its session when it has one.
+func (s *AuthService) Revoke(claims *Claims) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if claims.ExpiresAt != nil {
+		if err := s.store.Put(revokedTokenPrefix+claims.ID, &VerificationCode{
+			Token:     claims.ID,
+			Username:  claims.Username,
+			ExpiresAt: claims.ExpiresAt.Time,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if claims.SessionID == "" {
+		return nil
+	}
+	return s.revokeSession(claims.SessionID)
+}
+
+// RevokeUser invalidates every token issued to userDN so far, e.g. after
+// the password changes, and ends their sessions.
+func (s *AuthService) RevokeUser(userDN string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().Truncate(tokenTimePrecision)
+	err := s.store.Put(revokedUserPrefix+normalizeDN(userDN), &VerificationCode{
+		DN:        userDN,
+		ExpiresAt: now.Add(s.maxTokenLifetime()),
+		Data:      now.Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return err
+	}
+	// Tokens issued in the cutoff's own tick count as revoked; make sure
+	// this replica's next token, e.g. from the login after a password
+	// change, falls in a later one.
+	if wait := time.Until(now.Add(tokenTimePrecision)); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	sessions, err := s.sessions.List(userDN)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if err := s.revokeSession(session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sessions returns userDN's active sessions, most recently used first.
+func (s *AuthService) Sessions(userDN string) ([]*Session, error) {
+	sessions, err := s.sessions.List(userDN)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+// RevokeSession signs userDN out of one of their sessions. Sessions of other
+// users are reported as not found.
+func (s *AuthService) RevokeSession(userDN, sessionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session, err := s.sessions.Get(sessionID)
+	if err != nil {
+		return err
+	}
+	if session == nil || normalizeDN(session.DN) != normalizeDN(userDN) {
+		return ErrSessionNotFound
+	}
+	return s.revokeSession(sessionID)
+}
+
+// TouchSession records that a session was just used from ip. Writes are
+// throttled to one per sessionTouchInterval per session.
+func (s *AuthService) TouchSession(sessionID, ip string) error {
+	now := time.Now()
+
+	s.touchMutex.Lock()
+	if last, ok := s.touched[sessionID]; ok && now.Sub(last) < sessionTouchInterval {
+		s.touchMutex.Unlock()
+		return nil
+	}
+	for id, last := range s.touched {
+		if now.Sub(last) >= sessionTouchInterval {
+			delete(s.touched, id)
+		}
+	}
+	s.touched[sessionID] = now
+	s.touchMutex.Unlock()
+
+	// An atomic update, so a sign-out on another replica isn't undone.
+	_, err := s.sessions.Update(sessionID, func(session *Session) {
+		session.LastSeenAt = now
+		session.IP = ip
+	})
+	return err
+}
+
+func (s *AuthService) issuePair(username, dn, sessionID string) (*TokenPair, error) {
+	ttl := time.Duration(s.config.JWT.Expiration) * time.Second
+	accessToken, err := s.sign(&Claims{Username: username, DN: dn, SessionID: sessionID}, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	record := &VerificationCode{
+		Token:     sessionID,
+		Channel:   "refresh",
+		Username:  username,
+		DN:        dn,
+		ExpiresAt: now.Add(time.Duration(s.config.JWT.RefreshExpiration) * time.Second),
+	}
+	state := refreshState{SessionID: sessionID, IssuedAt: now}
+	if err := s.putRefreshState(refreshTokenPrefix+hashRefreshToken(refreshToken), record, state); err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{AccessToken: accessToken, RefreshToken: refreshToken, ExpiresAt: now.Add(ttl)}, nil
+}
+
+func (s *AuthService) putRefreshState(key string, record *VerificationCode, state refreshState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	record.Data = string(data)
+	return s.store.Put(key, record)
+}
+
+// revokeSession ends a session. Its access tokens fail validation and its
+// refresh tokens are refused once the session is gone.
+func (s *AuthService) revokeSession(sessionID string) error {
+	s.touchMutex.Lock()
+	delete(s.touched, sessionID)
+	s.touchMutex.Unlock()
+
+	return s.sessions.Delete(sessionID)
+}
+
+// userCutoff returns when userDN's tokens were last revoked, or the zero
+// time.
+func (s *AuthService) userCutoff(userDN string) (time.Time, error) {
+	record, err := s.store.Get(revokedUserPrefix + normalizeDN(userDN))
+	if err != nil || record == nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, record.Data)
+}
+
+// revokedBy reports whether a token issued at issuedAt is revoked by a
+// user cutoff, comparing both at tokenTimePrecision.
+func revokedBy(issuedAt, cutoff time.Time) bool {
+	return !cutoff.IsZero() && !issuedAt.Truncate(tokenTimePrecision).After(cutoff)
+}
+
+// maxTokenLifetime bounds how long a revocation has to be remembered.
+func (s *AuthService) maxTokenLifetime() time.Duration {
+	lifetime := s.config.JWT.Expiration
+	if s.config.JWT.RefreshExpiration > lifetime {
+		lifetime = s.config.JWT.RefreshExpiration
+	}
+	return time.Duration(lifetime) * time.Second
+}
+
+// hashRefreshToken keeps refresh tokens out of the store, which may be
+// shared, in usable form.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
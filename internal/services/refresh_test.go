@@ -0,0 +1,212 @@
+package services
+
+import (
+	"errors"
+	"ldap-self-service/internal/config"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowReadStore widens the gap between reading a record and writing it
+// back, so a rotation that isn't atomic loses the race.
+type slowReadStore struct {
+	VerificationStore
+}
+
+func (s slowReadStore) Get(key string) (*VerificationCode, error) {
+	code, err := s.VerificationStore.Get(key)
+	time.Sleep(10 * time.Millisecond)
+	return code, err
+}
+
+// authReplicas returns two AuthServices sharing store and a session store,
+// as replicas behind a load balancer would.
+func authReplicas(t *testing.T, store VerificationStore) (*AuthService, *AuthService) {
+	t.Helper()
+
+	cfg := &config.Config{JWT: config.JWTConfig{Secret: "test-secret", Expiration: 300, RefreshExpiration: 3600}}
+	sessions := NewMemorySessionStore()
+	replicas := make([]*AuthService, 2)
+	for i := range replicas {
+		service, err := NewAuthService(cfg, store, sessions)
+		if err != nil {
+			t.Fatalf("NewAuthService: %v", err)
+		}
+		replicas[i] = service
+	}
+	return replicas[0], replicas[1]
+}
+
+func TestRefreshRotation(t *testing.T) {
+	for name, store := range verificationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			first, second := authReplicas(t, store)
+
+			pair, err := first.GenerateSession("alice", "uid=alice,dc=example,dc=com", "test", "127.0.0.1")
+			if err != nil {
+				t.Fatalf("GenerateSession: %v", err)
+			}
+
+			rotated, err := second.Refresh(pair.RefreshToken)
+			if err != nil {
+				t.Fatalf("Refresh: %v", err)
+			}
+			if rotated.RefreshToken == pair.RefreshToken {
+				t.Fatal("Refresh returned the same refresh token")
+			}
+			claims, err := first.ValidateToken(rotated.AccessToken)
+			if err != nil {
+				t.Fatalf("ValidateToken: %v", err)
+			}
+			if claims.Username != "alice" || claims.SessionID == "" {
+				t.Fatalf("claims = %+v, want alice's session", claims)
+			}
+
+			if _, err := first.Refresh("unknown"); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("Refresh(unknown) = %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestRefreshReuseRevokesSession(t *testing.T) {
+	for name, store := range verificationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			first, second := authReplicas(t, store)
+
+			pair, err := first.GenerateSession("alice", "uid=alice,dc=example,dc=com", "test", "127.0.0.1")
+			if err != nil {
+				t.Fatalf("GenerateSession: %v", err)
+			}
+			rotated, err := first.Refresh(pair.RefreshToken)
+			if err != nil {
+				t.Fatalf("Refresh: %v", err)
+			}
+
+			// The old token presented again, at the other replica.
+			if _, err := second.Refresh(pair.RefreshToken); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("reused Refresh = %v, want %v", err, ErrInvalidToken)
+			}
+
+			if _, err := first.Refresh(rotated.RefreshToken); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("Refresh after reuse = %v, want %v", err, ErrInvalidToken)
+			}
+			if _, err := first.ValidateToken(rotated.AccessToken); err == nil {
+				t.Fatal("ValidateToken accepted an access token of the revoked session")
+			}
+		})
+	}
+}
+
+func TestRefreshConcurrentRotation(t *testing.T) {
+	for name, store := range verificationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			first, second := authReplicas(t, slowReadStore{store})
+
+			pair, err := first.GenerateSession("alice", "uid=alice,dc=example,dc=com", "test", "127.0.0.1")
+			if err != nil {
+				t.Fatalf("GenerateSession: %v", err)
+			}
+
+			const racers = 10
+			var wg sync.WaitGroup
+			var mutex sync.Mutex
+			var succeeded []*TokenPair
+			for i := 0; i < racers; i++ {
+				replica := first
+				if i%2 == 1 {
+					replica = second
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rotated, err := replica.Refresh(pair.RefreshToken)
+					if err == nil {
+						mutex.Lock()
+						succeeded = append(succeeded, rotated)
+						mutex.Unlock()
+					} else if !errors.Is(err, ErrInvalidToken) {
+						t.Errorf("Refresh: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if len(succeeded) > 1 {
+				t.Fatalf("%d concurrent refreshes succeeded, want at most 1", len(succeeded))
+			}
+			// The losers presented a rotated token, which revokes the
+			// session, even if the winner's write came last.
+			for _, rotated := range succeeded {
+				if _, err := first.ValidateToken(rotated.AccessToken); err == nil {
+					t.Fatal("the session survived the reuse of its refresh token")
+				}
+			}
+		})
+	}
+}
+
+func TestRefreshAfterRevokeUser(t *testing.T) {
+	service, _ := authReplicas(t, NewMemoryVerificationStore())
+
+	pair, err := service.GenerateSession("alice", "uid=alice,dc=example,dc=com", "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("GenerateSession: %v", err)
+	}
+	if err := service.RevokeUser("uid=alice,dc=example,dc=com"); err != nil {
+		t.Fatalf("RevokeUser: %v", err)
+	}
+	if _, err := service.Refresh(pair.RefreshToken); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Refresh after RevokeUser = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+// TestLoginAfterRevokeUser logs in again straight after RevokeUser, as the
+// portal does after a password change, within the same second.
+func TestLoginAfterRevokeUser(t *testing.T) {
+	const dn = "uid=alice,dc=example,dc=com"
+	service, _ := authReplicas(t, NewMemoryVerificationStore())
+
+	for i := 0; i < 20; i++ {
+		old, err := service.GenerateSession("alice", dn, "test", "127.0.0.1")
+		if err != nil {
+			t.Fatalf("GenerateSession: %v", err)
+		}
+		oldScoped, err := service.GenerateScopedToken("alice", dn, ScopePasswordChange, time.Minute)
+		if err != nil {
+			t.Fatalf("GenerateScopedToken: %v", err)
+		}
+		if err := service.RevokeUser(dn); err != nil {
+			t.Fatalf("RevokeUser: %v", err)
+		}
+
+		pair, err := service.GenerateSession("alice", dn, "test", "127.0.0.1")
+		if err != nil {
+			t.Fatalf("GenerateSession: %v", err)
+		}
+		if _, err := service.ValidateToken(pair.AccessToken); err != nil {
+			t.Fatalf("ValidateToken of the new session: %v", err)
+		}
+		scoped, err := service.GenerateScopedToken("alice", dn, ScopePasswordChange, time.Minute)
+		if err != nil {
+			t.Fatalf("GenerateScopedToken: %v", err)
+		}
+		if _, err := service.ValidateToken(scoped); err != nil {
+			t.Fatalf("ValidateToken of a new scoped token: %v", err)
+		}
+		if _, err := service.Refresh(pair.RefreshToken); err != nil {
+			t.Fatalf("Refresh of the new session: %v", err)
+		}
+
+		if _, err := service.ValidateToken(old.AccessToken); err == nil {
+			t.Fatal("ValidateToken accepted a token issued before RevokeUser")
+		}
+		if _, err := service.ValidateToken(oldScoped); err == nil {
+			t.Fatal("ValidateToken accepted a scoped token issued before RevokeUser")
+		}
+		if _, err := service.Refresh(old.RefreshToken); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("Refresh of a revoked session = %v, want %v", err, ErrInvalidToken)
+		}
+	}
+}
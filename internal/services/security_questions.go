@@ -0,0 +1,213 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ldap-self-service/internal/config"
+	"ldap-self-service/internal/models"
+	"log"
+	"math/big"
+	"strings"
+)
+
+// SecurityQuestionService lets users enroll answers to security questions
+// and serves them as the "questions" reset channel. Answers are normalized
+// and stored as Argon2id hashes, never in the clear.
+//
+// Guessing is limited by the ChallengeManager like any other channel: a
+// wrong set of answers counts as a wrong code.
+type SecurityQuestionService struct {
+	config config.SecurityQuestionConfig
+	store  UserDataStore
+}
+
+// enrolledAnswer is how an answer is stored.
+type enrolledAnswer struct {
+	Question string `json:"question"`
+	Hash     string `json:"hash"`
+}
+
+func NewSecurityQuestionService(cfg *config.Config, ldapService *LDAPService) (*SecurityQuestionService, error) {
+	questions := cfg.SecurityQuestions
+	if len(questions.Questions) < questions.MinEnrolled {
+		return nil, fmt.Errorf("security_questions lists %d questions but min_enrolled is %d", len(questions.Questions), questions.MinEnrolled)
+	}
+	if questions.Ask < 1 || questions.Ask > questions.MinEnrolled {
+		return nil, errors.New("security_questions.ask must be between 1 and min_enrolled")
+	}
+	// The questions are only known once the user has been looked up, which
+	// anti-enumeration mode defers until after the response.
+	if cfg.Reset.AntiEnumeration {
+		return nil, errors.New("security questions cannot be used with reset.anti_enumeration")
+	}
+
+	store, err := NewUserDataStore(ldapService, questions.Attribute, questions.StoreFile, "security_questions")
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecurityQuestionService{config: questions, store: store}, nil
+}
+
+// Catalog returns the questions users can choose from.
+func (s *SecurityQuestionService) Catalog() []string {
+	return s.config.Questions
+}
+
+// MinEnrolled is how many questions a user has to answer.
+func (s *SecurityQuestionService) MinEnrolled() int {
+	return s.config.MinEnrolled
+}
+
+// Enrolled returns the questions userDN has answered.
+func (s *SecurityQuestionService) Enrolled(userDN string) ([]string, error) {
+	answers, err := s.load(userDN)
+	if err != nil {
+		return nil, err
+	}
+
+	questions := make([]string, 0, len(answers))
+	for _, answer := range answers {
+		questions = append(questions, answer.Question)
+	}
+	return questions, nil
+}
+
+// Enroll replaces userDN's answers. Every question must come from the
+// catalog, and at least MinEnrolled distinct questions must be answered.
+func (s *SecurityQuestionService) Enroll(userDN string, answers []models.SecurityAnswer) error {
+	if len(answers) < s.config.MinEnrolled {
+		return invalidRequest(fmt.Sprintf("answer at least %d security questions", s.config.MinEnrolled), nil)
+	}
+
+	seen := make(map[string]bool)
+	records := make([]enrolledAnswer, 0, len(answers))
+	for _, answer := range answers {
+		if !s.inCatalog(answer.Question) {
+			return invalidRequest(fmt.Sprintf("unknown security question: %q", answer.Question), nil)
+		}
+		if seen[answer.Question] {
+			return invalidRequest(fmt.Sprintf("security question answered twice: %q", answer.Question), nil)
+		}
+		seen[answer.Question] = true
+
+		normalized := normalizeAnswer(answer.Answer)
+		if len([]rune(normalized)) < s.config.MinAnswerLength {
+			return invalidRequest(fmt.Sprintf("answers must be at least %d characters", s.config.MinAnswerLength), nil)
+		}
+
+		hash, err := hashSecret(normalized)
+		if err != nil {
+			return err
+		}
+		records = append(records, enrolledAnswer{Question: answer.Question, Hash: hash})
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return s.store.Save(userDN, data)
+}
+
+func (s *SecurityQuestionService) Name() string {
+	return "questions"
+}
+
+// Destinations is the user's DN once enough questions are answered, so
+// rate limits apply per user; Mask never shows it.
+func (s *SecurityQuestionService) Destinations(user *models.User) []string {
+	answers, err := s.load(user.DN)
+	if err != nil {
+		log.Printf("Failed to load security questions for %s: %v", user.DN, err)
+		return nil
+	}
+	if len(answers) < s.config.MinEnrolled {
+		return nil
+	}
+	return []string{user.DN}
+}
+
+func (s *SecurityQuestionService) Mask(destination string) string {
+	return "security questions"
+}
+
+// Start picks Ask of the user's questions at random as the prompt.
+func (s *SecurityQuestionService) Start(user *models.User, destination string, challenge *VerificationCode) error {
+	answers, err := s.load(user.DN)
+	if err != nil {
+		return err
+	}
+	if len(answers) < s.config.Ask {
+		return invalidRequest("not enough security questions are enrolled for this user", nil)
+	}
+
+	for i := len(answers) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return err
+		}
+		answers[i], answers[j.Int64()] = answers[j.Int64()], answers[i]
+	}
+
+	for _, answer := range answers[:s.config.Ask] {
+		challenge.Prompt = append(challenge.Prompt, answer.Question)
+	}
+	return nil
+}
+
+// Verify checks every answer against the prompt, in order. All answers
+// are hashed even after a mismatch so timing doesn't reveal which was wrong.
+func (s *SecurityQuestionService) Verify(challenge *VerificationCode, response ChallengeResponse) (bool, error) {
+	if len(challenge.Prompt) == 0 || len(response.Answers) != len(challenge.Prompt) {
+		return false, nil
+	}
+
+	answers, err := s.load(challenge.DN)
+	if err != nil {
+		return false, err
+	}
+	hashes := make(map[string]string, len(answers))
+	for _, answer := range answers {
+		hashes[answer.Question] = answer.Hash
+	}
+
+	valid := true
+	for i, question := range challenge.Prompt {
+		hash, ok := hashes[question]
+		if !verifySecret(hash, normalizeAnswer(response.Answers[i])) || !ok {
+			valid = false
+		}
+	}
+	return valid, nil
+}
+
+func (s *SecurityQuestionService) load(userDN string) ([]enrolledAnswer, error) {
+	data, err := s.store.Load(userDN)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+
+	var answers []enrolledAnswer
+	if err := json.Unmarshal(data, &answers); err != nil {
+		return nil, fmt.Errorf("invalid security question data: %w", err)
+	}
+	return answers, nil
+}
+
+func (s *SecurityQuestionService) inCatalog(question string) bool {
+	for _, q := range s.config.Questions {
+		if q == question {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeAnswer ignores case and extra whitespace, which users rarely
+// reproduce exactly.
+func normalizeAnswer(answer string) string {
+	return strings.ToLower(strings.Join(strings.Fields(answer), " "))
+}
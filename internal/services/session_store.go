@@ -0,0 +1,153 @@
+package services
+
+import (
+	"fmt"
+	"ldap-self-service/internal/config"
+	"sync"
+	"time"
+)
+
+// Session is a login as shown to its user: where it came from and when it
+// was last used. It lives until ExpiresAt, which each refresh extends, or
+// until it is revoked.
+type Session struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	DN         string    `json:"dn"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// SessionStore keeps active sessions. Like VerificationStore, stores are
+// responsible for expiry, and a shared store lets every replica see and
+// revoke the same sessions.
+type SessionStore interface {
+	// Put stores session, replacing any session with the same ID.
+	Put(session *Session) error
+	// Get returns the session with id, or nil when there is none or it has
+	// expired.
+	Get(id string) (*Session, error)
+	// List returns the unexpired sessions of userDN.
+	List(userDN string) ([]*Session, error)
+	// Update runs update on the session with id and stores the result in
+	// one atomic step, so a concurrent Delete on any replica is never
+	// undone. It returns the updated session, or nil without storing
+	// anything when there is none. update may be called more than once.
+	Update(id string, update func(session *Session)) (*Session, error)
+	// Delete removes the session with id. Deleting an unknown session is
+	// not an error.
+	Delete(id string) error
+}
+
+// NewSessionStore builds the store selected by cfg.Type.
+func NewSessionStore(cfg config.SessionStoreConfig) (SessionStore, error) {
+	switch cfg.Type {
+	case "", VerificationStoreMemory:
+		return NewMemorySessionStore(), nil
+	case VerificationStoreBolt:
+		return NewBoltSessionStore(cfg.Path)
+	case VerificationStoreRedis:
+		return NewRedisSessionStore(cfg.RedisURL, cfg.KeyPrefix)
+	default:
+		return nil, fmt.Errorf("unsupported session store: %s", cfg.Type)
+	}
+}
+
+// memorySessionStore keeps sessions in process. Everyone is signed out on
+// restart, and replicas don't see each other's sessions.
+type memorySessionStore struct {
+	sessions map[string]*Session
+	mutex    sync.RWMutex
+}
+
+func NewMemorySessionStore() SessionStore {
+	store := &memorySessionStore{
+		sessions: make(map[string]*Session),
+	}
+
+	go store.cleanupExpiredSessions()
+	return store
+}
+
+func (s *memorySessionStore) Put(session *Session) error {
+	stored := *session
+
+	s.mutex.Lock()
+	s.sessions[session.ID] = &stored
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *memorySessionStore) Get(id string) (*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	session, exists := s.sessions[id]
+	if !exists || time.Now().After(session.ExpiresAt) {
+		return nil, nil
+	}
+
+	found := *session
+	return &found, nil
+}
+
+func (s *memorySessionStore) List(userDN string) ([]*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	key := normalizeDN(userDN)
+	now := time.Now()
+	var sessions []*Session
+	for _, session := range s.sessions {
+		if normalizeDN(session.DN) == key && !now.After(session.ExpiresAt) {
+			found := *session
+			sessions = append(sessions, &found)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *memorySessionStore) Update(id string, update func(session *Session)) (*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session, exists := s.sessions[id]
+	if !exists || time.Now().After(session.ExpiresAt) {
+		return nil, nil
+	}
+
+	stored := *session
+	update(&stored)
+	s.sessions[id] = &stored
+
+	updated := stored
+	return &updated, nil
+}
+
+func (s *memorySessionStore) Delete(id string) error {
+	s.mutex.Lock()
+	delete(s.sessions, id)
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *memorySessionStore) cleanupExpiredSessions() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mutex.Lock()
+		now := time.Now()
+		for id, session := range s.sessions {
+			if now.After(session.ExpiresAt) {
+				delete(s.sessions, id)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var sessionBucket = []byte("sessions")
+
+// boltSessionStore persists sessions in an embedded bbolt database so users
+// stay signed in across restarts. Listing scans every session, which is
+// fine at the scale of a single instance.
+type boltSessionStore struct {
+	db *bolt.DB
+}
+
+func NewBoltSessionStore(path string) (SessionStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("session_store.path is required for the bolt store")
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &boltSessionStore{db: db}
+	go store.cleanupExpiredSessions()
+	return store, nil
+}
+
+func (s *boltSessionStore) Put(session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionBucket).Put([]byte(session.ID), data)
+	})
+}
+
+func (s *boltSessionStore) Get(id string) (*Session, error) {
+	var session *Session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(sessionBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		session = &Session{}
+		return json.Unmarshal(data, session)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if session == nil || time.Now().After(session.ExpiresAt) {
+		return nil, nil
+	}
+	return session, nil
+}
+
+func (s *boltSessionStore) List(userDN string) ([]*Session, error) {
+	key := normalizeDN(userDN)
+	now := time.Now()
+
+	var sessions []*Session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionBucket).ForEach(func(_, data []byte) error {
+			var session Session
+			if err := json.Unmarshal(data, &session); err != nil {
+				return err
+			}
+			if normalizeDN(session.DN) == key && !now.After(session.ExpiresAt) {
+				sessions = append(sessions, &session)
+			}
+			return nil
+		})
+	})
+	return sessions, err
+}
+
+func (s *boltSessionStore) Update(id string, update func(session *Session)) (*Session, error) {
+	var session *Session
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		var current Session
+		if err := json.Unmarshal(data, &current); err != nil {
+			return err
+		}
+		if time.Now().After(current.ExpiresAt) {
+			return nil
+		}
+
+		update(&current)
+		data, err := json.Marshal(&current)
+		if err != nil {
+			return err
+		}
+		session = &current
+		return bucket.Put([]byte(id), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *boltSessionStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltSessionStore) cleanupExpiredSessions() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			cursor := tx.Bucket(sessionBucket).Cursor()
+			for key, data := cursor.First(); key != nil; key, data = cursor.Next() {
+				var session Session
+				if json.Unmarshal(data, &session) != nil || now.After(session.ExpiresAt) {
+					if err := cursor.Delete(); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to purge expired sessions: %v", err)
+		}
+	}
+}
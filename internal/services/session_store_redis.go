@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisSessionStore keeps sessions in Redis so every replica sees them.
+// Each session is a key with a TTL, and a set per user indexes their
+// session IDs; IDs whose session has expired are pruned when listing.
+type redisSessionStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisSessionStore(redisURL, prefix string) (SessionStore, error) {
+	client, err := connectRedis(redisURL, "session_store.redis_url")
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisSessionStore{client: client, prefix: prefix}, nil
+}
+
+func (s *redisSessionStore) sessionKey(id string) string {
+	return s.prefix + "session:" + id
+}
+
+func (s *redisSessionStore) userKey(userDN string) string {
+	return s.prefix + "user-sessions:" + normalizeDN(userDN)
+}
+
+func (s *redisSessionStore) Put(session *Session) error {
+	ttl := time.Until(session.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	userKey := s.userKey(session.DN)
+	pipe := s.client.TxPipeline()
+	pipe.Set(ctx, s.sessionKey(session.ID), data, ttl)
+	pipe.SAdd(ctx, userKey, session.ID)
+	indexTTL := pipe.PTTL(ctx, userKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	// The index must outlive the user's longest session.
+	if indexTTL.Val() < ttl {
+		return s.client.PExpire(ctx, userKey, ttl).Err()
+	}
+	return nil
+}
+
+func (s *redisSessionStore) Get(id string) (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return decodeSession(s.client.Get(ctx, s.sessionKey(id)).Bytes())
+}
+
+// Update is an optimistic transaction like redisVerificationStore.Update.
+// The write is also SET XX, so it can only replace a session, never
+// recreate a deleted one.
+func (s *redisSessionStore) Update(id string, update func(session *Session)) (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := s.sessionKey(id)
+	var session *Session
+	var indexTTL *redis.DurationCmd
+	transaction := func(tx *redis.Tx) error {
+		current, err := decodeSession(tx.Get(ctx, key).Bytes())
+		if err != nil {
+			return err
+		}
+		session = current
+		if current == nil {
+			return nil
+		}
+
+		update(current)
+		data, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+
+		ttl := time.Until(current.ExpiresAt)
+		userKey := s.userKey(current.DN)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if ttl > 0 {
+				pipe.SetArgs(ctx, key, data, redis.SetArgs{Mode: "XX", TTL: ttl})
+			} else {
+				pipe.Del(ctx, key)
+			}
+			pipe.SAdd(ctx, userKey, current.ID)
+			indexTTL = pipe.PTTL(ctx, userKey)
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < maxUpdateRetries; i++ {
+		err := s.client.Watch(ctx, transaction, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			time.Sleep(time.Duration(mathrand.Int63n(int64(time.Millisecond) * int64(i+1))))
+			continue
+		}
+		if err != nil || session == nil {
+			return nil, err
+		}
+
+		if ttl := time.Until(session.ExpiresAt); indexTTL.Val() < ttl {
+			if err := s.client.PExpire(ctx, s.userKey(session.DN), ttl).Err(); err != nil {
+				return nil, err
+			}
+		}
+		return session, nil
+	}
+	return nil, fmt.Errorf("too much contention updating session %s", id)
+}
+
+func (s *redisSessionStore) List(userDN string) ([]*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	userKey := s.userKey(userDN)
+	ids, err := s.client.SMembers(ctx, userKey).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.sessionKey(id)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var sessions []*Session
+	var stale []interface{}
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			stale = append(stale, ids[i])
+			continue
+		}
+		var session Session
+		if err := json.Unmarshal([]byte(data), &session); err != nil {
+			return nil, err
+		}
+		if !now.After(session.ExpiresAt) {
+			sessions = append(sessions, &session)
+		}
+	}
+
+	if len(stale) > 0 {
+		if err := s.client.SRem(ctx, userKey, stale...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+func (s *redisSessionStore) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The ID stays in the user's index until the next List prunes it.
+	return s.client.Del(ctx, s.sessionKey(id)).Err()
+}
+
+// decodeSession decodes the reply to a GET, treating a missing or expired
+// session as nil.
+func decodeSession(data []byte, err error) (*Session, error) {
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, nil
+	}
+	return &session, nil
+}
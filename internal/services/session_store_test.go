@@ -0,0 +1,154 @@
+package services
+
+import (
+	"errors"
+	"ldap-self-service/internal/config"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// sessionStores returns one of each store type, with Redis served by
+// miniredis.
+func sessionStores(t *testing.T) map[string]SessionStore {
+	t.Helper()
+
+	bolt, err := NewBoltSessionStore(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatalf("NewBoltSessionStore: %v", err)
+	}
+
+	server := miniredis.RunT(t)
+	redis, err := NewRedisSessionStore("redis://"+server.Addr(), "test:")
+	if err != nil {
+		t.Fatalf("NewRedisSessionStore: %v", err)
+	}
+
+	return map[string]SessionStore{
+		VerificationStoreMemory: NewMemorySessionStore(),
+		VerificationStoreBolt:   bolt,
+		VerificationStoreRedis:  redis,
+	}
+}
+
+func testSession(id string) *Session {
+	now := time.Now()
+	return &Session{
+		ID:         id,
+		Username:   "alice",
+		DN:         "uid=alice,dc=example,dc=com",
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Hour),
+	}
+}
+
+func TestSessionStoreUpdate(t *testing.T) {
+	for name, store := range sessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Put(testSession("s1")); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			updated, err := store.Update("s1", func(session *Session) { session.IP = "192.0.2.1" })
+			if err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			if updated == nil || updated.IP != "192.0.2.1" {
+				t.Fatalf("Update = %+v, want the updated session", updated)
+			}
+			if got, err := store.Get("s1"); err != nil || got == nil || got.IP != "192.0.2.1" {
+				t.Fatalf("Get after Update = %+v, %v; want the updated session", got, err)
+			}
+			if sessions, err := store.List("uid=alice,dc=example,dc=com"); err != nil || len(sessions) != 1 {
+				t.Fatalf("List after Update = %v, %v; want one session", sessions, err)
+			}
+
+			called := false
+			missing, err := store.Update("missing", func(*Session) { called = true })
+			if err != nil || missing != nil || called {
+				t.Fatalf("Update(missing) = %+v, %v, called %v; want nil, nil, false", missing, err, called)
+			}
+			if got, err := store.Get("missing"); err != nil || got != nil {
+				t.Fatalf("Get(missing) after Update = %+v, %v; want nil, nil", got, err)
+			}
+		})
+	}
+}
+
+// TestSessionStoreUpdateConcurrentDelete deletes the session, as another
+// replica signing it out would, after Update has read it and before it
+// writes it back. The session must stay deleted.
+func TestSessionStoreUpdateConcurrentDelete(t *testing.T) {
+	for name, store := range sessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Put(testSession("s1")); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			deleted := make(chan error, 1)
+			once := false
+			_, err := store.Update("s1", func(session *Session) {
+				if once {
+					return
+				}
+				once = true
+				go func() { deleted <- store.Delete("s1") }()
+				// Stores that lock the session make Delete wait for
+				// Update; give the others time to let it through.
+				select {
+				case err := <-deleted:
+					deleted <- err
+				case <-time.After(50 * time.Millisecond):
+				}
+				session.IP = "192.0.2.1"
+			})
+			if err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			if err := <-deleted; err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+
+			if got, err := store.Get("s1"); err != nil || got != nil {
+				t.Fatalf("Get = %+v, %v; the deleted session came back", got, err)
+			}
+		})
+	}
+}
+
+func TestTouchSessionAfterRevoke(t *testing.T) {
+	for name, sessions := range sessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.Config{JWT: config.JWTConfig{Secret: "test-secret", Expiration: 300, RefreshExpiration: 3600}}
+			service, err := NewAuthService(cfg, NewMemoryVerificationStore(), sessions)
+			if err != nil {
+				t.Fatalf("NewAuthService: %v", err)
+			}
+
+			pair, err := service.GenerateSession("alice", "uid=alice,dc=example,dc=com", "test", "127.0.0.1")
+			if err != nil {
+				t.Fatalf("GenerateSession: %v", err)
+			}
+			claims, err := service.ValidateToken(pair.AccessToken)
+			if err != nil {
+				t.Fatalf("ValidateToken: %v", err)
+			}
+			if err := sessions.Delete(claims.SessionID); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+
+			if err := service.TouchSession(claims.SessionID, "192.0.2.1"); err != nil {
+				t.Fatalf("TouchSession: %v", err)
+			}
+			if _, err := service.Refresh(pair.RefreshToken); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("Refresh of a revoked session = %v, want %v", err, ErrInvalidToken)
+			}
+			if got, err := sessions.Get(claims.SessionID); err != nil || got != nil {
+				t.Fatalf("Get = %+v, %v; the revoked session came back", got, err)
+			}
+		})
+	}
+}
@@ -1,98 +1,51 @@
 package services
 
 import (
-	"crypto/rand"
 	"fmt"
 	"io"
 	"ldap-self-service/internal/config"
-	"math/big"
+	"ldap-self-service/internal/models"
 	"net/http"
 	"net/url"
-	"sync"
 	"time"
 )
 
 type SMSService struct {
 	config *config.Config
-	codes  map[string]*SMSVerificationCode
-	mutex  sync.RWMutex
-}
-
-type SMSVerificationCode struct {
-	Code      string
-	Phone     string
-	Username  string
-	ExpiresAt time.Time
-	Token     string
 }
 
 func NewSMSService(cfg *config.Config) *SMSService {
-	service := &SMSService{
-		config: cfg,
-		codes:  make(map[string]*SMSVerificationCode),
-	}
-	
-	go service.cleanupExpiredCodes()
-	return service
+	return &SMSService{config: cfg}
 }
 
-func (s *SMSService) SendVerificationCode(phone, username string) (string, error) {
-	code, err := s.generateCode()
-	if err != nil {
-		return "", err
-	}
-
-	token, err := s.generateToken()
-	if err != nil {
-		return "", err
-	}
-
-	s.mutex.Lock()
-	s.codes[token] = &SMSVerificationCode{
-		Code:      code,
-		Phone:     phone,
-		Username:  username,
-		ExpiresAt: time.Now().Add(10 * time.Minute),
-		Token:     token,
-	}
-	s.mutex.Unlock()
-
-	if err := s.sendSMS(phone, code); err != nil {
-		s.mutex.Lock()
-		delete(s.codes, token)
-		s.mutex.Unlock()
-		return "", err
-	}
-
-	return token, nil
+func (s *SMSService) Name() string {
+	return "sms"
 }
 
-func (s *SMSService) VerifyCode(token, code string) (bool, string) {
-	s.mutex.RLock()
-	verificationCode, exists := s.codes[token]
-	s.mutex.RUnlock()
-
-	if !exists {
-		return false, ""
+func (s *SMSService) Destinations(user *models.User) []string {
+	if len(user.Phones) == 0 && user.Phone != "" {
+		return []string{user.Phone}
 	}
+	return user.Phones
+}
 
-	if time.Now().After(verificationCode.ExpiresAt) {
-		s.mutex.Lock()
-		delete(s.codes, token)
-		s.mutex.Unlock()
-		return false, ""
+// Mask keeps only the last four digits.
+func (s *SMSService) Mask(destination string) string {
+	var digits []rune
+	for _, r := range destination {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, r)
+		}
 	}
-
-	if verificationCode.Code != code {
-		return false, ""
+	if len(digits) < 4 {
+		return "***-***-****"
 	}
+	return "***-***-" + string(digits[len(digits)-4:])
+}
 
-	phone := verificationCode.Phone
-	s.mutex.Lock()
-	delete(s.codes, token)
-	s.mutex.Unlock()
-
-	return true, phone
+// Send texts a verification code to destination.
+func (s *SMSService) Send(destination, code string) error {
+	return s.sendSMS(destination, code)
 }
 
 func (s *SMSService) sendSMS(phone, code string) error {
@@ -155,73 +108,3 @@ func (s *SMSService) sendAppriseSMS(phone, message string) error {
 	
 	return nil
 }
-
-func (s *SMSService) generateCode() (string, error) {
-	const charset = "0123456789"
-	code := make([]byte, 6)
-	
-	for i := range code {
-		num, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
-		if err != nil {
-			return "", err
-		}
-		code[i] = charset[num.Int64()]
-	}
-	
-	return string(code), nil
-}
-
-func (s *SMSService) generateToken() (string, error) {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	token := make([]byte, 32)
-	
-	for i := range token {
-		num, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
-		if err != nil {
-			return "", err
-		}
-		token[i] = charset[num.Int64()]
-	}
-	
-	return string(token), nil
-}
-
-func (s *SMSService) cleanupExpiredCodes() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		s.mutex.Lock()
-		now := time.Now()
-		for token, code := range s.codes {
-			if now.After(code.ExpiresAt) {
-				delete(s.codes, token)
-			}
-		}
-		s.mutex.Unlock()
-	}
-}
-
-func (s *SMSService) HasToken(token string) bool {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	
-	entry, exists := s.codes[token]
-	if !exists {
-		return false
-	}
-	
-	return time.Now().Before(entry.ExpiresAt)
-}
-
-func (s *SMSService) GetUsernameForToken(token string) string {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	
-	entry, exists := s.codes[token]
-	if !exists || time.Now().After(entry.ExpiresAt) {
-		return ""
-	}
-	
-	return entry.Username
-}
\ No newline at end of file
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"ldap-self-service/internal/config"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// RFC 6238 parameters. They are the defaults every authenticator app
+// understands, so they are not configurable.
+const (
+	totpDigits     = 6
+	totpPeriod     = 30
+	totpSecretSize = 20
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPService manages time-based one-time passwords (RFC 6238) used as a
+// second factor when logging in to the portal.
+//
+// A user's record holds the active secret, a pending secret while a new
+// authenticator is being set up, and the last time step accepted so a code
+// can't be replayed. Wrong codes count towards a per-user lockout.
+type TOTPService struct {
+	config      config.TOTPConfig
+	issuer      string
+	store       UserDataStore
+	lockout     *LockoutTracker
+	maxFailures int
+
+	// mutex serializes read-modify-write of records.
+	mutex sync.Mutex
+	now   func() time.Time
+}
+
+type totpRecord struct {
+	Secret   string `json:"secret,omitempty"`
+	Pending  string `json:"pending,omitempty"`
+	LastStep int64  `json:"lastStep,omitempty"`
+}
+
+// TOTPEnrollment is what a user needs to add the account to an
+// authenticator app.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	// QRCode is the URI as a PNG data URI.
+	QRCode string `json:"qrCode"`
+}
+
+func NewTOTPService(cfg *config.Config, ldapService *LDAPService, verificationStore VerificationStore) (*TOTPService, error) {
+	totp := cfg.TOTP
+
+	store, err := NewUserDataStore(ldapService, totp.Attribute, totp.StoreFile, "totp")
+	if err != nil {
+		return nil, err
+	}
+	if totp.Attribute == "" {
+		if totp.EncryptionKey == "" {
+			return nil, errors.New("totp.encryption_key is required when secrets are kept in totp.store_file")
+		}
+		store, err = newEncryptedUserDataStore(store, totp.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	issuer := totp.Issuer
+	if issuer == "" {
+		issuer = cfg.SiteName
+	}
+
+	return &TOTPService{
+		config:      totp,
+		issuer:      issuer,
+		store:       store,
+		maxFailures: cfg.Verification.UserMaxFailures,
+		lockout: NewLockoutTracker(verificationStore, "totp-lockout:",
+			time.Duration(cfg.Verification.FailureWindow)*time.Second,
+			time.Duration(cfg.Verification.LockoutDuration)*time.Second,
+		),
+		now: time.Now,
+	}, nil
+}
+
+// Required reports whether users must enroll before using the portal.
+func (s *TOTPService) Required() bool {
+	return s.config.Required
+}
+
+// PreAuthTTL is how long a user has to enter a code after their password.
+func (s *TOTPService) PreAuthTTL() time.Duration {
+	return time.Duration(s.config.PreAuthTTL) * time.Second
+}
+
+// Enrolled reports whether userDN has an active authenticator.
+func (s *TOTPService) Enrolled(userDN string) (bool, error) {
+	record, err := s.load(userDN)
+	if err != nil {
+		return false, err
+	}
+	return record.Secret != "", nil
+}
+
+// BeginEnrollment generates a new secret for userDN. It only replaces the
+// active one once ConfirmEnrollment proves the authenticator works.
+func (s *TOTPService) BeginEnrollment(username, userDN string) (*TOTPEnrollment, error) {
+	raw := make([]byte, totpSecretSize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	secret := totpEncoding.EncodeToString(raw)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, err := s.load(userDN)
+	if err != nil {
+		return nil, err
+	}
+	record.Pending = secret
+	if err := s.save(userDN, record); err != nil {
+		return nil, err
+	}
+
+	uri := s.provisioningURI(username, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TOTPEnrollment{
+		Secret: secret,
+		URI:    uri,
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}, nil
+}
+
+// ConfirmEnrollment activates the pending secret when code matches it.
+func (s *TOTPService) ConfirmEnrollment(username, userDN, code string) error {
+	return s.withRecord(username, userDN, func(record *totpRecord) error {
+		if record.Pending == "" {
+			return invalidRequest("no authenticator is being set up, start again", nil)
+		}
+
+		step, ok := s.validate(record.Pending, code, 0)
+		if !ok {
+			return ErrInvalidCode
+		}
+		record.Secret = record.Pending
+		record.Pending = ""
+		record.LastStep = step
+		return nil
+	})
+}
+
+// Disable removes userDN's authenticator after checking a current code.
+func (s *TOTPService) Disable(username, userDN, code string) error {
+	if s.config.Required {
+		return invalidRequest("two-factor authentication is required and cannot be turned off", nil)
+	}
+
+	return s.withRecord(username, userDN, func(record *totpRecord) error {
+		if err := s.check(record, code); err != nil {
+			return err
+		}
+		*record = totpRecord{}
+		return nil
+	})
+}
+
+// Verify checks a login code against userDN's active secret.
+func (s *TOTPService) Verify(username, userDN, code string) error {
+	return s.withRecord(username, userDN, func(record *totpRecord) error {
+		return s.check(record, code)
+	})
+}
+
+func (s *TOTPService) check(record *totpRecord, code string) error {
+	if record.Secret == "" {
+		return invalidRequest("two-factor authentication is not set up", nil)
+	}
+
+	step, ok := s.validate(record.Secret, code, record.LastStep)
+	if !ok {
+		return ErrInvalidCode
+	}
+	record.LastStep = step
+	return nil
+}
+
+// withRecord runs update on userDN's record under the lockout for
+// username, saving the record when update succeeds.
+func (s *TOTPService) withRecord(username, userDN string, update func(*totpRecord) error) error {
+	key := userLockoutKey(username)
+	if err := s.lockout.Check(key); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, err := s.load(userDN)
+	if err != nil {
+		return err
+	}
+
+	if err := update(record); err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			s.lockout.Failure(key, s.maxFailures)
+		}
+		return err
+	}
+	s.lockout.Success(key)
+
+	return s.save(userDN, record)
+}
+
+// validate looks for code within Skew steps of now, ignoring steps at or
+// before lastStep, and returns the matching step.
+func (s *TOTPService) validate(secret, code string, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := s.now().Unix() / totpPeriod
+	for offset := -int64(s.config.Skew); offset <= int64(s.config.Skew); offset++ {
+		step := current + offset
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// provisioningURI is the otpauth:// URI authenticator apps scan.
+func (s *TOTPService) provisioningURI(username, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", s.issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(s.issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func (s *TOTPService) load(userDN string) (*totpRecord, error) {
+	record := &totpRecord{}
+	data, err := s.store.Load(userDN)
+	if err != nil || len(data) == 0 {
+		return record, err
+	}
+
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("invalid TOTP data: %w", err)
+	}
+	return record, nil
+}
+
+func (s *TOTPService) save(userDN string, record *totpRecord) error {
+	if *record == (totpRecord{}) {
+		return s.store.Save(userDN, nil)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.store.Save(userDN, data)
+}
+
+// hotp computes an RFC 4226 code for counter.
+func hotp(key []byte, counter int64) string {
+	return otpCode(sha1.New, key, counter, totpDigits)
+}
+
+// otpCode computes an RFC 4226 code of the given length, using HMAC with
+// newHash so the SHA-256 and SHA-512 variants of RFC 6238 work too.
+func otpCode(newHash func() hash.Hash, key []byte, counter int64, digits int) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+
+	mac := hmac.New(newHash, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := uint64(binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff)
+
+	modulus := uint64(1)
+	for i := 0; i < digits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulus)
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"ldap-self-service/internal/config"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTOTPService(t *testing.T, skew int, now time.Time) *TOTPService {
+	t.Helper()
+
+	service, err := NewTOTPService(&config.Config{
+		SiteName: "Example",
+		TOTP: config.TOTPConfig{
+			Enabled:       true,
+			Skew:          skew,
+			StoreFile:     filepath.Join(t.TempDir(), "totp.json"),
+			EncryptionKey: "test-key",
+		},
+		Verification: config.VerificationConfig{UserMaxFailures: 3, FailureWindow: 300, LockoutDuration: 300},
+	}, nil, NewMemoryVerificationStore())
+	if err != nil {
+		t.Fatalf("NewTOTPService: %v", err)
+	}
+	service.now = func() time.Time { return now }
+	return service
+}
+
+// TestOTPCode checks the RFC 4226 and RFC 6238 test vectors.
+func TestOTPCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		newHash func() hash.Hash
+		key     string
+		counter int64
+		digits  int
+		want    string
+	}{
+		{name: "RFC 4226 counter 0", newHash: sha1.New, key: "12345678901234567890", counter: 0, digits: 6, want: "755224"},
+		{name: "RFC 4226 counter 1", newHash: sha1.New, key: "12345678901234567890", counter: 1, digits: 6, want: "287082"},
+		{name: "RFC 4226 counter 9", newHash: sha1.New, key: "12345678901234567890", counter: 9, digits: 6, want: "520489"},
+		{name: "RFC 6238 SHA-1", newHash: sha1.New, key: "12345678901234567890", counter: 59 / 30, digits: 8, want: "94287082"},
+		{name: "RFC 6238 SHA-1 leading zero", newHash: sha1.New, key: "12345678901234567890", counter: 1111111109 / 30, digits: 8, want: "07081804"},
+		{name: "RFC 6238 SHA-256", newHash: sha256.New, key: strings.Repeat("1234567890", 3) + "12", counter: 59 / 30, digits: 8, want: "46119246"},
+		{name: "RFC 6238 SHA-512", newHash: sha512.New, key: strings.Repeat("1234567890", 6) + "1234", counter: 59 / 30, digits: 8, want: "90693936"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := otpCode(tt.newHash, []byte(tt.key), tt.counter, tt.digits); got != tt.want {
+				t.Fatalf("otpCode = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTOTPServiceValidate(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := totpEncoding.EncodeToString(key)
+	now := time.Unix(1_700_000_000, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		code     string
+		skew     int
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current step", code: hotp(key, current), wantStep: current, wantOK: true},
+		{name: "previous step without skew", code: hotp(key, current-1)},
+		{name: "previous step within skew", code: hotp(key, current-1), skew: 1, wantStep: current - 1, wantOK: true},
+		{name: "next step within skew", code: hotp(key, current+1), skew: 1, wantStep: current + 1, wantOK: true},
+		{name: "beyond skew", code: hotp(key, current+2), skew: 1},
+		{name: "wider skew", code: hotp(key, current-2), skew: 2, wantStep: current - 2, wantOK: true},
+		{name: "step already used", code: hotp(key, current), lastStep: current},
+		{name: "earlier step already used", code: hotp(key, current-1), skew: 1, lastStep: current - 1},
+		{name: "later step still usable", code: hotp(key, current+1), skew: 1, lastStep: current, wantStep: current + 1, wantOK: true},
+		{name: "wrong code", code: "000000", skew: 1},
+		{name: "wrong length", code: hotp(key, current)[:5]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestTOTPService(t, tt.skew, now)
+			step, ok := service.validate(secret, tt.code, tt.lastStep)
+			if ok != tt.wantOK || ok && step != tt.wantStep {
+				t.Fatalf("validate = %d, %v; want %d, %v", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTOTPServiceEnrollment(t *testing.T) {
+	const userDN = "uid=alice,dc=example,dc=com"
+	now := time.Unix(1_700_000_000, 0)
+	service := newTestTOTPService(t, 1, now)
+
+	enrollment, err := service.BeginEnrollment("alice", userDN)
+	if err != nil {
+		t.Fatalf("BeginEnrollment: %v", err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/Example:alice?") {
+		t.Fatalf("URI = %s", enrollment.URI)
+	}
+	if enrolled, err := service.Enrolled(userDN); err != nil || enrolled {
+		t.Fatalf("Enrolled before confirmation = %v, %v; want false", enrolled, err)
+	}
+
+	key, err := totpEncoding.DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatalf("DecodeString: %v", err)
+	}
+	current := now.Unix() / totpPeriod
+	if err := service.ConfirmEnrollment("alice", userDN, hotp(key, current)); err != nil {
+		t.Fatalf("ConfirmEnrollment: %v", err)
+	}
+	if enrolled, err := service.Enrolled(userDN); err != nil || !enrolled {
+		t.Fatalf("Enrolled after confirmation = %v, %v; want true", enrolled, err)
+	}
+
+	// The code that confirmed the authenticator can't also log in.
+	if err := service.Verify("alice", userDN, hotp(key, current)); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("Verify(replayed code) = %v, want %v", err, ErrInvalidCode)
+	}
+	if err := service.Verify("alice", userDN, hotp(key, current+1)); err != nil {
+		t.Fatalf("Verify(next step) = %v", err)
+	}
+	if err := service.Verify("alice", userDN, hotp(key, current+1)); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("Verify(same code twice) = %v, want %v", err, ErrInvalidCode)
+	}
+	// Nor can an earlier step once a later one was accepted.
+	if err := service.Verify("alice", userDN, hotp(key, current-1)); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("Verify(earlier step) = %v, want %v", err, ErrInvalidCode)
+	}
+}
+
+func TestTOTPServiceLockout(t *testing.T) {
+	const userDN = "uid=alice,dc=example,dc=com"
+	now := time.Unix(1_700_000_000, 0)
+	service := newTestTOTPService(t, 0, now)
+
+	key := []byte("12345678901234567890")
+	if err := service.save(userDN, &totpRecord{Secret: totpEncoding.EncodeToString(key)}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := service.Verify("alice", userDN, "000000"); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("Verify(wrong code) = %v, want %v", err, ErrInvalidCode)
+		}
+	}
+
+	var throttled *ThrottleError
+	if err := service.Verify("alice", userDN, hotp(key, now.Unix()/totpPeriod)); !errors.As(err, &throttled) {
+		t.Fatalf("Verify after lockout = %v, want a *ThrottleError", err)
+	}
+}
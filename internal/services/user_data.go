@@ -0,0 +1,219 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// UserDataStore keeps one opaque value per user, keyed by DN, for features
+// whose per-user state may not fit the directory schema: either in an LDAP
+// attribute on the user's entry or in a local file.
+type UserDataStore interface {
+	// Load returns the value stored for userDN, or nil when there is none.
+	Load(userDN string) ([]byte, error)
+	// Save replaces the value for userDN; empty data removes it.
+	Save(userDN string, data []byte) error
+}
+
+// NewUserDataStore stores values in attribute when it is set, otherwise in
+// the JSON file at path. feature names the configuration in errors.
+func NewUserDataStore(ldapService *LDAPService, attribute, path, feature string) (UserDataStore, error) {
+	if attribute != "" {
+		return &ldapUserDataStore{ldap: ldapService, attribute: attribute}, nil
+	}
+	if path == "" {
+		return nil, fmt.Errorf("%s needs either an LDAP attribute or a local store file", feature)
+	}
+	return newFileUserDataStore(path)
+}
+
+// ldapUserDataStore keeps the value in a single-valued attribute of the
+// user's entry, written with the service account.
+type ldapUserDataStore struct {
+	ldap      *LDAPService
+	attribute string
+}
+
+func (s *ldapUserDataStore) Load(userDN string) ([]byte, error) {
+	values, err := s.ldap.readAttribute(userDN, s.attribute)
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+	return values[0], nil
+}
+
+func (s *ldapUserDataStore) Save(userDN string, data []byte) error {
+	var values []string
+	if len(data) > 0 {
+		values = []string{string(data)}
+	}
+	return s.ldap.replaceAttribute(userDN, s.attribute, values)
+}
+
+// fileUserDataStore is a UserDataStore persisted as a JSON document.
+type fileUserDataStore struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string][]byte
+}
+
+func newFileUserDataStore(path string) (*fileUserDataStore, error) {
+	store := &fileUserDataStore{
+		path:    path,
+		entries: make(map[string][]byte),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &store.entries); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+func (s *fileUserDataStore) Load(userDN string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]byte(nil), s.entries[normalizeDN(userDN)]...), nil
+}
+
+func (s *fileUserDataStore) Save(userDN string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := normalizeDN(userDN)
+	if len(data) == 0 {
+		delete(s.entries, key)
+	} else {
+		s.entries[key] = append([]byte(nil), data...)
+	}
+
+	encoded, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, encoded)
+}
+
+// encryptedUserDataStore seals values with AES-256-GCM before handing them
+// to the underlying store. The DN is authenticated with each value, so a
+// value copied to another user's entry doesn't decrypt.
+type encryptedUserDataStore struct {
+	store UserDataStore
+	aead  cipher.AEAD
+}
+
+// newEncryptedUserDataStore derives the encryption key from passphrase.
+func newEncryptedUserDataStore(store UserDataStore, passphrase string) (*encryptedUserDataStore, error) {
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedUserDataStore{store: store, aead: aead}, nil
+}
+
+func (s *encryptedUserDataStore) Load(userDN string) ([]byte, error) {
+	sealed, err := s.store.Load(userDN)
+	if err != nil || len(sealed) == 0 {
+		return nil, err
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("encrypted value is truncated")
+	}
+	data, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(normalizeDN(userDN)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt stored value: %w", err)
+	}
+	return data, nil
+}
+
+func (s *encryptedUserDataStore) Save(userDN string, data []byte) error {
+	if len(data) == 0 {
+		return s.store.Save(userDN, nil)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return s.store.Save(userDN, s.aead.Seal(nonce, nonce, data, []byte(normalizeDN(userDN))))
+}
+
+// readAttribute returns the raw values of attribute on userDN's entry.
+func (s *LDAPService) readAttribute(userDN, attribute string) ([][]byte, error) {
+	conn, err := s.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	searchRequest := ldap.NewSearchRequest(
+		userDN,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		1,
+		0,
+		false,
+		"(objectClass=*)",
+		[]string{attribute},
+		nil,
+	)
+
+	sr, err := conn.Search(searchRequest)
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %w", s.translateError(err, nil))
+	}
+	if len(sr.Entries) == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	return sr.Entries[0].GetRawAttributeValues(attribute), nil
+}
+
+// replaceAttribute sets attribute on userDN's entry to values; no values
+// removes the attribute.
+func (s *LDAPService) replaceAttribute(userDN, attribute string, values []string) error {
+	conn, err := s.connectWrite()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	modifyRequest := ldap.NewModifyRequest(userDN, nil)
+	modifyRequest.Replace(attribute, values)
+
+	if err := conn.Modify(modifyRequest); err != nil {
+		if len(values) == 0 && ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchAttribute) {
+			return nil
+		}
+		return fmt.Errorf("failed to update %s: %w", attribute, s.translateError(err, nil))
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"ldap-self-service/internal/config"
+	"sync"
+	"time"
+)
+
+// Verification store types selectable in the configuration.
+const (
+	VerificationStoreMemory = "memory"
+	VerificationStoreBolt   = "bolt"
+	VerificationStoreRedis  = "redis"
+)
+
+// VerificationCode is a pending challenge: a code sent to Destination by
+// Channel that proves control of it until ExpiresAt.
+type VerificationCode struct {
+	Token       string    `json:"token"`
+	Code        string    `json:"code"`
+	Channel     string    `json:"channel"`
+	Destination string    `json:"destination"`
+	Username    string    `json:"username"`
+	DN          string    `json:"dn,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	// Prompt holds what the user must answer, e.g. security questions.
+	Prompt []string `json:"prompt,omitempty"`
+	// Options is handed to the client to answer the challenge, e.g.
+	// WebAuthn assertion options.
+	Options json.RawMessage `json:"options,omitempty"`
+	// Data is channel state that never leaves the server.
+	Data string `json:"data,omitempty"`
+	// Attempts counts wrong codes submitted for this challenge.
+	Attempts int `json:"attempts"`
+}
+
+// VerificationStore keeps pending verification codes by key. Stores are
+// responsible for expiry: Get never returns a code past its ExpiresAt.
+// Shared stores let a reset started on one replica be confirmed on another.
+type VerificationStore interface {
+	// Put stores code under key, replacing any existing entry.
+	Put(key string, code *VerificationCode) error
+	// Get returns the code stored under key, or nil when there is none or
+	// it has expired.
+	Get(key string) (*VerificationCode, error)
+	// Delete removes key. Deleting an unknown key is not an error.
+	Delete(key string) error
+	// Take removes and returns the code stored under key in one step, so
+	// only one caller, on any replica, can redeem it. It returns nil like
+	// Get.
+	Take(key string) (*VerificationCode, error)
+	// Update atomically replaces the code under key with what update
+	// returns for the current one, which is nil when there is none or it
+	// has expired. Returning nil deletes key; returning an error leaves it
+	// unchanged and is passed on. update may be called again when key
+	// changes concurrently, so it must not have side effects.
+	Update(key string, update func(code *VerificationCode) (*VerificationCode, error)) error
+}
+
+// NewVerificationStore builds the store selected by cfg.Type.
+func NewVerificationStore(cfg config.VerificationStoreConfig) (VerificationStore, error) {
+	switch cfg.Type {
+	case "", VerificationStoreMemory:
+		return NewMemoryVerificationStore(), nil
+	case VerificationStoreBolt:
+		return NewBoltVerificationStore(cfg.Path)
+	case VerificationStoreRedis:
+		return NewRedisVerificationStore(cfg.RedisURL, cfg.KeyPrefix)
+	default:
+		return nil, fmt.Errorf("unsupported verification store: %s", cfg.Type)
+	}
+}
+
+// memoryVerificationStore keeps codes in process. Pending codes are lost on
+// restart and are not visible to other replicas.
+type memoryVerificationStore struct {
+	codes map[string]*VerificationCode
+	mutex sync.RWMutex
+}
+
+func NewMemoryVerificationStore() VerificationStore {
+	store := &memoryVerificationStore{
+		codes: make(map[string]*VerificationCode),
+	}
+
+	go store.cleanupExpiredCodes()
+	return store
+}
+
+func (s *memoryVerificationStore) Put(key string, code *VerificationCode) error {
+	stored := *code
+
+	s.mutex.Lock()
+	s.codes[key] = &stored
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *memoryVerificationStore) Get(key string) (*VerificationCode, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	code, exists := s.codes[key]
+	if !exists || time.Now().After(code.ExpiresAt) {
+		return nil, nil
+	}
+
+	found := *code
+	return &found, nil
+}
+
+func (s *memoryVerificationStore) Delete(key string) error {
+	s.mutex.Lock()
+	delete(s.codes, key)
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *memoryVerificationStore) Take(key string) (*VerificationCode, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	code, exists := s.codes[key]
+	delete(s.codes, key)
+	if !exists || time.Now().After(code.ExpiresAt) {
+		return nil, nil
+	}
+	return code, nil
+}
+
+func (s *memoryVerificationStore) Update(key string, update func(code *VerificationCode) (*VerificationCode, error)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var current *VerificationCode
+	if code, exists := s.codes[key]; exists && !time.Now().After(code.ExpiresAt) {
+		found := *code
+		current = &found
+	}
+
+	next, err := update(current)
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		delete(s.codes, key)
+		return nil
+	}
+	stored := *next
+	s.codes[key] = &stored
+	return nil
+}
+
+func (s *memoryVerificationStore) cleanupExpiredCodes() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mutex.Lock()
+		now := time.Now()
+		for token, code := range s.codes {
+			if now.After(code.ExpiresAt) {
+				delete(s.codes, token)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var verificationBucket = []byte("verification_codes")
+
+// boltVerificationStore persists codes in an embedded bbolt database so
+// pending resets survive a restart. The file is locked by one process at a
+// time, so it suits single-instance deployments.
+type boltVerificationStore struct {
+	db *bolt.DB
+}
+
+func NewBoltVerificationStore(path string) (VerificationStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("verification_store.path is required for the bolt store")
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open verification store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(verificationBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &boltVerificationStore{db: db}
+	go store.cleanupExpiredCodes()
+	return store, nil
+}
+
+func (s *boltVerificationStore) Put(key string, code *VerificationCode) error {
+	data, err := json.Marshal(code)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(verificationBucket).Put([]byte(key), data)
+	})
+}
+
+func (s *boltVerificationStore) Get(key string) (*VerificationCode, error) {
+	var code *VerificationCode
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		code, err = getUnexpiredCode(tx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+func (s *boltVerificationStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(verificationBucket).Delete([]byte(key))
+	})
+}
+
+func (s *boltVerificationStore) Take(key string) (*VerificationCode, error) {
+	var code *VerificationCode
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		code, err = getUnexpiredCode(tx, key)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(verificationBucket).Delete([]byte(key))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+func (s *boltVerificationStore) Update(key string, update func(code *VerificationCode) (*VerificationCode, error)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		current, err := getUnexpiredCode(tx, key)
+		if err != nil {
+			return err
+		}
+
+		next, err := update(current)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return tx.Bucket(verificationBucket).Delete([]byte(key))
+		}
+		data, err := json.Marshal(next)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(verificationBucket).Put([]byte(key), data)
+	})
+}
+
+func getUnexpiredCode(tx *bolt.Tx, key string) (*VerificationCode, error) {
+	data := tx.Bucket(verificationBucket).Get([]byte(key))
+	if data == nil {
+		return nil, nil
+	}
+
+	var code VerificationCode
+	if err := json.Unmarshal(data, &code); err != nil {
+		return nil, err
+	}
+	if time.Now().After(code.ExpiresAt) {
+		return nil, nil
+	}
+	return &code, nil
+}
+
+func (s *boltVerificationStore) cleanupExpiredCodes() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			cursor := tx.Bucket(verificationBucket).Cursor()
+			for key, data := cursor.First(); key != nil; key, data = cursor.Next() {
+				var code VerificationCode
+				if json.Unmarshal(data, &code) != nil || now.After(code.ExpiresAt) {
+					if err := cursor.Delete(); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to purge expired verification codes: %v", err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisVerificationStore keeps codes in Redis (or any server speaking its
+// protocol) so every replica sees the same pending resets. Expiry is
+// delegated to key TTLs.
+type redisVerificationStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisVerificationStore(redisURL, prefix string) (VerificationStore, error) {
+	client, err := connectRedis(redisURL, "verification_store.redis_url")
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisVerificationStore{client: client, prefix: prefix + "verification:"}, nil
+}
+
+// connectRedis opens and pings a client for redisURL. setting names the
+// configuration key in error messages.
+func connectRedis(redisURL, setting string) (*redis.Client, error) {
+	if redisURL == "" {
+		return nil, fmt.Errorf("%s is required for the redis store", setting)
+	}
+
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", setting, err)
+	}
+
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	return client, nil
+}
+
+func (s *redisVerificationStore) Put(key string, code *VerificationCode) error {
+	ttl := time.Until(code.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(code)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.client.Set(ctx, s.prefix+key, data, ttl).Err()
+}
+
+func (s *redisVerificationStore) Get(key string) (*VerificationCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return decodeCode(s.client.Get(ctx, s.prefix+key).Bytes())
+}
+
+func (s *redisVerificationStore) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.client.Del(ctx, s.prefix+key).Err()
+}
+
+// Take uses GETDEL, which needs Redis 6.2 or later.
+func (s *redisVerificationStore) Take(key string) (*VerificationCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return decodeCode(s.client.GetDel(ctx, s.prefix+key).Bytes())
+}
+
+// maxUpdateRetries bounds how often Update retries after losing a race.
+const maxUpdateRetries = 50
+
+// Update is an optimistic transaction: the write is discarded and update
+// run again when key changes between the read and the write.
+func (s *redisVerificationStore) Update(key string, update func(code *VerificationCode) (*VerificationCode, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key = s.prefix + key
+	transaction := func(tx *redis.Tx) error {
+		current, err := decodeCode(tx.Get(ctx, key).Bytes())
+		if err != nil {
+			return err
+		}
+
+		next, err := update(current)
+		if err != nil {
+			return err
+		}
+
+		var data []byte
+		var ttl time.Duration
+		if next != nil {
+			ttl = time.Until(next.ExpiresAt)
+			if data, err = json.Marshal(next); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if ttl > 0 {
+				pipe.Set(ctx, key, data, ttl)
+			} else {
+				pipe.Del(ctx, key)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < maxUpdateRetries; i++ {
+		err := s.client.Watch(ctx, transaction, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+		// Back off a little so concurrent writers stop colliding.
+		time.Sleep(time.Duration(mathrand.Int63n(int64(time.Millisecond) * int64(i+1))))
+	}
+	return fmt.Errorf("too much contention updating %s", key)
+}
+
+// decodeCode decodes the reply to a GET, treating a missing or expired
+// code as nil.
+func decodeCode(data []byte, err error) (*VerificationCode, error) {
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var code VerificationCode
+	if err := json.Unmarshal(data, &code); err != nil {
+		return nil, err
+	}
+	if time.Now().After(code.ExpiresAt) {
+		return nil, nil
+	}
+	return &code, nil
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// verificationStores returns one of each store type, with Redis served by
+// miniredis.
+func verificationStores(t *testing.T) map[string]VerificationStore {
+	t.Helper()
+
+	bolt, err := NewBoltVerificationStore(filepath.Join(t.TempDir(), "verification.db"))
+	if err != nil {
+		t.Fatalf("NewBoltVerificationStore: %v", err)
+	}
+
+	server := miniredis.RunT(t)
+	redis, err := NewRedisVerificationStore("redis://"+server.Addr(), "test:")
+	if err != nil {
+		t.Fatalf("NewRedisVerificationStore: %v", err)
+	}
+
+	return map[string]VerificationStore{
+		VerificationStoreMemory: NewMemoryVerificationStore(),
+		VerificationStoreBolt:   bolt,
+		VerificationStoreRedis:  redis,
+	}
+}
+
+func TestVerificationStorePutGetDelete(t *testing.T) {
+	for name, store := range verificationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			code := &VerificationCode{Token: "token", Code: "123456", Username: "jdoe", ExpiresAt: time.Now().Add(time.Minute)}
+			if err := store.Put("key", code); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			got, err := store.Get("key")
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if got == nil || got.Code != "123456" || got.Username != "jdoe" {
+				t.Fatalf("Get = %+v, want the stored code", got)
+			}
+
+			if got, err := store.Get("missing"); err != nil || got != nil {
+				t.Fatalf("Get(missing) = %+v, %v; want nil, nil", got, err)
+			}
+
+			if err := store.Delete("key"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if got, err := store.Get("key"); err != nil || got != nil {
+				t.Fatalf("Get after Delete = %+v, %v; want nil, nil", got, err)
+			}
+			if err := store.Delete("key"); err != nil {
+				t.Fatalf("Delete(unknown): %v", err)
+			}
+		})
+	}
+}
+
+func TestVerificationStoreExpiry(t *testing.T) {
+	for name, store := range verificationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			expired := &VerificationCode{Code: "123456", ExpiresAt: time.Now().Add(-time.Second)}
+			if err := store.Put("expired", expired); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if got, err := store.Get("expired"); err != nil || got != nil {
+				t.Fatalf("Get(expired) = %+v, %v; want nil, nil", got, err)
+			}
+			if got, err := store.Take("expired"); err != nil || got != nil {
+				t.Fatalf("Take(expired) = %+v, %v; want nil, nil", got, err)
+			}
+
+			expiring := &VerificationCode{Code: "654321", ExpiresAt: time.Now().Add(50 * time.Millisecond)}
+			if err := store.Put("expiring", expiring); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if got, err := store.Get("expiring"); err != nil || got != nil {
+				t.Fatalf("Get after expiry = %+v, %v; want nil, nil", got, err)
+			}
+		})
+	}
+}
+
+func TestVerificationStoreTake(t *testing.T) {
+	for name, store := range verificationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			code := &VerificationCode{Code: "123456", ExpiresAt: time.Now().Add(time.Minute)}
+			if err := store.Put("key", code); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			const racers = 10
+			var wg sync.WaitGroup
+			var mutex sync.Mutex
+			taken := 0
+			for i := 0; i < racers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					got, err := store.Take("key")
+					if err != nil {
+						t.Errorf("Take: %v", err)
+						return
+					}
+					if got != nil {
+						mutex.Lock()
+						taken++
+						mutex.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			if taken != 1 {
+				t.Fatalf("%d concurrent Takes succeeded, want 1", taken)
+			}
+			if got, err := store.Get("key"); err != nil || got != nil {
+				t.Fatalf("Get after Take = %+v, %v; want nil, nil", got, err)
+			}
+		})
+	}
+}
+
+func TestVerificationStoreUpdate(t *testing.T) {
+	for name, store := range verificationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			expiresAt := time.Now().Add(time.Minute)
+			increment := func(code *VerificationCode) (*VerificationCode, error) {
+				if code == nil {
+					code = &VerificationCode{ExpiresAt: expiresAt}
+				}
+				code.Attempts++
+				return code, nil
+			}
+
+			const updates = 20
+			var wg sync.WaitGroup
+			for i := 0; i < updates; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := store.Update("counter", increment); err != nil {
+						t.Errorf("Update: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			got, err := store.Get("counter")
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if got == nil || got.Attempts != updates {
+				t.Fatalf("Get = %+v, want %d attempts", got, updates)
+			}
+
+			failure := errors.New("rejected")
+			err = store.Update("counter", func(code *VerificationCode) (*VerificationCode, error) {
+				code.Attempts = 0
+				return nil, failure
+			})
+			if !errors.Is(err, failure) {
+				t.Fatalf("Update error = %v, want %v", err, failure)
+			}
+			if got, _ := store.Get("counter"); got == nil || got.Attempts != updates {
+				t.Fatalf("failed Update changed the code to %+v", got)
+			}
+
+			err = store.Update("counter", func(*VerificationCode) (*VerificationCode, error) {
+				return nil, nil
+			})
+			if err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			if got, err := store.Get("counter"); err != nil || got != nil {
+				t.Fatalf("Get after deleting Update = %+v, %v; want nil, nil", got, err)
+			}
+		})
+	}
+}
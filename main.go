@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"ldap-self-service/internal/config"
 	"ldap-self-service/internal/handlers"
 	"ldap-self-service/internal/middleware"
 	"ldap-self-service/internal/services"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -21,15 +27,93 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	ldapService := services.NewLDAPService(cfg)
+	ldapService, err := services.NewLDAPService(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize LDAP service:", err)
+	}
+	verificationStore, err := services.NewVerificationStore(cfg.VerificationStore)
+	if err != nil {
+		log.Fatal("Failed to initialize verification store:", err)
+	}
 	emailService := services.NewEmailService(cfg)
 	smsService := services.NewSMSService(cfg)
-	authService := services.NewAuthService(cfg)
+	rateLimiter, err := services.NewRateLimiter(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize rate limiter:", err)
+	}
+	channels := services.NewChannelRegistry(emailService, smsService)
+	if cfg.Reset.MagicLink {
+		magicLink, err := services.NewMagicLinkChannel(cfg, emailService, ldapService)
+		if err != nil {
+			log.Fatal("Failed to initialize reset links:", err)
+		}
+		channels.Register(magicLink)
+	}
+	var securityQuestions *services.SecurityQuestionService
+	if cfg.SecurityQuestions.Enabled {
+		securityQuestions, err = services.NewSecurityQuestionService(cfg, ldapService)
+		if err != nil {
+			log.Fatal("Failed to initialize security questions:", err)
+		}
+		channels.Register(securityQuestions)
+	}
+	if cfg.OTP.Enabled {
+		otpChannel, err := services.NewFreeIPAOTPChannel(cfg, ldapService)
+		if err != nil {
+			log.Fatal("Failed to initialize OTP tokens:", err)
+		}
+		channels.Register(otpChannel)
+	}
+	var passkeys *services.PasskeyService
+	if cfg.WebAuthn.Enabled {
+		passkeys, err = services.NewPasskeyService(cfg, ldapService, verificationStore)
+		if err != nil {
+			log.Fatal("Failed to initialize passkeys:", err)
+		}
+		// The assertion options can't be returned when the reset request
+		// answers before looking the user up.
+		if cfg.Reset.AntiEnumeration {
+			log.Printf("Passkeys are not offered for password resets because reset.anti_enumeration is enabled")
+		} else {
+			channels.Register(passkeys)
+		}
+	}
+	var totpService *services.TOTPService
+	if cfg.TOTP.Enabled {
+		totpService, err = services.NewTOTPService(cfg, ldapService, verificationStore)
+		if err != nil {
+			log.Fatal("Failed to initialize TOTP:", err)
+		}
+	}
+	challenges := services.NewChallengeManager(cfg, verificationStore, channels, rateLimiter)
+	sessionStore, err := services.NewSessionStore(cfg.SessionStore)
+	if err != nil {
+		log.Fatal("Failed to initialize session store:", err)
+	}
+	authService, err := services.NewAuthService(cfg, verificationStore, sessionStore)
+	if err != nil {
+		log.Fatal("Failed to initialize auth service:", err)
+	}
+
+	if cfg.ExpiryReminders.Enabled {
+		expiryNotifier, err := services.NewExpiryNotifier(cfg, ldapService, emailService, verificationStore)
+		if err != nil {
+			log.Fatal("Failed to initialize expiry reminders:", err)
+		}
+		expiryNotifier.Start()
+	}
 
 	router := gin.Default()
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal("Invalid trusted_proxies:", err)
+	}
 
 	router.Use(middleware.CORS())
-	router.Use(middleware.SessionMiddleware(cfg.SessionSecret))
+	sessionMiddleware, err := middleware.SessionMiddleware(cfg.SessionSecret, cfg.Session)
+	if err != nil {
+		log.Fatal("Invalid session settings:", err)
+	}
+	router.Use(sessionMiddleware)
 	router.Use(func(c *gin.Context) {
 		c.Set("authService", authService)
 		c.Next()
@@ -40,20 +124,50 @@ func main() {
 
 	api := router.Group("/api/v1")
 	{
-		api.POST("/login", handlers.Login(ldapService, authService))
-		api.POST("/verify-email", handlers.VerifyEmail(emailService))
-		api.POST("/verify-sms", handlers.VerifySMS(smsService))
-		api.POST("/reset-password", handlers.RequestPasswordReset(ldapService, emailService, smsService))
-		api.POST("/reset-password/confirm", handlers.ResetPassword(ldapService, emailService, smsService))
+		api.POST("/login", handlers.Login(ldapService, authService, totpService))
+		if passkeys != nil {
+			api.POST("/login/passkey/begin", handlers.BeginPasskeyLogin(ldapService, passkeys))
+			api.POST("/login/passkey/finish", handlers.FinishPasskeyLogin(ldapService, authService, passkeys))
+		}
+		if totpService != nil {
+			api.POST("/login/totp", handlers.LoginTOTP(ldapService, authService, totpService))
+		}
+		api.POST("/token/refresh", handlers.RefreshToken(authService))
+		api.POST("/verify-email", handlers.VerifyEmail(challenges))
+		api.POST("/verify-sms", handlers.VerifySMS(challenges))
+		api.POST("/reset-password/options", middleware.RateLimit(rateLimiter), handlers.GetResetOptions(cfg, ldapService, challenges))
+		api.POST("/reset-password", middleware.RateLimit(rateLimiter), handlers.RequestPasswordReset(cfg, ldapService, challenges))
+		api.POST("/reset-password/confirm", handlers.ResetPassword(ldapService, authService, challenges))
+		api.GET("/password-policy", handlers.GetPasswordPolicy(ldapService))
+		api.POST("/password/check", handlers.CheckPassword(ldapService))
 		
 		protected := api.Group("/")
 		protected.Use(middleware.AuthRequired())
 		{
-			protected.PUT("/password", handlers.UpdatePassword(ldapService))
+			protected.POST("/logout", handlers.Logout(authService))
+			protected.GET("/sessions", handlers.ListSessions(authService))
+			protected.DELETE("/sessions/:id", handlers.DeleteSession(authService))
+			protected.PUT("/password", handlers.UpdatePassword(ldapService, authService))
 			protected.GET("/ssh-keys", handlers.GetSSHKeys(ldapService))
 			protected.POST("/ssh-keys", handlers.AddSSHKey(ldapService))
 			protected.DELETE("/ssh-keys/:id", handlers.DeleteSSHKey(ldapService))
 			protected.GET("/profile", handlers.GetProfile(ldapService))
+			if securityQuestions != nil {
+				protected.GET("/security-questions", handlers.GetSecurityQuestions(securityQuestions))
+				protected.PUT("/security-questions", handlers.SetSecurityQuestions(ldapService, securityQuestions))
+			}
+			if passkeys != nil {
+				protected.GET("/passkeys", handlers.ListPasskeys(passkeys))
+				protected.POST("/passkeys/register/begin", handlers.BeginPasskeyRegistration(ldapService, passkeys))
+				protected.POST("/passkeys/register/finish", handlers.FinishPasskeyRegistration(ldapService, passkeys))
+				protected.DELETE("/passkeys/:id", handlers.DeletePasskey(passkeys))
+			}
+			if totpService != nil {
+				protected.GET("/totp", handlers.GetTOTPStatus(totpService))
+				protected.POST("/totp/enroll", handlers.BeginTOTPEnrollment(ldapService, totpService))
+				protected.POST("/totp/confirm", handlers.ConfirmTOTPEnrollment(totpService))
+				protected.POST("/totp/disable", handlers.DisableTOTP(totpService))
+			}
 		}
 	}
 
@@ -61,7 +175,43 @@ func main() {
 	router.GET("/login", handlers.LoginPage(cfg))
 	router.GET("/reset", handlers.ResetPasswordPage(cfg))
 	router.GET("/dashboard", handlers.Dashboard(cfg))
+	router.GET("/health", handlers.Health(ldapService))
+	if len(cfg.JWT.Keys) > 0 {
+		router.GET("/.well-known/jwks.json", handlers.JWKS(authService))
+	}
 
+	servers := []*http.Server{{Addr: ":" + cfg.Port, Handler: router}}
 	log.Printf("Server starting on port %s", cfg.Port)
-	router.Run(":" + cfg.Port)
+	if cfg.MonitoringAddr != "" {
+		monitoring := gin.New()
+		monitoring.Use(gin.Recovery())
+		monitoring.GET("/health", handlers.HealthDetails(ldapService))
+		servers = append(servers, &http.Server{Addr: cfg.MonitoringAddr, Handler: monitoring})
+		log.Printf("Monitoring listening on %s", cfg.MonitoringAddr)
+	}
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal("Server failed:", err)
+			}
+		}(server)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	log.Printf("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			// Requests may still be reading the breached password corpus.
+			log.Printf("Failed to shut down cleanly: %v", err)
+			return
+		}
+	}
+	if err := ldapService.Close(); err != nil {
+		log.Printf("Failed to close LDAP service: %v", err)
+	}
 }
\ No newline at end of file
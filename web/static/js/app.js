@@ -4,6 +4,18 @@
 axios.defaults.timeout = 10000;
 axios.defaults.headers.common['Content-Type'] = 'application/json';
 
+// Reads a cookie scripts are allowed to see, such as the CSRF token.
+function readCookie(name) {
+    const entry = document.cookie.split('; ').find(cookie => cookie.startsWith(name + '='));
+    return entry ? decodeURIComponent(entry.substring(name.length + 1)) : null;
+}
+
+// With cookie sessions the tokens live in an HttpOnly cookie instead of
+// localStorage, and requests echo the CSRF token from its readable cookie.
+function cookieSession() {
+    return localStorage.getItem('session') === 'cookie';
+}
+
 // Add request interceptor to include auth token
 axios.interceptors.request.use(
     config => {
@@ -11,6 +23,10 @@ axios.interceptors.request.use(
         if (token) {
             config.headers.Authorization = `Bearer ${token}`;
         }
+        const csrfToken = readCookie('ldap-csrf');
+        if (csrfToken) {
+            config.headers['X-CSRF-Token'] = csrfToken;
+        }
         return config;
     },
     error => {
@@ -18,12 +34,48 @@ axios.interceptors.request.use(
     }
 );
 
+// Concurrent 401s share one refresh: presenting the same refresh token twice
+// looks like token theft to the server and ends the session.
+let pendingRefresh = null;
+
+function refreshSession() {
+    if (!pendingRefresh) {
+        const body = cookieSession() ? {} : { refreshToken: localStorage.getItem('refreshToken') };
+        pendingRefresh = axios.post('/api/v1/token/refresh', body).then(response => {
+            if (response.data.token) {
+                localStorage.setItem('token', response.data.token);
+                localStorage.setItem('refreshToken', response.data.refreshToken);
+            }
+        }).finally(() => {
+            pendingRefresh = null;
+        });
+    }
+    return pendingRefresh;
+}
+
 // Add response interceptor to handle auth errors
 axios.interceptors.response.use(
     response => response,
-    error => {
+    async error => {
+        const request = error.config;
         if (error.response && error.response.status === 401) {
+            // Renew an expired access token once and retry, except for the
+            // login and refresh calls themselves.
+            const renewable = request && !request.retried &&
+                !request.url.startsWith('/api/v1/login') && request.url !== '/api/v1/token/refresh';
+            if (renewable && (localStorage.getItem('refreshToken') || cookieSession())) {
+                request.retried = true;
+                try {
+                    await refreshSession();
+                    return axios(request);
+                } catch (refreshError) {
+                    // Fall through and sign out.
+                }
+            }
+            
             localStorage.removeItem('token');
+            localStorage.removeItem('refreshToken');
+            localStorage.removeItem('session');
             localStorage.removeItem('user');
             if (window.location.pathname !== '/login') {
                 window.location.href = '/login';
@@ -200,6 +252,59 @@ window.AppUtils = {
             return permission === 'granted';
         }
         return false;
+    },
+    
+    // WebAuthn options and responses carry binary fields as base64url
+    base64urlToBuffer(value) {
+        const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+        const binary = atob(base64 + '='.repeat((4 - base64.length % 4) % 4));
+        return Uint8Array.from(binary, c => c.charCodeAt(0)).buffer;
+    },
+    
+    bufferToBase64url(buffer) {
+        const binary = String.fromCharCode(...new Uint8Array(buffer));
+        return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    },
+    
+    // Register a passkey with options from /passkeys/register/begin
+    async createPasskey(options) {
+        const publicKey = {
+            ...options.publicKey,
+            challenge: this.base64urlToBuffer(options.publicKey.challenge),
+            user: { ...options.publicKey.user, id: this.base64urlToBuffer(options.publicKey.user.id) },
+            excludeCredentials: (options.publicKey.excludeCredentials || []).map(c => ({ ...c, id: this.base64urlToBuffer(c.id) }))
+        };
+        const credential = await navigator.credentials.create({ publicKey });
+        return {
+            id: credential.id,
+            rawId: this.bufferToBase64url(credential.rawId),
+            type: credential.type,
+            response: {
+                clientDataJSON: this.bufferToBase64url(credential.response.clientDataJSON),
+                attestationObject: this.bufferToBase64url(credential.response.attestationObject)
+            }
+        };
+    },
+    
+    // Sign in with a passkey using options from a begin endpoint
+    async getPasskey(options) {
+        const publicKey = {
+            ...options.publicKey,
+            challenge: this.base64urlToBuffer(options.publicKey.challenge),
+            allowCredentials: (options.publicKey.allowCredentials || []).map(c => ({ ...c, id: this.base64urlToBuffer(c.id) }))
+        };
+        const credential = await navigator.credentials.get({ publicKey });
+        return {
+            id: credential.id,
+            rawId: this.bufferToBase64url(credential.rawId),
+            type: credential.type,
+            response: {
+                clientDataJSON: this.bufferToBase64url(credential.response.clientDataJSON),
+                authenticatorData: this.bufferToBase64url(credential.response.authenticatorData),
+                signature: this.bufferToBase64url(credential.response.signature),
+                userHandle: credential.response.userHandle ? this.bufferToBase64url(credential.response.userHandle) : undefined
+            }
+        };
     }
 };
 